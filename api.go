@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/codeserver"
+	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// codeServerLogSource is the source of code-server's output in the logs API.
+const codeServerLogSource = "code-server"
+
+// apiClient returns a client for the API of the proxy of the container
+// named cntName.
+func apiClient(cntName string) (*sailapi.Client, error) {
+	u, err := proxyURL(cntName)
+	if err != nil {
+		return nil, err
+	}
+	token, err := proxyToken(cntName)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get proxy token: %w", err)
+	}
+	return sailapi.New(u, token, proxyHTTPClient), nil
+}
+
+// handleAPI registers the handlers of the proxy's API on m.
+func (p *proxy) handleAPI(m *http.ServeMux) {
+	m.HandleFunc(sailapi.Prefix+sailapi.PathHealthz, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	m.HandleFunc(sailapi.Prefix+sailapi.PathStatus, p.status)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathRebuild, p.rebuild)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathStop, p.stop)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathLogs, p.logs)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathPorts, p.ports)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathConfig, p.config)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathRefresh, p.refresh)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathForwards, p.forwards)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathForwards+"/", p.closeForward)
+	m.HandleFunc(sailapi.Prefix+sailapi.PathMetrics, p.serveMetrics)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &sailapi.Error{Message: err.Error()})
+}
+
+// allowMethod responds with an error unless r was made with method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeAPIError(w, http.StatusMethodNotAllowed, xerrors.Errorf("method %v not allowed, use %v", r.Method, method))
+		return false
+	}
+	return true
+}
+
+// allowOrigin responds with an error unless r was made by a page of the
+// project itself or carries the token. Browsers authenticate with the
+// cookie, which other local pages are also sent as they're on the same site.
+// Every request that changes the project must be checked.
+func allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	err := checkOrigin(r)
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// apiStatus returns the state of the project. Probes are only checked
+// while the container is running.
+func (p *proxy) apiStatus() sailapi.Status {
+	st := sailapi.Status{
+		Project:   toSailName(p.cntName),
+		Container: p.cntName,
+		Probes:    []sailapi.Probe{},
+	}
+
+	cli := dockerClient()
+	defer cli.Close()
+	cnt, err := cli.ContainerInspect(context.Background(), p.cntName)
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.State = cnt.State.Status
+	if !cnt.State.Running {
+		return st
+	}
+
+	st.Port, _ = p.getCodeServerPort()
+	_, err = codeserver.PID(p.cntName)
+	st.CodeServer = err == nil
+
+	probes, err := checkProbes(p.cntName)
+	if err != nil {
+		st.Error = err.Error()
+	} else {
+		st.Probes = probes
+	}
+
+	st.Ready = st.CodeServer && err == nil
+	for _, probe := range st.Probes {
+		st.Ready = st.Ready && probe.Ready
+	}
+	return st
+}
+
+// status reports whether code-server is up and checks each of the
+// container's readiness probes. It responds with 503 until the project
+// is ready.
+func (p *proxy) status(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	st := p.apiStatus()
+	code := http.StatusOK
+	if !st.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, st)
+}
+
+// eventWriter streams events as JSON lines.
+type eventWriter struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+}
+
+func newEventWriter(w http.ResponseWriter) *eventWriter {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return &eventWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (ew *eventWriter) write(v interface{}) error {
+	err := ew.enc.Encode(v)
+	if f, ok := ew.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return err
+}
+
+// rebuild rebuilds the container with sail edit and streams its events.
+// Browsers open a websocket, and other clients POST and read the events as
+// JSON lines until the result. Only one rebuild runs at a time, later
+// requests watch the running one. It's canceled once all of them are gone.
+func (p *proxy) rebuild(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") == "websocket" {
+		p.rebuildWebsocket(w, r)
+		return
+	}
+
+	if !allowMethod(w, r, http.MethodPost) || !allowOrigin(w, r) {
+		return
+	}
+
+	ew := newEventWriter(w)
+	run := p.startRebuild()
+	defer run.release()
+	run.watch(r.Context(), func(e sailapi.Event) error {
+		return ew.write(e)
+	})
+}
+
+func (p *proxy) rebuildWebsocket(w http.ResponseWriter, r *http.Request) {
+	// Websockets aren't subject to the same-origin policy.
+	err := checkOrigin(r)
+	if err != nil {
+		writeAPIError(w, http.StatusForbidden, err)
+		return
+	}
+
+	c, err := websocket.Accept(w, r, websocket.AcceptOptions{})
+	if err != nil {
+		flog.Error("failed to accept rebuild websocket: %v", err)
+		return
+	}
+	defer c.Close(websocket.StatusInternalError, "rebuild failed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nothing is expected from the client, reading is only done to notice
+	// when it goes away.
+	go func() {
+		defer cancel()
+		for {
+			_, rd, err := c.Reader(ctx)
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, rd)
+		}
+	}()
+
+	run := p.startRebuild()
+	defer run.release()
+	err = run.watch(ctx, func(e sailapi.Event) error {
+		return wsjson.Write(ctx, c, e)
+	})
+	if err != nil {
+		return
+	}
+	c.Close(websocket.StatusNormalClosure, "")
+}
+
+// runRebuild runs sail edit, sending its events to emit, and ends
+// with the result. Canceling ctx cancels the rebuild.
+func (p *proxy) runRebuild(ctx context.Context, emit func(sailapi.Event) error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	start := time.Now()
+	rebuildErr := streamRun(ctx, p.configPath, emit, "edit", toSailName(p.cntName))
+
+	// Need to refresh the port before we signal the rebuild was successful.
+	// A failed rebuild may still have swapped the container if a
+	// post_rebuild hook failed.
+	err := p.refreshPort()
+	if err != nil {
+		flog.Error("%v", err)
+		if rebuildErr == nil {
+			rebuildErr = err
+		}
+	}
+	p.recordRebuild(start, rebuildErr)
+
+	result := sailapi.Event{Type: sailapi.EventResult}
+	if rebuildErr != nil {
+		result.Error = rebuildErr.Error()
+	}
+	emit(result)
+}
+
+// stop stops the container. The next request to the project starts it again.
+func (p *proxy) stop(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !allowOrigin(w, r) {
+		return
+	}
+
+	err := stopContainer(p.cntName)
+	if err != nil {
+		p.recordError(err)
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	p.stopped()
+	writeJSON(w, http.StatusOK, p.apiStatus())
+}
+
+// logSourcePath returns the file inside of the container that holds
+// the output of source.
+func logSourcePath(source string) (string, bool) {
+	if source == codeServerLogSource {
+		return containerLogPath, true
+	}
+	if _, ok := defaultHooks[source]; ok {
+		return hookLogPath(source), true
+	}
+	return "", false
+}
+
+// tailLog starts reading the file at path inside of the container named
+// cntName. tail is killed once stdin is closed, as killing docker exec
+// doesn't stop the command inside of the container.
+func tailLog(cntName, path string, follow bool) (*exec.Cmd, io.WriteCloser, io.Reader, error) {
+	script := `tail -n +1 "$1" 2>/dev/null || true`
+	if follow {
+		script = `tail -n +1 -F "$1" 2>/dev/null & read _; kill $!`
+	}
+	cmd := dockutil.Exec(cntName, "sh", "-c", script, "sh", path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cmd, stdin, stdout, nil
+}
+
+// streamLogs sends each line of the output of sources to emit. With follow,
+// it keeps sending new lines until ctx is done.
+func streamLogs(ctx context.Context, cntName string, sources []string, follow bool, emit func(sailapi.LogLine) error) error {
+	paths := make([]string, len(sources))
+	for i, source := range sources {
+		path, ok := logSourcePath(source)
+		if !ok {
+			return xerrors.Errorf("unknown log source %q", source)
+		}
+		paths[i] = path
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		emitErr error
+	)
+	defer wg.Wait()
+
+	for i, source := range sources {
+		cmd, stdin, stdout, err := tailLog(cntName, paths[i], follow)
+		if err != nil {
+			cancel()
+			return xerrors.Errorf("failed to read %v: %w", source, err)
+		}
+
+		wg.Add(1)
+		go func(source string) {
+			defer wg.Done()
+			defer cmd.Wait()
+			go func() {
+				<-ctx.Done()
+				stdin.Close()
+			}()
+
+			s := bufio.NewScanner(stdout)
+			s.Buffer(nil, 1<<20)
+			for s.Scan() {
+				mu.Lock()
+				if emitErr == nil {
+					emitErr = emit(sailapi.LogLine{Source: source, Line: s.Text()})
+				}
+				failed := emitErr != nil
+				mu.Unlock()
+				if failed {
+					cancel()
+					break
+				}
+			}
+			io.Copy(ioutil.Discard, stdout)
+		}(source)
+	}
+
+	wg.Wait()
+	return emitErr
+}
+
+// logs streams the output of the project's lifecycle hooks and of code-server.
+func (p *proxy) logs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+	sources := q["source"]
+	if len(sources) == 0 {
+		sources = append(append([]string(nil), hookNames...), codeServerLogSource)
+	}
+	for _, source := range sources {
+		if _, ok := logSourcePath(source); !ok {
+			writeAPIError(w, http.StatusBadRequest, xerrors.Errorf("unknown log source %q, must be one of %v or %v",
+				source, strings.Join(hookNames, ", "), codeServerLogSource))
+			return
+		}
+	}
+	_, follow := q["follow"]
+	if v := q.Get("follow"); v != "" {
+		var err error
+		follow, err = strconv.ParseBool(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, xerrors.Errorf("invalid follow %q: %w", v, err))
+			return
+		}
+	}
+
+	p.mu.Lock()
+	off := p.off
+	p.mu.Unlock()
+	if off {
+		writeAPIError(w, http.StatusConflict, xerrors.Errorf("container %v is not running", p.cntName))
+		return
+	}
+
+	ew := newEventWriter(w)
+	err := streamLogs(r.Context(), p.cntName, sources, follow, func(l sailapi.LogLine) error {
+		return ew.write(l)
+	})
+	if err != nil && r.Context().Err() == nil {
+		flog.Error("failed to stream logs of %v: %v", p.cntName, err)
+	}
+}
+
+// ports lists the ports listened on inside of the container.
+func (p *proxy) ports(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	ports, err := containerPorts(p.cntName, p.url)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ports)
+}
+
+// containerConfig returns the configuration that the container named
+// cntName was created with, as recorded in its labels.
+func containerConfig(cntName string) (sailapi.Config, error) {
+	cli := dockerClient()
+	defer cli.Close()
+
+	cnt, err := cli.ContainerInspect(context.Background(), cntName)
+	if err != nil {
+		return sailapi.Config{}, err
+	}
+	labels := cnt.Config.Labels
+
+	conf := sailapi.Config{
+		Project:     toSailName(cntName),
+		Image:       cnt.Config.Image,
+		Hat:         labels[hatLabel],
+		ProjectDir:  labels[projectDirLabel],
+		LocalDir:    labels[projectLocalDirLabel],
+		ProxyURL:    labels[proxyURLLabel],
+		IdleTimeout: labels[idleTimeoutLabel],
+		ForwardGPG:  labels[forwardGPGLabel] == "true",
+		Dotfiles:    labels[dotfilesLabel],
+		Env:         []string{},
+		Probes:      []string{},
+
+		CodeServerVersion: labels[codeServerVersionLabel],
+	}
+	for _, name := range strings.Split(labels[runEnvLabel], ",") {
+		if name != "" {
+			conf.Env = append(conf.Env, name)
+		}
+	}
+
+	probes, _, err := containerProbes(cntName)
+	if err != nil {
+		return sailapi.Config{}, err
+	}
+	conf.Probes = append(conf.Probes, sortedProbeNames(probes)...)
+	return conf, nil
+}
+
+// config responds with the configuration the container was created with.
+func (p *proxy) config(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	conf, err := containerConfig(p.cntName)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, conf)
+}
+
+// refresh finds the code-server port again after sail edit replaced the container.
+func (p *proxy) refresh(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) || !allowOrigin(w, r) {
+		return
+	}
+	err := p.refreshPort()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
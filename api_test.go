@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.coder.com/sail/internal/sailapi"
+)
+
+func Test_proxyAPI(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy("http://cdr--sail.localhost:7080", "cdr_sail", &proxyAuth{cntName: "cdr_sail", token: "token"})
+
+	serve := func(method, path string, header http.Header) (int, sailapi.Error) {
+		r := httptest.NewRequest(method, "http://cdr--sail.localhost:7080"+sailapi.Prefix+path, nil)
+		r.Header.Set("Authorization", "Bearer token")
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		p.handler.ServeHTTP(w, r)
+
+		var apiErr sailapi.Error
+		if w.Code != http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &apiErr), w.Body.String())
+		}
+		return w.Code, apiErr
+	}
+
+	code, apiErr := serve("GET", sailapi.PathRebuild, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	assert.Equal(t, "method GET not allowed, use POST", apiErr.Message)
+
+	code, _ = serve("GET", sailapi.PathLogs+"?source=on_boot", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = serve("GET", sailapi.PathLogs+"?follow=maybe", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = serve("DELETE", sailapi.PathForwards+"/nope", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Browsers authenticate with the cookie, so changes to the project
+	// must come from its own pages.
+	changes := []struct {
+		method string
+		path   string
+	}{
+		{"POST", sailapi.PathRebuild},
+		{"POST", sailapi.PathStop},
+		{"POST", sailapi.PathRefresh},
+		{"POST", sailapi.PathForwards},
+		{"DELETE", sailapi.PathForwards + "/nope"},
+	}
+	for _, c := range changes {
+		for _, origin := range []string{"http://evil.com", "http://localhost:8080", ""} {
+			code, apiErr = serve(c.method, c.path, http.Header{
+				"Authorization": {""},
+				"Cookie":        {proxyTokenCookiePrefix + "cdr_sail=token"},
+				"Content-Type":  {"text/plain"},
+				"Origin":        {origin},
+			})
+			assert.Equal(t, http.StatusForbidden, code, "%v %v from %q", c.method, c.path, origin)
+		}
+	}
+
+	// Websockets aren't subject to the same-origin policy, even with the token.
+	code, apiErr = serve("GET", sailapi.PathRebuild, http.Header{
+		"Connection":            {"Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+		"Origin":                {"http://evil.com"},
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Contains(t, apiErr.Message, "doesn't match host")
+}
+
+func Test_logSourcePath(t *testing.T) {
+	t.Parallel()
+
+	path, ok := logSourcePath("code-server")
+	assert.True(t, ok)
+	assert.Equal(t, containerLogPath, path)
+
+	path, ok = logSourcePath(onStartHook)
+	assert.True(t, ok)
+	assert.Equal(t, hookLogPath(onStartHook), path)
+
+	_, ok = logSourcePath("../../etc/passwd")
+	assert.False(t, ok)
+}
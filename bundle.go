@@ -0,0 +1,716 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/xexec"
+)
+
+// A bundle is a tar archive holding everything needed to recreate a project's
+// environment on another machine, except for the repository itself:
+//
+//	manifest.json   the bundleManifest, always the first entry
+//	config.toml     the project's effective config overrides
+//	Dockerfile      the project's .sail/Dockerfile, if it has one
+//	hat/            the sources of the project's hat, if it has one
+//	image.tar       the built images as written by docker save, unless excluded
+const (
+	bundleVersion = 1
+
+	bundleManifestName   = "manifest.json"
+	bundleConfigName     = "config.toml"
+	bundleDockerfileName = "Dockerfile"
+	bundleHatDir         = "hat"
+	bundleImageName      = "image.tar"
+)
+
+// bundleManifest describes the contents of a bundle.
+type bundleManifest struct {
+	Version int `json:"version"`
+	// Repo is the clone URI of the project's repository.
+	Repo string `json:"repo"`
+	// Image is the image the project's container was created from.
+	Image string `json:"image"`
+	// BaseImage is the image before the hat was applied.
+	BaseImage string `json:"base_image,omitempty"`
+	// IncludesImage is set if the bundle contains image.tar.
+	IncludesImage bool `json:"includes_image"`
+	// Hat is set if the bundle contains the project's hat.
+	Hat bool `json:"hat"`
+	// Labels are the labels of the project's container.
+	Labels map[string]string `json:"labels"`
+	// Extensions are the VS Code extensions installed on the host.
+	Extensions []string  `json:"extensions"`
+	Created    time.Time `json:"created"`
+}
+
+// importDir returns the directory the hat and Dockerfile of an
+// imported bundle are kept in.
+func importDir(cntName string) string {
+	return filepath.Join(metaRoot(), "imports", cntName)
+}
+
+// exportConfigText returns the config file holding every value of conf that
+// the project relies on. Defaults, global only keys and values committed to
+// the repository, which come with the clone, are left out.
+func exportConfigText(conf config, sources configSources, repoConfigPath string) []byte {
+	var text []byte
+	for _, e := range configEntries(conf) {
+		src := sources.source(e.key)
+		if src == defaultConfigSource || src == repoConfigPath {
+			continue
+		}
+		if !isBundledConfigKey(e.key) {
+			continue
+		}
+		text = setConfigText(text, e.key, e.value)
+	}
+	return text
+}
+
+// isBundledConfigKey reports whether key may be carried by a bundle.
+func isBundledConfigKey(key string) bool {
+	// Global only keys may be whole tables, e.g tls.
+	table := strings.SplitN(key, ".", 2)[0]
+	for _, k := range []string{key, table} {
+		if _, ok := globalOnlyConfigKeys[k]; ok {
+			return false
+		}
+	}
+	// env_from refers to files on this host, and runs commands on it.
+	return !strings.HasPrefix(key, "env_from.")
+}
+
+// importConfigText returns the config of a bundle as it's written to the
+// project's personal override. The override is trusted, so keys that a bundle
+// can't carry are dropped, and the remaining config must be valid.
+func importConfigText(byt []byte) ([]byte, error) {
+	var c config
+	md, err := toml.Decode(string(byt), &c)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid config: %w", err)
+	}
+
+	sources := make(configSources)
+	for _, e := range configEntries(c) {
+		if !md.IsDefined(strings.SplitN(e.key, ".", 2)...) {
+			continue
+		}
+		if !isBundledConfigKey(e.key) {
+			flog.Error("ignoring %v in the bundle's config: it can't be imported", e.key)
+			continue
+		}
+		sources[e.key] = bundleConfigName
+	}
+
+	var problems []configProblem
+	for _, key := range md.Undecoded() {
+		problems = append(problems, configProblem{key: key.String(), msg: "unknown key"})
+	}
+	problems = append(problems, validateConfig(c)...)
+	if len(problems) > 0 {
+		msgs := make([]string, 0, len(problems))
+		for _, p := range problems {
+			msgs = append(msgs, p.String())
+		}
+		return nil, xerrors.Errorf("invalid config: %v", strings.Join(msgs, "; "))
+	}
+
+	return exportConfigText(c, sources, ""), nil
+}
+
+// hostExtensions returns the names of the VS Code extensions installed on the host.
+func hostExtensions() ([]string, error) {
+	fis, err := ioutil.ReadDir(vscodeExtensionsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var exts []string
+	for _, fi := range fis {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		exts = append(exts, fi.Name())
+	}
+	sort.Strings(exts)
+	return exts, nil
+}
+
+// tarAddFile adds a file named name holding data to tw.
+func tarAddFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// tarAddPath adds the file or directory at path to tw under name.
+// Git metadata is skipped.
+func tarAddPath(tw *tar.Writer, name, path string) error {
+	return filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			// Symlinks and other special files can't be recreated safely.
+			return nil
+		}
+
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(name, rel))
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// extractTarEntry writes the entry described by hdr to dst, which must be
+// within root.
+func extractTarEntry(root string, hdr *tar.Header, r io.Reader) error {
+	dst := filepath.Join(root, filepath.FromSlash(hdr.Name))
+	if dst != root && !strings.HasPrefix(dst, root+string(filepath.Separator)) {
+		return xerrors.Errorf("invalid path %q in bundle", hdr.Name)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(dst, 0750)
+	case tar.TypeReg, tar.TypeRegA:
+		err := os.MkdirAll(filepath.Dir(dst), 0750)
+		if err != nil {
+			return err
+		}
+		fi, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode)&0755|0600)
+		if err != nil {
+			return err
+		}
+		defer fi.Close()
+		_, err = io.Copy(fi, r)
+		return err
+	default:
+		return xerrors.Errorf("unsupported entry %q in bundle", hdr.Name)
+	}
+}
+
+type exportcmd struct {
+	gf *globalFlags
+
+	output  string
+	noImage bool
+}
+
+func (c *exportcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "export",
+		Usage: "[flags] <repo>",
+		Desc: `Bundles a project's environment into a tar archive that sail import can
+recreate it from on another machine. The bundle holds the built image, the hat,
+the project's config, the container's labels and the list of installed VS Code
+extensions. The repository itself isn't included.
+
+If the -no-image flag is set, the bundle holds the project's Dockerfile instead
+of the image, which is rebuilt on import.`,
+	}
+}
+
+func (c *exportcmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.StringVar(&c.output, "o", "", "Path to write the bundle to. Defaults to <org>_<repo>.tar.")
+	fl.BoolVar(&c.noImage, "no-image", false, "Include the project's Dockerfile instead of the built image.")
+}
+
+func (c *exportcmd) Run(fl *flag.FlagSet) {
+	c.gf.ensureDockerDaemon()
+
+	proj := c.gf.project(schemaPrefs{}, fl)
+
+	output := c.output
+	if output == "" {
+		output = proj.cntName() + ".tar"
+	}
+
+	err := exportProject(proj, output, !c.noImage)
+	if err != nil {
+		os.Remove(output)
+		flog.Fatal("failed to export %v: %v", proj.cntName(), err)
+	}
+	flog.Success("exported %v to %v", proj.cntName(), output)
+}
+
+// exportProject writes the bundle of proj to path.
+func exportProject(proj *project, path string, includeImage bool) error {
+	cli := dockerClient()
+	defer cli.Close()
+
+	ctx := context.Background()
+
+	cnt, err := cli.ContainerInspect(ctx, proj.cntName())
+	if err != nil {
+		return xerrors.Errorf("failed to inspect %v: %w", proj.cntName(), err)
+	}
+
+	exts, err := hostExtensions()
+	if err != nil {
+		return xerrors.Errorf("failed to list extensions: %w", err)
+	}
+
+	m := bundleManifest{
+		Version:       bundleVersion,
+		Repo:          proj.repo.CloneURI(),
+		Image:         cnt.Config.Image,
+		BaseImage:     cnt.Config.Labels[baseImageLabel],
+		IncludesImage: includeImage,
+		Labels:        cnt.Config.Labels,
+		Extensions:    exts,
+		Created:       time.Now(),
+	}
+
+	var hatPath string
+	if cnt.Config.Labels[hatLabel] != "" {
+		b := &hatBuilder{hatPath: cnt.Config.Labels[hatLabel]}
+		hatPath, err = b.resolveHatPath()
+		if err != nil {
+			return xerrors.Errorf("failed to resolve hat path: %w", err)
+		}
+		m.Hat = true
+	}
+
+	fi, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	tw := tar.NewWriter(fi)
+
+	byt, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = tarAddFile(tw, bundleManifestName, byt)
+	if err != nil {
+		return err
+	}
+
+	repoConfigPath := projectConfigPaths(proj)[0]
+	err = tarAddFile(tw, bundleConfigName, exportConfigText(proj.conf, proj.confSources, repoConfigPath))
+	if err != nil {
+		return err
+	}
+
+	if hatPath != "" {
+		err = tarAddHat(tw, hatPath)
+		if err != nil {
+			return xerrors.Errorf("failed to add hat: %w", err)
+		}
+	}
+
+	if includeImage {
+		err = tarAddImages(ctx, tw, m.Image, m.BaseImage)
+		if err != nil {
+			return xerrors.Errorf("failed to add image: %w", err)
+		}
+	} else if _, err := os.Stat(proj.dockerfilePath()); err == nil {
+		err = tarAddPath(tw, bundleDockerfileName, proj.dockerfilePath())
+		if err != nil {
+			return xerrors.Errorf("failed to add Dockerfile: %w", err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return fi.Close()
+}
+
+// tarAddHat adds the hat at hatPath, which is either a Dockerfile or
+// a directory holding one.
+func tarAddHat(tw *tar.Writer, hatPath string) error {
+	fi, err := os.Stat(hatPath)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return tarAddPath(tw, bundleHatDir, hatPath)
+	}
+	return tarAddPath(tw, bundleHatDir+"/Dockerfile", hatPath)
+}
+
+// tarAddImages saves image, along with baseImage if it's available locally, to tw.
+func tarAddImages(ctx context.Context, tw *tar.Writer, image, baseImage string) error {
+	cli := dockerClient()
+	defer cli.Close()
+
+	refs := []string{image}
+	if baseImage != "" && baseImage != image {
+		// The base image is needed to reapply the hat with sail edit.
+		_, _, err := cli.ImageInspectWithRaw(ctx, baseImage)
+		if err == nil {
+			refs = append(refs, baseImage)
+		}
+	}
+
+	flog.Info("saving %v", strings.Join(refs, ", "))
+	rc, err := cli.ImageSave(ctx, refs)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// The size of the image must be known before it's added.
+	tmp, err := ioutil.TempFile("", "sail-export")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, rc)
+	if err != nil {
+		return err
+	}
+	return tarAddPath(tw, bundleImageName, tmp.Name())
+}
+
+type importcmd struct {
+	gf *globalFlags
+
+	force  bool
+	noOpen bool
+}
+
+func (c *importcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "import",
+		Usage: "[flags] <bundle>",
+		Desc: `Recreates a project from a bundle written by sail export.
+The repository is cloned as usual, but the image, hat and config come from the
+bundle so the original hat repository doesn't need to be reachable.
+The bundle's config is written to the project's personal override file.`,
+	}
+}
+
+func (c *importcmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.BoolVar(&c.force, "force", false, "Overwrite the project's existing personal config override.")
+	fl.BoolVar(&c.noOpen, "no-open", false, "Don't open an editor session")
+}
+
+func (c *importcmd) Run(fl *flag.FlagSet) {
+	if fl.NArg() != 1 {
+		fl.Usage()
+		os.Exit(1)
+	}
+	c.gf.ensureDockerDaemon()
+
+	proj, err := c.importProject(fl.Arg(0))
+	if err != nil {
+		flog.Fatal("failed to import %v: %v", fl.Arg(0), err)
+	}
+	flog.Success("imported %v", proj.cntName())
+
+	if c.noOpen {
+		return
+	}
+	err = proj.open(c.gf.configPath)
+	if err != nil {
+		flog.Fatal("failed to open project: %v", err)
+	}
+}
+
+// importProject recreates the project bundled at path.
+func (c *importcmd) importProject(path string) (*project, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	tr := tar.NewReader(fi)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read bundle: %w", err)
+	}
+	if hdr.Name != bundleManifestName {
+		return nil, xerrors.Errorf("not a sail bundle: first entry is %q", hdr.Name)
+	}
+	var m bundleManifest
+	err = json.NewDecoder(tr).Decode(&m)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to decode manifest: %w", err)
+	}
+	if m.Version != bundleVersion {
+		return nil, xerrors.Errorf("unsupported bundle version %v", m.Version)
+	}
+
+	proj := c.gf.projectFromArg(schemaPrefs{}, m.Repo)
+
+	exists, err := proj.cntExists()
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, xerrors.Errorf("%v already exists, remove it with sail rm first", proj.cntName())
+	}
+
+	confPath := projectConfigPaths(proj)[1]
+	if _, err := os.Stat(confPath); err == nil && !c.force {
+		return nil, xerrors.Errorf("%v already exists, use -force to overwrite it", confPath)
+	}
+
+	dir := importDir(proj.cntName())
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		imported   bool
+		dockerfile string
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read bundle: %w", err)
+		}
+
+		switch name := strings.TrimSuffix(hdr.Name, "/"); {
+		case name == bundleConfigName:
+			err = os.MkdirAll(filepath.Dir(confPath), 0750)
+			if err != nil {
+				return nil, err
+			}
+			byt, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			byt, err = importConfigText(byt)
+			if err != nil {
+				return nil, err
+			}
+			err = ioutil.WriteFile(confPath, byt, 0640)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to write %v: %w", confPath, err)
+			}
+		case name == bundleImageName:
+			err = loadImage(tr)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to load image: %w", err)
+			}
+			imported = true
+		case name == bundleDockerfileName:
+			dockerfile = filepath.Join(dir, bundleDockerfileName)
+			fallthrough
+		case name == bundleHatDir || strings.HasPrefix(name, bundleHatDir+"/"):
+			err = extractTarEntry(dir, hdr, tr)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			flog.Info("skipping unknown bundle entry %v", hdr.Name)
+		}
+	}
+	if m.IncludesImage && !imported {
+		return nil, xerrors.New("bundle is missing its image")
+	}
+
+	err = proj.ensureDir()
+	if err != nil {
+		return nil, err
+	}
+	c.gf.resolveProjectConfig(proj)
+
+	var hatPath string
+	if m.Hat {
+		hatPath = filepath.Join(dir, bundleHatDir)
+	}
+
+	b := &hatBuilder{hatPath: hatPath}
+	switch {
+	case imported:
+		// The image already has the hat applied, it only needs to point at the
+		// hat's new location so that sail edit -hat keeps working.
+		b.baseImage = m.Image
+		if hatPath != "" {
+			b.baseImage, err = relabelHat(proj, m.Image, hatPath)
+			if err != nil {
+				return nil, err
+			}
+			b.hatPath = ""
+		}
+	case dockerfile != "":
+		b.baseImage, err = proj.buildDockerfile(dockerfile)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		b.baseImage = m.BaseImage
+		if b.baseImage == "" {
+			b.baseImage = m.Image
+		}
+		err = ensureImage(b.baseImage)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to ensure image %v: %w", b.baseImage, err)
+		}
+	}
+
+	r, err := importRunner(proj)
+	if err != nil {
+		return nil, err
+	}
+
+	err = (&runcmd{}).build(c.gf, proj, b, r)
+	if err != nil {
+		removeErr := removeIfExists(context.Background(), dockerClient(), proj.cntName())
+		if removeErr != nil {
+			flog.Error("failed to remove %v: %v", proj.cntName(), removeErr)
+		}
+		return nil, err
+	}
+
+	reportMissingExtensions(m.Extensions)
+	return proj, nil
+}
+
+// importRunner returns the runner that creates the container of an imported
+// project. The labels in the bundle's manifest aren't trusted, so everything
+// that's forwarded from the host comes from the project's config only.
+func importRunner(proj *project) (*runner, error) {
+	r := &runner{
+		projectName:     proj.repo.BaseName(),
+		projectLocalDir: proj.localDir(),
+		cntName:         proj.cntName(),
+		hostname:        proj.repo.BaseName(),
+		port:            "0",
+	}
+	err := r.applyConfig(proj.conf)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid project config: %w", err)
+	}
+	return r, nil
+}
+
+// loadImage loads the images written by docker save from r.
+func loadImage(r io.Reader) error {
+	cli := dockerClient()
+	defer cli.Close()
+
+	flog.Info("loading image")
+	resp, err := cli.ImageLoad(context.Background(), r, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		err = dec.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return xerrors.New(msg.Error)
+		}
+	}
+}
+
+// relabelHat returns an image of image with its hat label pointing to hatPath.
+func relabelHat(proj *project, image, hatPath string) (string, error) {
+	// Docker image names must be completely lowercase.
+	imageName := "sail-import/" + strings.ToLower(proj.cntName())
+
+	cmd := xexec.Fmt("docker build -q -t %v --label %v=%v -", imageName, hatLabel, hatPath)
+	xexec.Attach(cmd)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stdin = strings.NewReader("FROM " + image + "\n")
+	err := cmd.Run()
+	if err != nil {
+		return "", xerrors.Errorf("failed to relabel %v: %w", image, err)
+	}
+	return imageName, nil
+}
+
+// reportMissingExtensions lists the extensions of the bundle that
+// aren't installed on this host.
+func reportMissingExtensions(exts []string) {
+	installed, err := hostExtensions()
+	if err != nil {
+		flog.Error("failed to list extensions: %v", err)
+		return
+	}
+	have := make(map[string]struct{}, len(installed))
+	for _, ext := range installed {
+		have[ext] = struct{}{}
+	}
+
+	var missing []string
+	for _, ext := range exts {
+		if _, ok := have[ext]; !ok {
+			missing = append(missing, ext)
+		}
+	}
+	if len(missing) > 0 {
+		flog.Info("the following VS Code extensions of the bundle aren't installed:\n%v", strings.Join(missing, "\n"))
+	}
+}
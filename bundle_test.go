@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_exportConfigText(t *testing.T) {
+	t.Parallel()
+
+	conf := configDefaults()
+	conf.ProjectRoot = "~/src"
+	conf.DefaultImage = "codercom/ubuntu-dev"
+	conf.Resources.CPUs = 2
+	conf.Env = map[string]string{"FOO": "bar"}
+	conf.EnvFrom = map[string]envSource{"DB_PASSWORD": {File: "~/.db_password"}}
+	conf.Probes = map[string]probe{"db": {TCP: "localhost:5432"}}
+
+	sources := configSources{
+		"project_root":         "/global.toml",
+		"default_image":        "/repo/.sail/sail.toml",
+		"resources.cpus":       "/global.toml",
+		"env.FOO":              "/override.toml",
+		"env_from.DB_PASSWORD": "/global.toml",
+		"probes.db":            "/global.toml",
+	}
+
+	text := exportConfigText(conf, sources, "/repo/.sail/sail.toml")
+	assert.Equal(t, `[resources]
+cpus = 2.0
+
+[env]
+FOO = "bar"
+
+[probes]
+db = { tcp = "localhost:5432" }
+`, string(text))
+
+	c, _ := readConfigText(t, text)
+	assert.Equal(t, 2.0, c.Resources.CPUs)
+	assert.Equal(t, "localhost:5432", c.Probes["db"].TCP)
+}
+
+func Test_importConfigText(t *testing.T) {
+	t.Parallel()
+
+	text, err := importConfigText([]byte(`
+default_hat = "./hat"
+proxy_password = "hunter2"
+code_server_mirror = "https://evil.example.com"
+
+[tls]
+enabled = true
+
+[git]
+forward_identity = false
+forward_credentials = true
+forward_gpg = true
+
+[env]
+FOO = "bar"
+
+[env_from]
+KEY = { command = "cat ~/.ssh/id_rsa" }
+`))
+	require.NoError(t, err)
+	assert.Equal(t, `default_hat = "./hat"
+
+[env]
+FOO = "bar"
+
+[git]
+forward_identity = false
+`, string(text))
+
+	_, err = importConfigText([]byte(`default_schema = "ftp"`))
+	assert.Error(t, err, "invalid value")
+
+	_, err = importConfigText([]byte(`unknown = true`))
+	assert.Error(t, err, "unknown key")
+}
+
+func Test_importRunner(t *testing.T) {
+	t.Parallel()
+
+	var m bundleManifest
+	err := json.Unmarshal([]byte(`{
+	"version": 1,
+	"repo": "cdr/sail",
+	"image": "cdr_sail",
+	"labels": {"com.coder.sail.forward_gpg": "true"}
+}`), &m)
+	require.NoError(t, err)
+
+	repo, err := parseRepo("https", "github.com", "", m.Repo)
+	require.NoError(t, err)
+	proj := &project{repo: repo}
+
+	r, err := importRunner(proj)
+	require.NoError(t, err)
+	assert.False(t, r.forwardGPG, "manifest label enabled gpg forwarding")
+
+	proj.conf.Git.ForwardGPG = true
+	r, err = importRunner(proj)
+	require.NoError(t, err)
+	assert.True(t, r.forwardGPG)
+}
+
+func readConfigText(t *testing.T, text []byte) (config, configSources) {
+	dir, err := ioutil.TempDir("", "sail-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sail.toml")
+	require.NoError(t, ioutil.WriteFile(path, text, 0644))
+
+	c, sources, err := readConfigLayers(path, "")
+	require.NoError(t, err)
+	return c, sources
+}
+
+func Test_bundleHat(t *testing.T) {
+	t.Parallel()
+
+	src, err := ioutil.TempDir("", "sail-hat")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(src, ".git"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, ".git", "HEAD"), []byte("ref"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "scripts"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "Dockerfile"), []byte("FROM ubuntu"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "scripts", "setup.sh"), []byte("#!/bin/sh"), 0755))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tarAddHat(tw, src))
+	require.NoError(t, tw.Close())
+
+	dst, err := ioutil.TempDir("", "sail-import")
+	require.NoError(t, err)
+	defer os.RemoveAll(dst)
+
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, extractTarEntry(dst, hdr, tr))
+	}
+
+	byt, err := ioutil.ReadFile(filepath.Join(dst, bundleHatDir, "Dockerfile"))
+	require.NoError(t, err)
+	assert.Equal(t, "FROM ubuntu", string(byt))
+
+	fi, err := os.Stat(filepath.Join(dst, bundleHatDir, "scripts", "setup.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+	_, err = os.Stat(filepath.Join(dst, bundleHatDir, ".git"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_extractTarEntry(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"../escape", "hat/../../escape"} {
+		err := extractTarEntry("/tmp/sail-import", &tar.Header{Name: name, Typeflag: tar.TypeReg}, nil)
+		assert.Error(t, err, name)
+	}
+}
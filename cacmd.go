@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/xexec"
+)
+
+type cacmd struct {
+	gf *globalFlags
+}
+
+func (c *cacmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name: "ca",
+		Desc: `Prints the path of the local CA certificate, generating it if needed.
+The proxy issues certificates from it when tls is enabled in the config without a
+cert and key. Install it into your trust store with sail ca install.`,
+	}
+}
+
+func (c *cacmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&caInstallCmd{gf: c.gf},
+	}
+}
+
+func (c *cacmd) Run(fl *flag.FlagSet) {
+	_, err := loadLocalCA(c.gf.config())
+	if err != nil {
+		flog.Fatal("failed to load local CA: %v", err)
+	}
+	fmt.Println(localCACertPath())
+}
+
+type caInstallCmd struct {
+	gf *globalFlags
+}
+
+func (c *caInstallCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name: "install",
+		Desc: `Adds the local CA certificate to the trust store of the host.
+On Linux, it's also added to the NSS database used by Chrome and Firefox.
+This may prompt for your password.`,
+	}
+}
+
+func (c *caInstallCmd) Run(fl *flag.FlagSet) {
+	_, err := loadLocalCA(c.gf.config())
+	if err != nil {
+		flog.Fatal("failed to load local CA: %v", err)
+	}
+
+	err = installCA(localCACertPath())
+	if err != nil {
+		flog.Fatal("failed to install local CA: %v", err)
+	}
+	flog.Success("installed %v, restart your browser to use it", localCACertPath())
+}
+
+// installCA adds the CA certificate at path to the trust stores of the host.
+func installCA(path string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return runAttached("sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %q", path)
+	case "linux":
+		err := installLinuxCA(path)
+		if err != nil {
+			return err
+		}
+		return installNSSCA(path)
+	default:
+		return xerrors.Errorf("unsupported os %q, trust %v manually", runtime.GOOS, path)
+	}
+}
+
+// installLinuxCA adds the CA certificate at path to the system trust store
+// of Debian and Fedora based distributions.
+func installLinuxCA(path string) error {
+	if _, err := exec.LookPath("update-ca-certificates"); err == nil {
+		return runAttached("sudo cp %q /usr/local/share/ca-certificates/sail-ca.crt && sudo update-ca-certificates", path)
+	}
+	if _, err := exec.LookPath("trust"); err == nil {
+		return runAttached("sudo trust anchor --store %q", path)
+	}
+	return xerrors.Errorf("neither update-ca-certificates nor trust found, trust %v manually", path)
+}
+
+// installNSSCA adds the CA certificate at path to the user's NSS database,
+// which Chrome and Firefox use instead of the system trust store on Linux.
+func installNSSCA(path string) error {
+	hostHomeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	nssdb := filepath.Join(hostHomeDir, ".pki", "nssdb")
+	if _, err := os.Stat(nssdb); err != nil {
+		return nil
+	}
+
+	if _, err := exec.LookPath("certutil"); err != nil {
+		flog.Error("certutil not found, install libnss3-tools to trust %v in Chrome and Firefox", path)
+		return nil
+	}
+	return runAttached("certutil -d sql:%q -A -t C,, -n 'sail local CA' -i %q", nssdb, path)
+}
+
+func runAttached(cmdFmt string, args ...interface{}) error {
+	cmd := xexec.Fmt(cmdFmt, args...)
+	xexec.Attach(cmd)
+	err := cmd.Run()
+	if err != nil {
+		return xerrors.Errorf("failed to run %v: %w", cmd.Args[2], err)
+	}
+	return nil
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -10,6 +14,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,13 +25,22 @@ import (
 	"go.coder.com/sail/internal/codeserver"
 )
 
-// loadCodeServer produces a path containing the code-server binary.
-// It will attempt to cache the binary.
-func loadCodeServer(ctx context.Context) (string, error) {
-	start := time.Now()
+// codeServerVersionLabel records the version of code-server a container
+// was created with.
+const codeServerVersionLabel = sailLabel + ".code_server_version"
+
+// codeServerVersionImageLabel pins the version of code-server used by a
+// project from its image, overriding the config.
+const codeServerVersionImageLabel = "code_server_version"
+
+// codeServerFromImage is the code_server_version that makes a project use the
+// code-server installed in its image instead of mounting one in.
+const codeServerFromImage = "image"
 
-	var cachePath string
-	const codeServerPathSuffix = "sail-code-server-cache/code-server"
+// codeServerCacheDir returns the directory the code-server binaries
+// are cached in, one directory per version.
+func codeServerCacheDir() string {
+	const cacheDirName = "sail-code-server-cache"
 	// MacOS maps os.TempDir() to `/var/folders/...`, which isn't shared with the docker
 	// system since docker tries to comply with Apple's filesystem sandbox guidelines, so
 	// default to `/tmp` when on MacOS.
@@ -35,102 +49,443 @@ func loadCodeServer(ctx context.Context) (string, error) {
 	// https://stackoverflow.com/questions/45122459/docker-mounts-denied-the-paths-are-not-shared-from-os-x-and-are-not-known
 	switch runtime.GOOS {
 	case "darwin":
-		cachePath = filepath.Join("/tmp", codeServerPathSuffix)
+		return filepath.Join("/tmp", cacheDirName)
 	default:
-		cachePath = filepath.Join(os.TempDir(), codeServerPathSuffix)
+		return filepath.Join(os.TempDir(), cacheDirName)
 	}
+}
 
-	// downloadURLPath stores the download URL, so we know whether we should update
-	// the binary.
-	downloadURLPath := cachePath + ".download_url"
+// codeServerBinPath returns the cached binary of version.
+func codeServerBinPath(version string) string {
+	return filepath.Join(codeServerCacheDir(), version, "code-server")
+}
 
-	// Only check for a new codeserver if it's over an hour old.
-	info, err := os.Stat(cachePath)
-	if err == nil {
-		if info.ModTime().Add(time.Hour).After(time.Now()) {
-			return cachePath, nil
+// codeServerVersionPath returns the file holding the version of code-server
+// used by projects that don't pin one. It's only changed by sail code-server update.
+func codeServerVersionPath() string {
+	return filepath.Join(metaRoot(), "code-server", "version")
+}
+
+// codeServerChecksumsPath returns the file holding the SHA-256 of every
+// release archive downloaded so far. It's used to verify archives
+// of releases that don't have a checksum manifest.
+func codeServerChecksumsPath() string {
+	return filepath.Join(metaRoot(), "code-server", codeserver.ChecksumsName)
+}
+
+// currentCodeServerVersion returns the version of code-server used by
+// projects that don't pin one. The latest version is recorded the first
+// time it's needed, or the newest cached version when offline.
+func currentCodeServerVersion(ctx context.Context, offline bool) (string, error) {
+	byt, err := ioutil.ReadFile(codeServerVersionPath())
+	if err == nil && len(bytes.TrimSpace(byt)) > 0 {
+		version := string(bytes.TrimSpace(byt))
+		return version, codeserver.ValidateVersion(version)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var version string
+	if offline {
+		versions, err := cachedCodeServerVersions(codeServerCacheDir())
+		if err != nil {
+			return "", err
+		}
+		if len(versions) == 0 {
+			return "", xerrors.New("no code-server is cached, install one with sail code-server install -from <archive>")
+		}
+		version = versions[0]
+	} else {
+		version, err = codeserver.LatestVersion(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = setCodeServerVersion(version)
+	if err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// cachedCodeServerVersions returns the versions of code-server cached in dir,
+// the most recently installed first.
+func cachedCodeServerVersions(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		versions []string
+		modTimes = make(map[string]time.Time)
+	)
+	for _, fi := range fis {
+		if !fi.IsDir() || codeserver.ValidateVersion(fi.Name()) != nil {
+			continue
 		}
+		binFi, err := os.Stat(filepath.Join(dir, fi.Name(), "code-server"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, fi.Name())
+		modTimes[fi.Name()] = binFi.ModTime()
 	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return modTimes[versions[i]].After(modTimes[versions[j]])
+	})
+	return versions, nil
+}
 
-	err = os.MkdirAll(filepath.Dir(cachePath), 0750)
+// setCodeServerVersion makes version the version of code-server used by
+// projects that don't pin one.
+func setCodeServerVersion(version string) error {
+	err := codeserver.ValidateVersion(version)
+	if err != nil {
+		return err
+	}
+	path := codeServerVersionPath()
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(version+"\n"), 0640)
+}
+
+// resolveCodeServerVersion returns the version of code-server to use for a
+// project. The image's code_server_version label takes precedence over the
+// config's, and otherwise the current version is used. Images and
+// repositories can set the version, so it's validated before it's used
+// in paths and URLs.
+func resolveCodeServerVersion(ctx context.Context, imageLabels map[string]string, confVersion string, offline bool) (string, error) {
+	version := imageLabels[codeServerVersionImageLabel]
+	if version == "" {
+		version = confVersion
+	}
+	if version == "" {
+		return currentCodeServerVersion(ctx, offline)
+	}
+	if version == codeServerFromImage {
+		return version, nil
+	}
+	return version, codeserver.ValidateVersion(version)
+}
+
+// loadCodeServer returns the path of the code-server binary of version,
+// downloading it from mirror if it isn't cached. Downloads are verified
+// before they're cached, and cached binaries are never replaced. When offline,
+// only cached binaries are used, however old they are. trust allows the first
+// download of a release without a checksum manifest, see verifyCodeServer.
+func loadCodeServer(ctx context.Context, mirror, version string, offline, trust bool) (string, error) {
+	err := codeserver.ValidateVersion(version)
 	if err != nil {
 		return "", err
 	}
 
-	_, err = os.Stat(cachePath)
-	if err != nil && !os.IsNotExist(err) {
-		return "", xerrors.Errorf("failed to stat %v: %v", cachePath, err)
+	binPath := codeServerBinPath(version)
+	_, err = os.Stat(binPath)
+	if err == nil {
+		return binPath, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", xerrors.Errorf("failed to stat %v: %w", binPath, err)
+	}
+	if offline {
+		return "", xerrors.Errorf("code-server %v isn't cached and code_server_offline is set, "+
+			"install it with sail code-server install -from <archive>", version)
 	}
 
-	cachedBinExists := err == nil
+	if mirror == "" {
+		mirror = codeserver.DefaultMirror
+	}
 
-	downloadURL, err := codeserver.DownloadURL(ctx)
+	start := time.Now()
+	archive, err := downloadCodeServer(ctx, mirror, version, trust)
 	if err != nil {
 		return "", err
 	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
 
-	lastDownloadURL, err := ioutil.ReadFile(downloadURLPath)
+	err = installCodeServer(ctx, archive, binPath)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return "", xerrors.Errorf("failed to get download URL: %w", err)
+		return "", err
+	}
+
+	flog.Info("loaded code-server %v in %v", version, time.Since(start))
+	return binPath, nil
+}
+
+// downloadCodeServer downloads the release archive of version from mirror
+// into a temporary file and verifies it.
+func downloadCodeServer(ctx context.Context, mirror, version string, trust bool) (*os.File, error) {
+	archiveURL := codeserver.ArchiveURL(mirror, version)
+	flog.Info("downloading %v", archiveURL)
+
+	resp, err := httpGetContext(ctx, archiveURL)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get %v: %w", archiveURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("failed to get %v: %v", archiveURL, resp.Status)
+	}
+
+	archive, err := ioutil.TempFile("", "code-server*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			archive.Close()
+			os.Remove(archive.Name())
 		}
+	}()
 
-		lastDownloadURL = []byte("")
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(archive, h), resp.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to download %v: %w", archiveURL, err)
 	}
 
-	// The binary is already up to date.
-	if string(lastDownloadURL) == downloadURL && cachedBinExists {
-		return cachePath, nil
+	err = verifyCodeServer(ctx, mirror, version, hex.EncodeToString(h.Sum(nil)), trust)
+	if err != nil {
+		return nil, err
 	}
 
-	// We can't just overwrite the binary, as that would cause a `text file busy` error if code-server is running.
-	// We write to a temporary path first, and then atomically swap in this new file.
-	tmpCachePath := cachePath + strconv.FormatInt(time.Now().UnixNano(), 10)
-	defer os.Remove(tmpCachePath)
+	_, err = archive.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	ok = true
+	return archive, nil
+}
+
+// verifyCodeServer checks sum, the SHA-256 of the release archive of version,
+// against the checksum manifest of the release on mirror. Mirrors may not
+// have manifests, in which case sum is checked against the one recorded when
+// the release was first downloaded. Releases with neither are refused unless
+// trust is set, which records sum for later downloads.
+func verifyCodeServer(ctx context.Context, mirror, version, sum string, trust bool) error {
+	name := codeserver.ArchiveName(version)
 
-	// Update the binary.
-	cachedBinFi, err := os.OpenFile(tmpCachePath, os.O_CREATE|os.O_RDWR, 0750)
+	known, err := readCodeServerChecksums()
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer cachedBinFi.Close()
 
-	tarFi, err := http.Get(downloadURL)
+	want, err := fetchCodeServerChecksum(ctx, mirror, version)
 	if err != nil {
-		return "", xerrors.Errorf("failed to get %v: %w", downloadURL, err)
+		return err
+	}
+	if want == "" {
+		want = known[name]
+	}
+	if want == "" {
+		if !trust {
+			return xerrors.Errorf("%v has no %v and no checksum was recorded for it, "+
+				"install a verified archive with sail code-server install -from <archive>, "+
+				"or trust the download with sail code-server update -trust -version %v",
+				version, codeserver.ChecksumsName, version,
+			)
+		}
+		flog.Info("%v has no %v, trusting the sha256 %v of %v from now on",
+			version, codeserver.ChecksumsName, sum, name,
+		)
+	}
+	if want != "" && want != sum {
+		return xerrors.Errorf("sha256 of %v is %v, expected %v", name, sum, want)
+	}
+
+	if known[name] == sum {
+		return nil
+	}
+	return recordCodeServerChecksum(name, sum)
+}
+
+// fetchCodeServerChecksum returns the SHA-256 of the release archive of version
+// from the release's checksum manifest on mirror, or "" if it has none.
+func fetchCodeServerChecksum(ctx context.Context, mirror, version string) (string, error) {
+	sumsURL := codeserver.ChecksumsURL(mirror, version)
+	resp, err := httpGetContext(ctx, sumsURL)
+	if err != nil {
+		return "", xerrors.Errorf("failed to get %v: %w", sumsURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", xerrors.Errorf("failed to get %v: %v", sumsURL, resp.Status)
 	}
-	defer tarFi.Body.Close()
 
-	binRd, err := codeserver.Extract(ctx, tarFi.Body)
+	sums, err := codeserver.ParseChecksums(resp.Body)
 	if err != nil {
-		return "", xerrors.Errorf("failed to untar %v: %w", downloadURL, err)
+		return "", xerrors.Errorf("invalid %v: %w", sumsURL, err)
+	}
+	sum, ok := sums[codeserver.ArchiveName(version)]
+	if !ok {
+		return "", xerrors.Errorf("%v has no checksum for %v", sumsURL, codeserver.ArchiveName(version))
 	}
+	return sum, nil
+}
 
-	_, err = io.Copy(cachedBinFi, binRd)
+func readCodeServerChecksums() (map[string]string, error) {
+	fi, err := os.Open(codeServerChecksumsPath())
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	sums, err := codeserver.ParseChecksums(fi)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid %v: %w", fi.Name(), err)
+	}
+	return sums, nil
+}
+
+func recordCodeServerChecksum(name, sum string) error {
+	path := codeServerChecksumsPath()
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+	fi, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	_, err = fmt.Fprintf(fi, "%v  %v\n", sum, name)
+	if err != nil {
+		return err
+	}
+	return fi.Close()
+}
+
+// installCodeServerArchive caches the code-server binary from the release
+// archive at path, returning its version. If version is empty, it's read from
+// the archive. The archive must match the checksum recorded for its version,
+// if any, and its checksum is recorded otherwise.
+func installCodeServerArchive(ctx context.Context, path, version string) (string, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+
+	if version == "" {
+		name, _, err := codeserver.ExtractFile(ctx, fi)
+		if err != nil {
+			return "", xerrors.Errorf("failed to untar %v: %w", path, err)
+		}
+		var ok bool
+		version, ok = codeserver.ArchiveVersion(name)
+		if !ok {
+			version, ok = codeserver.ArchiveVersion(filepath.Base(path))
+		}
+		if !ok {
+			return "", xerrors.Errorf("failed to find the version of %v, set it with -version", path)
+		}
+	}
+	err = codeserver.ValidateVersion(version)
 	if err != nil {
-		return "", xerrors.Errorf("failed to copy binary into %v: %w", tmpCachePath, err)
+		return "", err
 	}
 
-	err = cachedBinFi.Close()
+	_, err = fi.Seek(0, io.SeekStart)
 	if err != nil {
-		return "", xerrors.Errorf("failed to close %v: %v", cachedBinFi.Name(), err)
+		return "", err
 	}
+	h := sha256.New()
+	_, err = io.Copy(h, fi)
+	if err != nil {
+		return "", xerrors.Errorf("failed to read %v: %w", path, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
 
-	// TODO: make this actually atomic.
-	_ = os.Remove(cachePath)
-	err = os.Rename(tmpCachePath, cachePath)
+	known, err := readCodeServerChecksums()
 	if err != nil {
-		return "", xerrors.Errorf("failed to rename %v to %v: %v", tmpCachePath, cachePath, err)
+		return "", err
+	}
+	name := codeserver.ArchiveName(version)
+	if want := known[name]; want != "" && want != sum {
+		return "", xerrors.Errorf("sha256 of %v is %v, expected %v for %v", path, sum, want, name)
 	}
 
-	err = ioutil.WriteFile(downloadURLPath, []byte(downloadURL), 0640)
+	_, err = fi.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	err = installCodeServer(ctx, fi, codeServerBinPath(version))
 	if err != nil {
 		return "", err
 	}
 
-	flog.Info("loaded code-server in %v", time.Since(start))
+	if known[name] == sum {
+		return version, nil
+	}
+	return version, recordCodeServerChecksum(name, sum)
+}
 
-	return cachePath, nil
+// installCodeServer extracts the code-server binary from the release archive
+// into binPath.
+func installCodeServer(ctx context.Context, archive io.Reader, binPath string) error {
+	err := os.MkdirAll(filepath.Dir(binPath), 0750)
+	if err != nil {
+		return err
+	}
+
+	binRd, err := codeserver.Extract(ctx, archive)
+	if err != nil {
+		return xerrors.Errorf("failed to untar code-server: %w", err)
+	}
+
+	// The binary is written to a temporary path first, and then renamed into
+	// place, so a binary in use by a container is never half written.
+	tmpBinPath := binPath + strconv.FormatInt(time.Now().UnixNano(), 10)
+	defer os.Remove(tmpBinPath)
+
+	binFi, err := os.OpenFile(tmpBinPath, os.O_CREATE|os.O_RDWR, 0750)
+	if err != nil {
+		return err
+	}
+	defer binFi.Close()
+
+	_, err = io.Copy(binFi, binRd)
+	if err != nil {
+		return xerrors.Errorf("failed to copy binary into %v: %w", tmpBinPath, err)
+	}
+
+	err = binFi.Close()
+	if err != nil {
+		return xerrors.Errorf("failed to close %v: %v", binFi.Name(), err)
+	}
+
+	err = os.Rename(tmpBinPath, binPath)
+	if err != nil {
+		return xerrors.Errorf("failed to rename %v to %v: %v", tmpBinPath, binPath, err)
+	}
+	return nil
+}
+
+// httpGetContext makes a GET request to u that's canceled with ctx.
+func httpGetContext(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req.WithContext(ctx))
 }
 
 // codeServerPort gets the port of the running code-server binary.
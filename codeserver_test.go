@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.coder.com/sail/internal/codeserver"
+)
+
+func Test_resolveCodeServerVersion(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	version, err := resolveCodeServerVersion(ctx, map[string]string{
+		codeServerVersionImageLabel: "2.1523-vsc1.38.1",
+	}, "2.1485-vsc1.38.1", false)
+	require.NoError(t, err)
+	assert.Equal(t, "2.1523-vsc1.38.1", version, "image label takes precedence")
+
+	version, err = resolveCodeServerVersion(ctx, nil, "2.1485-vsc1.38.1", false)
+	require.NoError(t, err)
+	assert.Equal(t, "2.1485-vsc1.38.1", version)
+
+	version, err = resolveCodeServerVersion(ctx, nil, codeServerFromImage, true)
+	require.NoError(t, err)
+	assert.Equal(t, codeServerFromImage, version)
+
+	// Versions end up in paths on the host and in URLs.
+	_, err = resolveCodeServerVersion(ctx, map[string]string{
+		codeServerVersionImageLabel: "../../..",
+	}, "", true)
+	assert.Error(t, err)
+	_, err = resolveCodeServerVersion(ctx, nil, "../../../../usr/local/bin", true)
+	assert.Error(t, err)
+
+	_, err = loadCodeServer(ctx, "", "../escape", true, false)
+	assert.Error(t, err)
+}
+
+func Test_cachedCodeServerVersions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "sail-code-server-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	versions, err := cachedCodeServerVersions(filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+
+	now := time.Now()
+	for i, v := range []string{"2.1485-vsc1.38.1", "2.1523-vsc1.38.1", "2.1650-vsc1.39.2"} {
+		binPath := filepath.Join(dir, v, "code-server")
+		require.NoError(t, os.MkdirAll(filepath.Dir(binPath), 0750))
+		require.NoError(t, ioutil.WriteFile(binPath, nil, 0750))
+		// The oldest version was installed last.
+		modTime := now.Add(-time.Hour * time.Duration(i))
+		require.NoError(t, os.Chtimes(binPath, modTime, modTime))
+	}
+	// Interrupted installs leave a directory without a binary.
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "2.1700-vsc1.40.0"), 0750))
+
+	versions, err = cachedCodeServerVersions(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2.1485-vsc1.38.1", "2.1523-vsc1.38.1", "2.1650-vsc1.39.2"}, versions)
+}
+
+func Test_fetchCodeServerChecksum(t *testing.T) {
+	t.Parallel()
+
+	const (
+		version = "2.1523-vsc1.38.1"
+		sum     = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + version + "/" + codeserver.ChecksumsName:
+			fmt.Fprintf(w, "%v  %v\n", sum, codeserver.ArchiveName(version))
+		case "/other/" + codeserver.ChecksumsName:
+			fmt.Fprintf(w, "%v  %v\n", sum, "code-server.tar.gz")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	got, err := fetchCodeServerChecksum(ctx, srv.URL, version)
+	require.NoError(t, err)
+	assert.Equal(t, sum, got)
+
+	// Mirrors without a manifest are verified against the recorded checksum.
+	got, err = fetchCodeServerChecksum(ctx, srv.URL, "2.1485-vsc1.38.1")
+	require.NoError(t, err)
+	assert.Equal(t, "", got)
+
+	_, err = fetchCodeServerChecksum(ctx, srv.URL, "other")
+	assert.Error(t, err, "manifest without the archive")
+}
+
+func Test_verifyCodeServer(t *testing.T) {
+	t.Parallel()
+
+	const (
+		version = "2.1-verify-test"
+		sum     = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+		other   = "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752"
+	)
+
+	// The mirror has no checksum manifests.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	err := verifyCodeServer(ctx, srv.URL, version, sum, false)
+	assert.Error(t, err, "nothing to verify against")
+
+	err = verifyCodeServer(ctx, srv.URL, version, sum, true)
+	require.NoError(t, err)
+
+	// The checksum is recorded once trusted.
+	err = verifyCodeServer(ctx, srv.URL, version, sum, false)
+	assert.NoError(t, err)
+	err = verifyCodeServer(ctx, srv.URL, version, other, true)
+	assert.Error(t, err, "mismatch with the recorded checksum")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/codeserver"
+)
+
+type codeservercmd struct {
+	gf *globalFlags
+}
+
+func (c *codeservercmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name: "code-server",
+		Desc: `Prints the version of code-server used by projects that don't pin one
+with code_server_version in the config or in their image. It only changes
+with sail code-server update or sail code-server install.`,
+	}
+}
+
+func (c *codeservercmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&codeServerUpdateCmd{gf: c.gf},
+		&codeServerInstallCmd{gf: c.gf},
+	}
+}
+
+func (c *codeservercmd) Run(fl *flag.FlagSet) {
+	conf := c.gf.config()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	version, err := currentCodeServerVersion(ctx, conf.CodeServerOffline)
+	if err != nil {
+		flog.Fatal("failed to get code-server version: %v", err)
+	}
+	fmt.Println(version)
+}
+
+type codeServerUpdateCmd struct {
+	gf *globalFlags
+
+	version string
+	trust   bool
+}
+
+func (c *codeServerUpdateCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "update",
+		Usage: "[flags]",
+		Desc: `Downloads the latest version of code-server, or the one set with -version,
+and makes it the version used by projects that don't pin one. Projects pick it
+up the next time their container is created or rebuilt.
+
+Downloads must match the SHA256SUMS published next to the release on the mirror,
+or the checksum recorded when the version was first downloaded or installed.
+Releases with neither are refused unless -trust is set.`,
+	}
+}
+
+func (c *codeServerUpdateCmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.StringVar(&c.version, "version", "", "Version to update to instead of the latest, e.g 2.1523-vsc1.38.1.")
+	fl.BoolVar(&c.trust, "trust", false, "Trust and record the checksum of a release that has no SHA256SUMS.")
+}
+
+func (c *codeServerUpdateCmd) Run(fl *flag.FlagSet) {
+	conf := c.gf.config()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancel()
+
+	version := c.version
+	if version == "" {
+		var err error
+		version, err = codeserver.LatestVersion(ctx)
+		if err != nil {
+			flog.Fatal("%v", err)
+		}
+	}
+
+	// Download it first, so a broken release is never made the current version.
+	// Updating is an explicit request for the network, so code_server_offline
+	// doesn't apply.
+	_, err := loadCodeServer(ctx, conf.CodeServerMirror, version, false, c.trust)
+	if err != nil {
+		flog.Fatal("failed to load code-server %v: %v", version, err)
+	}
+
+	err = setCodeServerVersion(version)
+	if err != nil {
+		flog.Fatal("failed to set code-server version: %v", err)
+	}
+	flog.Success("using code-server %v, rebuild projects with sail edit to update them", version)
+	if conf.CodeServerVersion != "" {
+		flog.Info("code_server_version = %q in the global config takes precedence", conf.CodeServerVersion)
+	}
+}
+
+type codeServerInstallCmd struct {
+	gf *globalFlags
+
+	from    string
+	version string
+}
+
+func (c *codeServerInstallCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "install",
+		Usage: "-from <archive> [flags]",
+		Desc: `Installs code-server from a release archive on disk, such as
+code-server2.1523-vsc1.38.1-linux-x86_64.tar.gz, without network access, and makes
+it the version used by projects that don't pin one. The version is read from the
+archive unless it's set with -version.
+
+If an archive of the same version was installed or downloaded before, the new one
+must have the same checksum.`,
+	}
+}
+
+func (c *codeServerInstallCmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.StringVar(&c.from, "from", "", "Path to a code-server release archive.")
+	fl.StringVar(&c.version, "version", "", "Version of the archive, if it can't be read from it.")
+}
+
+func (c *codeServerInstallCmd) Run(fl *flag.FlagSet) {
+	if c.from == "" {
+		fl.Usage()
+		os.Exit(1)
+	}
+
+	conf := c.gf.config()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancel()
+
+	version, err := installCodeServerArchive(ctx, c.from, c.version)
+	if err != nil {
+		flog.Fatal("failed to install code-server from %v: %v", c.from, err)
+	}
+
+	err = setCodeServerVersion(version)
+	if err != nil {
+		flog.Fatal("failed to set code-server version: %v", err)
+	}
+	flog.Success("using code-server %v, rebuild projects with sail edit to update them", version)
+	if conf.CodeServerVersion != "" {
+		flog.Info("code_server_version = %q in the global config takes precedence", conf.CodeServerVersion)
+	}
+}
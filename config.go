@@ -1,12 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"
+	"golang.org/x/xerrors"
 
 	"go.coder.com/flog"
 )
@@ -31,6 +36,8 @@ func resolvePath(homedir string, path string) string {
 
 // config describes the config.toml.
 // Changes to this should be accompanied by changes to DefaultConfig.
+//
+// The global config may be overridden per project, see readConfigLayers.
 type config struct {
 	DefaultImage        string `toml:"default_image"`
 	ProjectRoot         string `toml:"project_root"`
@@ -38,6 +45,101 @@ type config struct {
 	DefaultSchema       string `toml:"default_schema"`
 	DefaultHost         string `toml:"default_host"`
 	DefaultOrganization string `toml:"default_organization"`
+
+	// LanguageImages maps detected languages to the default image
+	// used for them.
+	LanguageImages map[string]string `toml:"language_images"`
+
+	// Resources limits the resources available to project containers.
+	Resources resourcesConfig `toml:"resources"`
+
+	// Env holds environment variables set inside project containers.
+	Env map[string]string `toml:"env"`
+
+	// EnvFrom holds environment variables whose values are read
+	// from a file or command on the host.
+	EnvFrom map[string]envSource `toml:"env_from"`
+
+	// Git configures how the host's git setup is shared with containers.
+	Git gitConfig `toml:"git"`
+
+	// Dotfiles is a dotfiles repository installed into project containers.
+	Dotfiles dotfilesConfig `toml:"dotfiles"`
+
+	// EditGracePeriod is how long the container replaced by sail edit
+	// is kept for rolling back to, e.g "1h".
+	EditGracePeriod string `toml:"edit_grace_period"`
+
+	// OnlineTimeout is how long to wait for code-server to start, e.g "30s".
+	OnlineTimeout string `toml:"online_timeout"`
+
+	// IdleTimeout is how long a project can go unused before its
+	// container is stopped, e.g "2h". Empty or "0s" never stops it.
+	IdleTimeout string `toml:"idle_timeout"`
+
+	// Proxy is how projects are proxied to, either through the sail
+	// daemon or a proxy process forked for each project.
+	Proxy string `toml:"proxy"`
+
+	// DaemonAddress is the address the sail daemon listens on.
+	DaemonAddress string `toml:"daemon_address"`
+
+	// ProxyAddress is the host forked proxies listen on.
+	ProxyAddress string `toml:"proxy_address"`
+
+	// TLS configures HTTPS for the proxy.
+	TLS tlsConfig `toml:"tls"`
+
+	// ProxyPassword allows logging in to projects with a password
+	// in addition to the token sail opens them with.
+	ProxyPassword string `toml:"proxy_password"`
+
+	// Probes holds readiness probes that are waited on after code-server
+	// has started. They replace image defined probes of the same name.
+	Probes map[string]probe `toml:"probes"`
+
+	// CodeServerVersion pins the version of code-server, e.g "2.1523-vsc1.38.1".
+	// Without it, the version last set by sail code-server update is used.
+	// "image" uses the code-server installed in the project's image.
+	CodeServerVersion string `toml:"code_server_version"`
+
+	// CodeServerOffline only uses cached code-server binaries, and never
+	// reaches the network for them.
+	CodeServerOffline bool `toml:"code_server_offline"`
+
+	// CodeServerMirror is where code-server releases are downloaded from.
+	CodeServerMirror string `toml:"code_server_mirror"`
+}
+
+// gitConfig describes the [git] table of the config.
+type gitConfig struct {
+	// ForwardIdentity copies the host's git identity and signing
+	// settings into the container.
+	ForwardIdentity bool `toml:"forward_identity"`
+	// ForwardCredentials answers git credential requests from the
+	// container with the host's credential helpers.
+	ForwardCredentials bool `toml:"forward_credentials"`
+	// ForwardGPG forwards the host's gpg-agent into the container
+	// so commits can be signed.
+	ForwardGPG bool `toml:"forward_gpg"`
+}
+
+// configDefaults returns the values of config keys that aren't set
+// by any config file.
+func configDefaults() config {
+	return config{
+		Git: gitConfig{
+			ForwardIdentity: true,
+		},
+	}
+}
+
+// resourcesConfig describes the [resources] table of the config.
+type resourcesConfig struct {
+	// CPUs is the number of CPUs the container may use, e.g 1.5.
+	CPUs float64 `toml:"cpus"`
+	// Memory is the memory limit of the container, e.g "4g".
+	Memory string `toml:"memory"`
 }
 
 // DefaultConfig is the default configuration file string.
@@ -58,13 +160,141 @@ default_schema = "ssh"
 # default host used to clone repo in sail run if none given
 default_host = "github.com"
 
-# default_oranization lets you configure which username to use on default_host
+# default_organization lets you configure which username to use on default_host
 # when cloning a repo.
 # default_organization = ""
+
+# online_timeout is how long to wait for code-server to start in a new container.
+# online_timeout = "10s"
+
+# edit_grace_period is how long the container replaced by sail edit is kept, stopped,
+# so that sail edit -rollback can swap back to it. "0s" removes it right away.
+# edit_grace_period = "1h"
+
+# idle_timeout stops a project's container once it has gone unused for this long,
+# counting requests through the proxy, open editor tabs and terminal activity. It's
+# started again by the next request to the project.
+# idle_timeout = "2h"
+
+# proxy is how the browser reaches code-server. With "daemon", a single sail daemon
+# is started on daemon_address and serves every project on its own subdomain of
+# localhost, e.g http://cdr--sail.localhost:7080. With "fork", a proxy process is
+# started for each project on a random port.
+# proxy = "daemon"
+# daemon_address = "localhost:7080"
+
+# proxy_address is the host forked proxies listen on. Set it, or daemon_address,
+# to "0.0.0.0" to reach projects from other machines.
+# proxy_address = "localhost"
+
+# Browsers are logged in to a project through a token in the URL sail opens, which is
+# kept in ~/.config/sail/<org>_<repo>/proxy_token. proxy_password additionally allows
+# logging in with a password, for when daemon_address is reachable from other machines.
+# proxy_password = ""
+
+# code_server_version pins the version of code-server mounted into project containers.
+# Without it, the latest version is used the first time and then kept until
+# "sail code-server update". An image can pin it too with a code_server_version label.
+# Set it to "image" to use the code-server installed in the project's image instead.
+# code_server_version = "2.1523-vsc1.38.1"
+
+# code_server_offline only uses code-server binaries that are already cached, however
+# old they are, and never checks for or downloads releases. Binaries can be cached
+# without network access with "sail code-server install -from <archive>".
+# code_server_offline = false
+
+# code_server_mirror is where code-server release archives are downloaded from, laid out
+# as <mirror>/<version>/code-server<version>-linux-x86_64.tar.gz. Archives are verified
+# against <mirror>/<version>/SHA256SUMS if it exists, and otherwise against the checksum
+# recorded in ~/.config/sail/code-server/SHA256SUMS. Versions with neither must be
+# installed with "sail code-server install -from <archive>" or "sail code-server update -trust".
+# code_server_mirror = "https://github.com/cdr/code-server/releases/download"
+
+# language_images maps the language detected in a repository to the image used
+# when the repository doesn't provide a .sail/Dockerfile. The language is detected
+# from the local clone through its build manifest or the file extensions of its source.
+# Languages without an entry use sail's built-in images, or default_image.
+# [language_images]
+# go = "codercom/ubuntu-dev-go:latest"
+# javascript = "codercom/ubuntu-dev-node12:latest"
+# typescript = "codercom/ubuntu-dev-node12:latest"
+# python = "codercom/ubuntu-dev-python3.7:latest"
+# c = "codercom/ubuntu-dev-gcc8:latest"
+# "c++" = "codercom/ubuntu-dev-gcc8:latest"
+# java = "codercom/ubuntu-dev-openjdk12:latest"
+# ruby = "codercom/ubuntu-dev-ruby2.6:latest"
+
+# resources limits the CPU and memory available to project containers.
+# [resources]
+# cpus = 2.0
+# memory = "4g"
+
+# env sets environment variables inside project containers.
+# [env]
+# EXAMPLE = "value"
+
+# env_from sets environment variables from the contents of a file or the output
+# of a command on the host. Values marked secret are mounted as files in
+# /run/secrets instead, with <NAME>_FILE set to their path. It's ignored in a
+# repository's .sail/sail.toml, as it runs on the host.
+# [env_from]
+# GITHUB_TOKEN = { command = "gh auth token", secret = true }
+# NPM_TOKEN = { file = "~/.npm_token" }
+
+# git configures how your git setup is shared with project containers.
+# forward_identity copies your git user and commit signing settings into the container.
+# forward_credentials lets git inside the container use the host's credential helpers,
+# so HTTPS remotes can be pushed to without storing tokens in the container. Any process
+# in a project container can then ask for any of your credentials, so it's off by default
+# and can only be enabled in this file.
+# forward_gpg forwards your gpg-agent and public keyring into the container so
+# commits can be signed without copying private keys. It can only be enabled in this
+# file, or for a single project with sail run --gpg.
+[git]
+forward_identity = true
+forward_credentials = false
+forward_gpg = false
+
+# dotfiles installs your dotfiles into every project container without writing a hat.
+# The repository is cloned on the host, mounted at ~/.dotfiles, and install is run
+# from it once per container. Without install, the first of install.sh, install,
+# bootstrap.sh, bootstrap, setup.sh and setup found in the repository is run.
+# [dotfiles]
+# repo = "github.com/<user>/dotfiles"
+# install = "./install.sh"
+
+# tls serves the proxy over HTTPS, which browsers require for the clipboard, service
+# workers and webviews on origins other than localhost. Without a cert and key,
+# certificates are issued by a local CA under ~/.config/sail/ca that
+# "sail ca install" adds to your trust store.
+# [tls]
+# enabled = false
+# cert = ""
+# key = ""
+
+# probes declare when a project is ready to use beyond code-server having started,
+# e.g once its language server is running or its database accepts connections.
+# sail run and sail edit wait on every probe. Each probe sets one of command, http
+# or tcp, which is checked inside of the container, and an optional timeout.
+# [probes.db]
+# tcp = "localhost:5432"
+# timeout = "1m"
+
+# Any of the above, except project_root, the proxy settings and code_server_mirror,
+# can be overridden per project with a .sail/sail.toml committed to the repository
+# or with a personal override file at ~/.config/sail/projects/<org>_<repo>.toml.
 `
 
+// metaRootDir replaces the directory returned by metaRoot when set.
+// Tests point it at a temporary directory so they never touch the user's config.
+var metaRootDir string
+
 // metaRoot returns the root path of all metadata stored on the host.
 func metaRoot() string {
+	if metaRootDir != "" {
+		return metaRootDir
+	}
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		panic(err)
@@ -73,10 +303,13 @@ func metaRoot() string {
 	return filepath.Join(homeDir, ".config", "sail")
 }
 
+// mustReadConfig reads the config at path, writing the default config
+// there if it doesn't exist yet.
+// Unknown keys are reported but don't prevent the config from being used.
 func mustReadConfig(path string) config {
-	var c config
+	c := configDefaults()
 
-	_, err := toml.DecodeFile(path, &c)
+	md, err := toml.DecodeFile(path, &c)
 	if err != nil {
 		if os.IsNotExist(err) {
 			flog.Info("No configuration exists at %v, writing default.", path)
@@ -94,7 +327,270 @@ func mustReadConfig(path string) config {
 
 			return mustReadConfig(path)
 		}
-		flog.Fatal("failed to parse config @ %v\n%v", path, err)
+		flog.Fatal("failed to parse config @ %v\n%v\nrun `sail config validate` or `sail config edit` to fix it", path, err)
+	}
+
+	for _, key := range md.Undecoded() {
+		msg := fmt.Sprintf("unknown key %v in config @ %v", key, path)
+		if s := suggestConfigKey(key.String()); s != "" {
+			msg += fmt.Sprintf(", did you mean %v?", s)
+		}
+		flog.Error("%v", msg)
 	}
 	return c
 }
+
+// defaultConfigSource is the source reported for config keys that
+// were not set by any config file.
+const defaultConfigSource = "default"
+
+// globalOnlyConfigKeys can't be overridden by project config files.
+// Keys of tables are dotted, e.g "git.forward_credentials".
+var globalOnlyConfigKeys = map[string]struct{}{
+	"project_root":   {},
+	"daemon_address": {},
+	"proxy_password": {},
+	"proxy_address":  {},
+	"tls":            {},
+	// Repositories must not choose where binaries run on the host come from.
+	"code_server_mirror": {},
+	// Credentials are shared with every project's container, so only the
+	// user may choose to forward them.
+	"git.forward_credentials": {},
+	// Forwarding gpg-agent lets the container sign with the user's keys.
+	"git.forward_gpg": {},
+}
+
+// trustedConfigKeys can't be set by the config committed to a repository,
+// as they run commands or read files on the host. Unlike global only keys,
+// they can be set in the personal override of a project.
+var trustedConfigKeys = map[string]struct{}{
+	"env_from": {},
+}
+
+// configLayer is the kind of config file that's merged over the config.
+type configLayer int
+
+const (
+	globalConfigLayer configLayer = iota
+	// repoConfigLayer is the config committed to the project's repository,
+	// which comes with the clone and isn't trusted.
+	repoConfigLayer
+	// personalConfigLayer is the user's override for a project.
+	personalConfigLayer
+)
+
+// ignores returns why key can't be set in config files of the layer,
+// or "" if it can.
+func (l configLayer) ignores(key string) string {
+	if _, ok := globalOnlyConfigKeys[key]; ok && l != globalConfigLayer {
+		return "it can only be set in the global config"
+	}
+	if _, ok := trustedConfigKeys[key]; ok && l == repoConfigLayer {
+		return "it can't be set by the repository, set it in the global config or in " +
+			filepath.Join(metaRoot(), "projects") + " instead"
+	}
+	return ""
+}
+
+// configSources records the file each effective config key was read from.
+// Keys of tables are dotted, e.g "resources.memory" or "env.FOO".
+type configSources map[string]string
+
+// source returns the file key was read from.
+func (s configSources) source(key string) string {
+	src, ok := s[key]
+	if !ok {
+		return defaultConfigSource
+	}
+	return src
+}
+
+// projectConfigPaths returns the per-project config files for p in the
+// order they are merged over the global config. The repository's
+// committed config comes first so that the user's personal override
+// always has the final say.
+func projectConfigPaths(p *project) []string {
+	return []string{
+		filepath.Join(p.localDir(), ".sail", "sail.toml"),
+		filepath.Join(metaRoot(), "projects", p.cntName()+".toml"),
+	}
+}
+
+// readConfigLayers reads the global config at globalPath and merges the
+// repository's config at repoPath and then each of personalPaths over it.
+// Project config files that don't exist, or are "", are skipped.
+func readConfigLayers(globalPath, repoPath string, personalPaths ...string) (config, configSources, error) {
+	var (
+		c       = configDefaults()
+		sources = make(configSources)
+	)
+
+	_, err := mergeConfigFile(&c, sources, globalPath, globalConfigLayer)
+	if err != nil {
+		return config{}, nil, err
+	}
+
+	if repoPath != "" {
+		_, err = mergeConfigFile(&c, sources, repoPath, repoConfigLayer)
+		if err != nil {
+			return config{}, nil, err
+		}
+	}
+
+	for _, path := range personalPaths {
+		_, err = mergeConfigFile(&c, sources, path, personalConfigLayer)
+		if err != nil {
+			return config{}, nil, err
+		}
+	}
+
+	return c, sources, nil
+}
+
+// mergeConfigFile merges every key defined in the config file at path over c.
+// Tables are merged key by key, and keys the layer can't set are skipped.
+// It returns false if the file doesn't exist.
+func mergeConfigFile(c *config, sources configSources, path string, layer configLayer) (bool, error) {
+	var fileConf config
+	md, err := toml.DecodeFile(path, &fileConf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, xerrors.Errorf("failed to parse config @ %v: %w", path, err)
+	}
+
+	dst := reflect.ValueOf(c).Elem()
+	src := reflect.ValueOf(fileConf)
+	typ := dst.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		key := typ.Field(i).Tag.Get("toml")
+
+		if reason := layer.ignores(key); reason != "" {
+			if md.IsDefined(key) {
+				flog.Error("ignoring %v in %v: %v", key, path, reason)
+			}
+			continue
+		}
+
+		dstField, srcField := dst.Field(i), src.Field(i)
+		switch dstField.Kind() {
+		case reflect.Map:
+			if srcField.Len() == 0 {
+				continue
+			}
+			if dstField.IsNil() {
+				dstField.Set(reflect.MakeMap(dstField.Type()))
+			}
+			for _, k := range srcField.MapKeys() {
+				dstField.SetMapIndex(k, srcField.MapIndex(k))
+				sources[key+"."+k.String()] = path
+			}
+		case reflect.Struct:
+			subTyp := dstField.Type()
+			for j := 0; j < subTyp.NumField(); j++ {
+				subKey := subTyp.Field(j).Tag.Get("toml")
+				if !md.IsDefined(key, subKey) {
+					continue
+				}
+				if reason := layer.ignores(key + "." + subKey); reason != "" {
+					flog.Error("ignoring %v.%v in %v: %v", key, subKey, path, reason)
+					continue
+				}
+				dstField.Field(j).Set(srcField.Field(j))
+				sources[key+"."+subKey] = path
+			}
+		default:
+			if !md.IsDefined(key) {
+				continue
+			}
+			dstField.Set(srcField)
+			sources[key] = path
+		}
+	}
+
+	return true, nil
+}
+
+// configEntry is a single effective config value.
+type configEntry struct {
+	key   string
+	value string
+}
+
+// configEntries flattens c into a list of dotted keys and their values,
+// in the order they're declared in the config struct.
+func configEntries(c config) []configEntry {
+	var entries []configEntry
+
+	v := reflect.ValueOf(c)
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		key := typ.Field(i).Tag.Get("toml")
+		field := v.Field(i)
+
+		switch field.Kind() {
+		case reflect.Map:
+			keys := make([]string, 0, field.Len())
+			for _, k := range field.MapKeys() {
+				keys = append(keys, k.String())
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				entries = append(entries, configEntry{
+					key:   key + "." + k,
+					value: fmtConfigValue(field.MapIndex(reflect.ValueOf(k))),
+				})
+			}
+		case reflect.Struct:
+			subTyp := field.Type()
+			for j := 0; j < subTyp.NumField(); j++ {
+				entries = append(entries, configEntry{
+					key:   key + "." + subTyp.Field(j).Tag.Get("toml"),
+					value: fmtConfigValue(field.Field(j)),
+				})
+			}
+		default:
+			entries = append(entries, configEntry{
+				key:   key,
+				value: fmtConfigValue(field),
+			})
+		}
+	}
+
+	return entries
+}
+
+// fmtConfigValue formats v as it would appear in a TOML file.
+func fmtConfigValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Struct:
+		// Format as an inline table, skipping zero values.
+		var fields []string
+		for i := 0; i < v.NumField(); i++ {
+			if reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(v.Field(i).Type()).Interface()) {
+				continue
+			}
+			fields = append(fields, v.Type().Field(i).Tag.Get("toml")+" = "+fmtConfigValue(v.Field(i)))
+		}
+		return "{ " + strings.Join(fields, ", ") + " }"
+	case reflect.Float32, reflect.Float64:
+		return fmtConfigFloat(v.Float())
+	default:
+		return fmt.Sprintf("%v", v.Interface())
+	}
+}
+
+// fmtConfigFloat formats f as a TOML float.
+func fmtConfigFloat(f float64) string {
+	// TOML requires floats to have a decimal point.
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// The config is edited as text rather than re-encoded so that the user's
+// comments and formatting survive `sail config set` and `sail config unset`.
+
+var tableHeaderRe = regexp.MustCompile(`^\s*\[\s*([^\[\]]+?)\s*\]\s*(#.*)?$`)
+
+// keyLineRe matches an assignment to key, or a commented out one.
+func keyLineRe(key string, commented bool) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(key)
+	keyPat := `(` + quoted + `|"` + quoted + `")`
+	if commented {
+		return regexp.MustCompile(`^\s*#\s*` + keyPat + `\s*=`)
+	}
+	return regexp.MustCompile(`^\s*` + keyPat + `\s*=`)
+}
+
+// fmtConfigInput converts the user provided value for key into its TOML
+// representation, checking that it's of the right type.
+func fmtConfigInput(key, value string) (string, error) {
+	typ, ok := configKeyType(key)
+	if !ok {
+		msg := "unknown config key " + key
+		if s := suggestConfigKey(key); s != "" {
+			msg += ", did you mean " + s + "?"
+		}
+		return "", xerrors.New(msg)
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		return strconv.Quote(value), nil
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", xerrors.Errorf("%v must be a number: %w", key, err)
+		}
+		return fmtConfigFloat(f), nil
+	case reflect.Int, reflect.Int64:
+		_, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", xerrors.Errorf("%v must be an integer: %w", key, err)
+		}
+		return value, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", xerrors.Errorf("%v must be true or false: %w", key, err)
+		}
+		return strconv.FormatBool(b), nil
+	default:
+		return "", xerrors.Errorf("%v can't be set from the command line", key)
+	}
+}
+
+// splitConfigKey splits a dotted key into its table and the key within it.
+// Top level keys have an empty table.
+func splitConfigKey(key string) (table, name string) {
+	i := strings.Index(key, ".")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+// tableBounds returns the range of lines [start, end) belonging to table.
+// The top level table spans from the start of the file to the first header.
+// ok is false if the table has no header in the file.
+func tableBounds(lines []string, table string) (start, end int, ok bool) {
+	start = -1
+	if table == "" {
+		start = 0
+	}
+
+	for i, line := range lines {
+		m := tableHeaderRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if start >= 0 {
+			return start, i, true
+		}
+		if strings.Trim(m[1], `"`) == table {
+			start = i + 1
+		}
+	}
+
+	if start < 0 {
+		return 0, 0, false
+	}
+	return start, len(lines), true
+}
+
+// setConfigText sets key to the already formatted TOML value in the config text.
+// An existing assignment is replaced in place. Otherwise the assignment is added
+// below a commented out example of the key if there is one, or at the end of its table.
+func setConfigText(text []byte, key, value string) []byte {
+	table, name := splitConfigKey(key)
+	if strings.ContainsAny(name, ".+ ") {
+		name = strconv.Quote(name)
+	}
+	assignment := name + " = " + value
+
+	lines := strings.Split(string(text), "\n")
+
+	start, end, ok := tableBounds(lines, table)
+	if !ok {
+		out := strings.TrimRight(string(text), "\n")
+		if out != "" {
+			out += "\n\n"
+		}
+		out += "[" + table + "]\n" + assignment + "\n"
+		return []byte(out)
+	}
+
+	re := keyLineRe(strings.Trim(name, `"`), false)
+	for i := start; i < end; i++ {
+		if re.MatchString(lines[i]) {
+			lines[i] = assignment
+			return []byte(strings.Join(lines, "\n"))
+		}
+	}
+
+	insertAt := -1
+	commentRe := keyLineRe(strings.Trim(name, `"`), true)
+	for i := start; i < end; i++ {
+		if commentRe.MatchString(lines[i]) {
+			insertAt = i + 1
+			break
+		}
+	}
+	if insertAt < 0 {
+		// Insert after the table's last non-blank line. If another table follows,
+		// also skip the comments that introduce it.
+		insertAt = end
+		for insertAt > start {
+			line := strings.TrimSpace(lines[insertAt-1])
+			if line != "" && (end == len(lines) || !strings.HasPrefix(line, "#")) {
+				break
+			}
+			insertAt--
+		}
+	}
+
+	lines = append(lines[:insertAt], append([]string{assignment}, lines[insertAt:]...)...)
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// unsetConfigText removes the assignment to key from the config text.
+// It returns false if the key wasn't set.
+func unsetConfigText(text []byte, key string) ([]byte, bool) {
+	table, name := splitConfigKey(key)
+
+	lines := strings.Split(string(text), "\n")
+	start, end, ok := tableBounds(lines, table)
+	if !ok {
+		return text, false
+	}
+
+	re := keyLineRe(name, false)
+	for i := start; i < end; i++ {
+		if re.MatchString(lines[i]) {
+			lines = append(lines[:i], lines[i+1:]...)
+			return []byte(strings.Join(lines, "\n")), true
+		}
+	}
+	return text, false
+}
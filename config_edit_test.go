@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_setConfigText(t *testing.T) {
+	t.Parallel()
+
+	const conf = `# sail configuration.
+default_image = "codercom/ubuntu-dev"
+
+# default_hat = ""
+
+[env]
+# A comment.
+FOO = "bar"
+`
+
+	var tests = []struct {
+		name  string
+		key   string
+		value string
+		exp   string
+	}{
+		{
+			"Replace",
+			"default_image",
+			`"codercom/ubuntu-dev-go"`,
+			`# sail configuration.
+default_image = "codercom/ubuntu-dev-go"
+
+# default_hat = ""
+
+[env]
+# A comment.
+FOO = "bar"
+`,
+		},
+		{
+			"BelowExample",
+			"default_hat",
+			`"./hat"`,
+			`# sail configuration.
+default_image = "codercom/ubuntu-dev"
+
+# default_hat = ""
+default_hat = "./hat"
+
+[env]
+# A comment.
+FOO = "bar"
+`,
+		},
+		{
+			"ExistingTable",
+			"env.BAZ",
+			`"qux"`,
+			`# sail configuration.
+default_image = "codercom/ubuntu-dev"
+
+# default_hat = ""
+
+[env]
+# A comment.
+FOO = "bar"
+BAZ = "qux"
+`,
+		},
+		{
+			"NewTable",
+			"resources.cpus",
+			`2.0`,
+			`# sail configuration.
+default_image = "codercom/ubuntu-dev"
+
+# default_hat = ""
+
+[env]
+# A comment.
+FOO = "bar"
+
+[resources]
+cpus = 2.0
+`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			out := setConfigText([]byte(conf), test.key, test.value)
+			assert.Equal(t, test.exp, string(out))
+		})
+	}
+
+	t.Run("Unset", func(t *testing.T) {
+		t.Parallel()
+
+		out, ok := unsetConfigText([]byte(conf), "env.FOO")
+		require.True(t, ok)
+		assert.NotContains(t, string(out), "FOO")
+		assert.Contains(t, string(out), "# A comment.")
+
+		_, ok = unsetConfigText([]byte(conf), "default_hat")
+		assert.False(t, ok)
+	})
+}
+
+func Test_fmtConfigInput(t *testing.T) {
+	t.Parallel()
+
+	v, err := fmtConfigInput("resources.cpus", "2")
+	require.NoError(t, err)
+	assert.Equal(t, "2.0", v)
+
+	v, err = fmtConfigInput("env.FOO", `say "hi"`)
+	require.NoError(t, err)
+	assert.Equal(t, `"say \"hi\""`, v)
+
+	_, err = fmtConfigInput("resources.cpus", "lots")
+	require.Error(t, err)
+
+	_, err = fmtConfigInput("default_oranization", "cdr")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "default_organization")
+}
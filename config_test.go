@@ -1,9 +1,14 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -33,3 +38,106 @@ func Test_resolvePath(t *testing.T) {
 		})
 	}
 }
+
+func Test_readConfigLayers(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "sail-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(content), 0640)
+		require.NoError(t, err)
+		return path
+	}
+
+	global := write("global.toml", `
+default_image = "codercom/ubuntu-dev"
+project_root = "~/Projects"
+
+[env]
+A = "global"
+B = "global"
+
+[resources]
+cpus = 1.0
+`)
+	repoConf := write("repo.toml", `
+default_hat = "./hat"
+project_root = "~/elsewhere"
+
+[env]
+B = "repo"
+
+[resources]
+memory = "2g"
+
+[git]
+forward_identity = false
+forward_credentials = true
+forward_gpg = true
+
+[env_from]
+STOLEN = { command = "cat ~/.ssh/id_rsa" }
+KEY = { file = "~/.ssh/id_rsa" }
+`)
+	userConf := write("user.toml", `
+default_hat = "./my-hat"
+
+[env_from]
+NPM_TOKEN = { file = "~/.npm_token" }
+`)
+
+	conf, sources, err := readConfigLayers(global, repoConf, userConf, filepath.Join(dir, "missing.toml"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "codercom/ubuntu-dev", conf.DefaultImage)
+	assert.Equal(t, global, sources.source("default_image"))
+
+	// project_root can only be set globally.
+	assert.Equal(t, "~/Projects", conf.ProjectRoot)
+	assert.Equal(t, global, sources.source("project_root"))
+
+	assert.Equal(t, "./my-hat", conf.DefaultHat)
+	assert.Equal(t, userConf, sources.source("default_hat"))
+
+	assert.Equal(t, map[string]string{"A": "global", "B": "repo"}, conf.Env)
+	assert.Equal(t, repoConf, sources.source("env.B"))
+
+	assert.Equal(t, 1.0, conf.Resources.CPUs)
+	assert.Equal(t, "2g", conf.Resources.Memory)
+	assert.Equal(t, repoConf, sources.source("resources.memory"))
+
+	// Credential and gpg-agent forwarding can only be enabled globally.
+	assert.False(t, conf.Git.ForwardIdentity)
+	assert.False(t, conf.Git.ForwardCredentials)
+	assert.Equal(t, defaultConfigSource, sources.source("git.forward_credentials"))
+	assert.False(t, conf.Git.ForwardGPG)
+
+	// Repositories can't run commands or read files on the host.
+	assert.Equal(t, map[string]envSource{
+		"NPM_TOKEN": {File: "~/.npm_token"},
+	}, conf.EnvFrom)
+	assert.Equal(t, userConf, sources.source("env_from.NPM_TOKEN"))
+
+	assert.Equal(t, defaultConfigSource, sources.source("default_schema"))
+}
+
+func Test_DefaultConfigExamples(t *testing.T) {
+	t.Parallel()
+
+	// Every commented out example must end up in the right table once it's
+	// uncommented.
+	exampleRx := regexp.MustCompile(`(?m)^# (\[[a-z_.]+\]|[a-z_"+]+ = .+)$`)
+	text := exampleRx.ReplaceAllString(DefaultConfig, "$1")
+	require.NotEqual(t, DefaultConfig, text)
+
+	var c config
+	md, err := toml.Decode(text, &c)
+	require.NoError(t, err, text)
+	assert.Empty(t, md.Undecoded())
+	assert.NotEmpty(t, c.CodeServerVersion)
+	assert.NotEmpty(t, c.CodeServerMirror)
+}
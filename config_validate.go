@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/docker/go-units"
+
+	"go.coder.com/sail/internal/codeserver"
+)
+
+// configProblem describes an issue found while validating a config file.
+type configProblem struct {
+	key string
+	msg string
+}
+
+func (p configProblem) String() string {
+	if p.key == "" {
+		return p.msg
+	}
+	return fmt.Sprintf("%v: %v", p.key, p.msg)
+}
+
+// validateConfigFile parses the config file at path and returns any problems with it.
+// isProject should be set for per-project config files, which can't set global only keys.
+// An error is returned if the file can't be read.
+func validateConfigFile(path string, isProject bool) ([]configProblem, error) {
+	var c config
+	md, err := toml.DecodeFile(path, &c)
+	if err != nil {
+		if _, ok := err.(*os.PathError); ok {
+			return nil, err
+		}
+		// Syntax errors or values of the wrong type.
+		return []configProblem{{msg: err.Error()}}, nil
+	}
+
+	var problems []configProblem
+	for _, key := range md.Undecoded() {
+		k := key.String()
+		msg := "unknown key"
+		if s := suggestConfigKey(k); s != "" {
+			msg = fmt.Sprintf("unknown key, did you mean %v?", s)
+		}
+		problems = append(problems, configProblem{key: k, msg: msg})
+	}
+
+	if isProject {
+		for key := range globalOnlyConfigKeys {
+			if md.IsDefined(strings.Split(key, ".")...) {
+				problems = append(problems, configProblem{key: key, msg: "can only be set in the global config"})
+			}
+		}
+	} else if c.ProjectRoot == "" {
+		problems = append(problems, configProblem{key: "project_root", msg: "must be set"})
+	}
+
+	return append(problems, validateConfig(c)...), nil
+}
+
+// validateConfig checks the values of c.
+func validateConfig(c config) []configProblem {
+	var problems []configProblem
+
+	if c.DefaultSchema != "" && !isAllowedSchema(c.DefaultSchema) {
+		problems = append(problems, configProblem{
+			key: "default_schema",
+			msg: fmt.Sprintf("%q is not one of ssh, http or https", c.DefaultSchema),
+		})
+	}
+
+	if v := c.CodeServerVersion; v != "" && v != codeServerFromImage {
+		err := codeserver.ValidateVersion(v)
+		if err != nil {
+			problems = append(problems, configProblem{key: "code_server_version", msg: err.Error()})
+		}
+	}
+
+	if c.Resources.CPUs < 0 {
+		problems = append(problems, configProblem{key: "resources.cpus", msg: "must not be negative"})
+	}
+	if c.Resources.Memory != "" {
+		_, err := units.RAMInBytes(c.Resources.Memory)
+		if err != nil {
+			problems = append(problems, configProblem{
+				key: "resources.memory",
+				msg: fmt.Sprintf("invalid size %q", c.Resources.Memory),
+			})
+		}
+	}
+
+	for lang, image := range c.LanguageImages {
+		if image == "" {
+			problems = append(problems, configProblem{key: "language_images." + lang, msg: "image must not be empty"})
+		}
+	}
+
+	for name, src := range c.EnvFrom {
+		if (src.File == "") == (src.Command == "") {
+			problems = append(problems, configProblem{key: "env_from." + name, msg: "exactly one of file or command must be set"})
+		}
+	}
+
+	if c.Proxy != "" && c.Proxy != proxyModeDaemon && c.Proxy != proxyModeFork {
+		problems = append(problems, configProblem{
+			key: "proxy",
+			msg: fmt.Sprintf("%q is not one of daemon or fork", c.Proxy),
+		})
+	}
+	if c.DaemonAddress != "" {
+		_, _, err := net.SplitHostPort(c.DaemonAddress)
+		if err != nil {
+			problems = append(problems, configProblem{
+				key: "daemon_address",
+				msg: fmt.Sprintf("invalid address %q", c.DaemonAddress),
+			})
+		}
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		problems = append(problems, configProblem{key: "tls.cert", msg: "tls.cert and tls.key must be set together"})
+	}
+
+	durations := map[string]string{
+		"online_timeout":    c.OnlineTimeout,
+		"edit_grace_period": c.EditGracePeriod,
+		"idle_timeout":      c.IdleTimeout,
+	}
+	for key, d := range durations {
+		if d == "" {
+			continue
+		}
+		_, err := time.ParseDuration(d)
+		if err != nil {
+			problems = append(problems, configProblem{key: key, msg: fmt.Sprintf("invalid duration %q", d)})
+		}
+	}
+
+	for name, p := range c.Probes {
+		err := p.validate()
+		if err != nil {
+			problems = append(problems, configProblem{key: "probes." + name, msg: err.Error()})
+		}
+	}
+
+	if c.Dotfiles.Install != "" && c.Dotfiles.Repo == "" {
+		problems = append(problems, configProblem{key: "dotfiles.install", msg: "requires dotfiles.repo to be set"})
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].key < problems[j].key
+	})
+	return problems
+}
+
+// knownConfigKeys returns every key the config accepts. Tables whose keys
+// are arbitrary, like [env], are returned as their table name.
+func knownConfigKeys() []string {
+	var keys []string
+
+	typ := reflect.TypeOf(config{})
+	for i := 0; i < typ.NumField(); i++ {
+		key := typ.Field(i).Tag.Get("toml")
+		field := typ.Field(i).Type
+
+		if field.Kind() == reflect.Struct {
+			for j := 0; j < field.NumField(); j++ {
+				keys = append(keys, key+"."+field.Field(j).Tag.Get("toml"))
+			}
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// configKeyType returns the type of the value stored at the dotted config key.
+func configKeyType(key string) (reflect.Type, bool) {
+	parts := strings.SplitN(key, ".", 2)
+
+	typ := reflect.TypeOf(config{})
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).Tag.Get("toml") != parts[0] {
+			continue
+		}
+		field := typ.Field(i).Type
+
+		switch field.Kind() {
+		case reflect.Map:
+			if len(parts) != 2 || parts[1] == "" {
+				return nil, false
+			}
+			return field.Elem(), true
+		case reflect.Struct:
+			if len(parts) != 2 {
+				return nil, false
+			}
+			for j := 0; j < field.NumField(); j++ {
+				if field.Field(j).Tag.Get("toml") == parts[1] {
+					return field.Field(j).Type, true
+				}
+			}
+			return nil, false
+		default:
+			if len(parts) != 1 {
+				return nil, false
+			}
+			return field, true
+		}
+	}
+	return nil, false
+}
+
+// suggestConfigKey returns the known key closest to key, or the empty
+// string if none are close enough to be a likely typo.
+func suggestConfigKey(key string) string {
+	var (
+		best     string
+		bestDist = -1
+	)
+	for _, known := range knownConfigKeys() {
+		dist := levenshtein(key, known)
+		if bestDist == -1 || dist < bestDist {
+			best, bestDist = known, dist
+		}
+	}
+
+	// Allow roughly a third of the key to be wrong.
+	if bestDist > len(key)/3+1 {
+		return ""
+	}
+	return best
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
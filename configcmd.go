@@ -0,0 +1,346 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+)
+
+type configcmd struct {
+	gf *globalFlags
+}
+
+func (c *configcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "config",
+		Usage: "COMMAND [ARGS...]",
+		Desc: `Inspect and modify sail's configuration.
+The global config is merged with per-project overrides from the repository's
+.sail/sail.toml, and then from ~/.config/sail/projects/<org>_<repo>.toml.
+Later files take precedence, and tables such as [env] are merged key by key.`,
+	}
+}
+
+func (c *configcmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&configShowCmd{gf: c.gf},
+		&configGetCmd{gf: c.gf},
+		&configSetCmd{configFileFlags{gf: c.gf}},
+		&configUnsetCmd{configFileFlags{gf: c.gf}},
+		&configEditCmd{configFileFlags{gf: c.gf}},
+		&configValidateCmd{gf: c.gf},
+	}
+}
+
+func (c *configcmd) Run(fl *flag.FlagSet) {
+	fl.Usage()
+	os.Exit(1)
+}
+
+type configShowCmd struct {
+	gf *globalFlags
+}
+
+func (c *configShowCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "show",
+		Usage: "[repo]",
+		Desc: `Prints the effective configuration and where each value came from.
+If no repo is provided, the global configuration is printed.`,
+	}
+}
+
+func (c *configShowCmd) Run(fl *flag.FlagSet) {
+	var (
+		conf    config
+		sources configSources
+	)
+
+	if fl.NArg() == 0 {
+		var err error
+		// Ensures the global config exists.
+		c.gf.config()
+		conf, sources, err = readConfigLayers(c.gf.configPath, "")
+		if err != nil {
+			flog.Fatal("%v", err)
+		}
+	} else {
+		proj := c.gf.project(schemaPrefs{}, fl)
+		conf, sources = proj.conf, proj.confSources
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(tw, "key\tvalue\tsource\n")
+	for _, e := range configEntries(conf) {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", e.key, e.value, sources.source(e.key))
+	}
+	tw.Flush()
+}
+
+type configGetCmd struct {
+	gf *globalFlags
+}
+
+func (c *configGetCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "get",
+		Usage: "<key> [repo]",
+		Desc: `Prints the effective value of a config key.
+Keys within tables are dotted, e.g resources.memory or env.FOO.
+If a repo is provided, the project's overrides are taken into account.`,
+	}
+}
+
+func (c *configGetCmd) Run(fl *flag.FlagSet) {
+	key := fl.Arg(0)
+	if key == "" {
+		fl.Usage()
+		os.Exit(1)
+	}
+	if _, ok := configKeyType(key); !ok {
+		fatalUnknownConfigKey(key)
+	}
+
+	conf := c.gf.config()
+	if fl.NArg() > 1 {
+		projFl := flag.NewFlagSet("", flag.ExitOnError)
+		_ = projFl.Parse(fl.Args()[1:])
+		conf = c.gf.project(schemaPrefs{}, projFl).conf
+	}
+
+	for _, e := range configEntries(conf) {
+		if e.key == key {
+			fmt.Println(e.value)
+			return
+		}
+	}
+	// The key is a table entry that isn't set.
+	os.Exit(1)
+}
+
+// configFileFlags are shared by the commands that modify config files.
+type configFileFlags struct {
+	gf      *globalFlags
+	project string
+}
+
+func (c *configFileFlags) RegisterFlags(fl *flag.FlagSet) {
+	fl.StringVar(&c.project, "project", "", "Modify the personal override file of this project instead of the global config.")
+}
+
+// path returns the config file to modify.
+func (c *configFileFlags) path() (path string, isProject bool) {
+	if c.project == "" {
+		// Write the default config if there is none, but don't parse an existing
+		// one as it may be broken and in need of editing.
+		if _, err := os.Stat(c.gf.configPath); os.IsNotExist(err) {
+			c.gf.config()
+		}
+		return c.gf.configPath, false
+	}
+
+	conf := c.gf.config()
+	r, err := parseRepo(conf.DefaultSchema, conf.DefaultHost, conf.DefaultOrganization, c.project)
+	if err != nil {
+		flog.Fatal("failed to parse repo %q: %v", c.project, err)
+	}
+	return filepath.Join(metaRoot(), "projects", r.DockerName()+".toml"), true
+}
+
+// write validates text and writes it to path. Nothing is written if the
+// new config would be invalid.
+func (c *configFileFlags) write(path string, isProject bool, text []byte) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		flog.Fatal("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = tmp.Write(text)
+	if err != nil {
+		flog.Fatal("failed to write %v: %v", tmp.Name(), err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		flog.Fatal("failed to close %v: %v", tmp.Name(), err)
+	}
+
+	problems, err := validateConfigFile(tmp.Name(), isProject)
+	if err != nil {
+		flog.Fatal("failed to validate config: %v", err)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			flog.Error("%v", p)
+		}
+		flog.Fatal("refusing to write invalid config to %v", path)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		flog.Fatal("failed to write %v: %v", path, err)
+	}
+}
+
+// read reads the config file at path. A missing file is treated as empty.
+func (c *configFileFlags) read(path string) []byte {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		flog.Fatal("failed to create %v: %v", filepath.Dir(path), err)
+	}
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		flog.Fatal("failed to read %v: %v", path, err)
+	}
+	return text
+}
+
+type configSetCmd struct {
+	configFileFlags
+}
+
+func (c *configSetCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "set",
+		Usage: "[flags] <key> <value>",
+		Desc: `Sets a config key, keeping the file's comments intact.
+Keys within tables are dotted, e.g resources.memory or env.FOO.`,
+	}
+}
+
+func (c *configSetCmd) Run(fl *flag.FlagSet) {
+	if fl.NArg() != 2 {
+		fl.Usage()
+		os.Exit(1)
+	}
+	key, value := fl.Arg(0), fl.Arg(1)
+
+	tomlValue, err := fmtConfigInput(key, value)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+
+	path, isProject := c.path()
+	text := setConfigText(c.read(path), key, tomlValue)
+	c.write(path, isProject, text)
+}
+
+type configUnsetCmd struct {
+	configFileFlags
+}
+
+func (c *configUnsetCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "unset",
+		Usage: "[flags] <key>",
+		Desc:  "Removes a config key, keeping the file's comments intact.",
+	}
+}
+
+func (c *configUnsetCmd) Run(fl *flag.FlagSet) {
+	key := fl.Arg(0)
+	if key == "" {
+		fl.Usage()
+		os.Exit(1)
+	}
+	if _, ok := configKeyType(key); !ok {
+		fatalUnknownConfigKey(key)
+	}
+
+	path, isProject := c.path()
+	text, ok := unsetConfigText(c.read(path), key)
+	if !ok {
+		flog.Info("%v is not set in %v", key, path)
+		return
+	}
+	c.write(path, isProject, text)
+}
+
+type configEditCmd struct {
+	configFileFlags
+}
+
+func (c *configEditCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "edit",
+		Usage: "[flags]",
+		Desc: `Opens the config in your editor and validates it once the editor is closed.
+The editor can be set using the "EDITOR" environment variable.`,
+	}
+}
+
+func (c *configEditCmd) Run(fl *flag.FlagSet) {
+	path, isProject := c.path()
+	// Make sure the file exists for the editor.
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		c.write(path, isProject, c.read(path))
+	}
+
+	err := runEditor(path)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+
+	if !reportConfigProblems(path, isProject) {
+		os.Exit(1)
+	}
+}
+
+type configValidateCmd struct {
+	gf *globalFlags
+
+	project bool
+}
+
+func (c *configValidateCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "validate",
+		Usage: "[flags] [path]",
+		Desc: `Checks a config file for syntax errors, unknown keys and invalid values.
+If no path is provided, the global config is validated.`,
+	}
+}
+
+func (c *configValidateCmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.BoolVar(&c.project, "project", false, "Validate the file as a per-project config.")
+}
+
+func (c *configValidateCmd) Run(fl *flag.FlagSet) {
+	path := fl.Arg(0)
+	if path == "" {
+		path = c.gf.configPath
+	}
+
+	if !reportConfigProblems(path, c.project) {
+		os.Exit(1)
+	}
+	flog.Success("%v is valid", path)
+}
+
+// reportConfigProblems validates the config at path and logs any problems.
+// It returns true if the config is valid.
+func reportConfigProblems(path string, isProject bool) bool {
+	problems, err := validateConfigFile(path, isProject)
+	if err != nil {
+		flog.Fatal("failed to validate %v: %v", path, err)
+	}
+	for _, p := range problems {
+		flog.Error("%v: %v", path, p)
+	}
+	return len(problems) == 0
+}
+
+func fatalUnknownConfigKey(key string) {
+	if s := suggestConfigKey(key); s != "" {
+		flog.Fatal("unknown config key %v, did you mean %v?", key, s)
+	}
+	flog.Fatal("unknown config key %v", key)
+}
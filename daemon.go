@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// The sail daemon is a single long-running process that proxies to the
+// code-server of every project. Projects are served on their own subdomain
+// of localhost, e.g http://cdr--sail.localhost:7080, which browsers resolve
+// to the loopback address, or under a path prefix like
+// http://localhost:7080/p/cdr_sail/.
+const (
+	proxyModeDaemon = "daemon"
+	proxyModeFork   = "fork"
+
+	defaultDaemonAddress = "localhost:7080"
+
+	// daemonPathPrefix is the path prefix projects are served under
+	// for clients that can't resolve subdomains of localhost.
+	daemonPathPrefix = "/p/"
+)
+
+// daemonAddress returns the address the daemon listens on.
+func daemonAddress(conf config) string {
+	if conf.DaemonAddress == "" {
+		return defaultDaemonAddress
+	}
+	return conf.DaemonAddress
+}
+
+var slugInvalidRe = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// projectSlug returns the subdomain the daemon serves the
+// container named cntName on.
+func projectSlug(cntName string) string {
+	slug := strings.ToLower(strings.Replace(cntName, "_", "--", 1))
+	return strings.Trim(slugInvalidRe.ReplaceAllString(slug, "-"), "-")
+}
+
+// daemonURL returns the URL the daemon listening on addr is reached on.
+func daemonURL(addr string, tls bool) string {
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return scheme + "://" + net.JoinHostPort("localhost", port)
+}
+
+// daemonProjectURL returns the URL the daemon reached on
+// base serves the container named cntName on.
+func daemonProjectURL(base, cntName string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	u.Host = net.JoinHostPort(projectSlug(cntName)+".localhost", u.Port())
+	return u.String()
+}
+
+// daemonURLFromProjectURL returns the URL of the daemon serving the
+// project URL u. It returns false if u isn't served by a daemon.
+func daemonURLFromProjectURL(u string) (string, bool) {
+	pu, err := url.Parse(u)
+	if err != nil || !strings.HasSuffix(pu.Hostname(), ".localhost") {
+		return "", false
+	}
+	pu.Host = net.JoinHostPort("localhost", pu.Port())
+	return pu.String(), true
+}
+
+// daemonAPIURL returns the base URL of the API of the daemon reached on base.
+func daemonAPIURL(base string) string {
+	return base + sailapi.Prefix
+}
+
+// daemonLogPath returns the file the daemon logs to when started by sail.
+func daemonLogPath() string {
+	return filepath.Join(metaRoot(), "daemon.log")
+}
+
+// proxyHTTPClient talks to project proxies. Subdomains of localhost are
+// dialed on the loopback address as not every resolver handles them.
+var proxyHTTPClient = &http.Client{
+	Timeout: time.Second * 15,
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err == nil && strings.HasSuffix(host, ".localhost") {
+				addr = net.JoinHostPort("localhost", port)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: proxyClientTLS(),
+	},
+}
+
+// daemonRunning reports whether a daemon is reached on base.
+func daemonRunning(base string) bool {
+	c := &http.Client{
+		Timeout:   time.Second,
+		Transport: proxyHTTPClient.Transport,
+	}
+	resp, err := c.Get(daemonAPIURL(base) + sailapi.PathHealthz)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// ensureDaemon starts a daemon listening on addr if there
+// isn't one running on base.
+func ensureDaemon(configPath, base, addr string) error {
+	if daemonRunning(base) {
+		return nil
+	}
+
+	path := daemonLogPath()
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return xerrors.Errorf("failed to open %v: %w", path, err)
+	}
+	defer f.Close()
+
+	flog.Info("starting sail daemon on %v, writing logs to %v", addr, path)
+
+	cmd := sailCommand(configPath, "daemon", "-addr", addr)
+	cmd.Stdout = f
+	cmd.Stderr = f
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// Keep the daemon running once sail exits.
+		Setpgid: true,
+	}
+	err = cmd.Start()
+	if err != nil {
+		return xerrors.Errorf("failed to start daemon: %w", err)
+	}
+	go cmd.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	for ctx.Err() == nil {
+		if daemonRunning(base) {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return xerrors.Errorf("daemon didn't start, see %v", path)
+}
+
+// registerWithDaemon makes the daemon reached on base serve the container named cntName.
+func registerWithDaemon(base, cntName string) error {
+	token, err := daemonToken()
+	if err != nil {
+		return xerrors.Errorf("failed to get daemon token: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, daemonAPIURL(base)+"/projects/"+cntName, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := proxyHTTPClient.Do(req)
+	if err != nil {
+		return xerrors.Errorf("failed to register %v with daemon: %w", cntName, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return xerrors.Errorf("failed to register %v with daemon: %v", cntName, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// ensureProxy makes sure the container named cntName is being served,
+// starting the daemon or forking its proxy again if it isn't running.
+func ensureProxy(configPath, cntName string) error {
+	u, err := proxyURL(cntName)
+	if err != nil {
+		return err
+	}
+	base, ok := daemonURLFromProjectURL(u)
+	if !ok {
+		return ensureForkedProxy(configPath, cntName, u)
+	}
+
+	pu, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	err = ensureDaemon(configPath, base, pu.Host)
+	if err != nil {
+		return err
+	}
+	return registerWithDaemon(base, cntName)
+}
+
+// ensureForkedProxy forks the proxy of the container named cntName again
+// if nothing is serving its URL u. This only works if the proxy gets the
+// same port, as the URL is stored on the container.
+func ensureForkedProxy(configPath, cntName, u string) error {
+	err := sailapi.New(u, "", proxyHTTPClient).Healthz(context.Background())
+	if err == nil {
+		return nil
+	}
+
+	newURL, err := forkProxy(configPath, cntName)
+	if err != nil {
+		return xerrors.Errorf("failed to start proxy: %w", err)
+	}
+	if newURL != u {
+		return xerrors.Errorf("proxy of %v moved from %v to %v, the container must be recreated", cntName, u, newURL)
+	}
+	return nil
+}
+
+// daemon proxies to the containers of every project served by it.
+type daemon struct {
+	// addr is the address the daemon listens on and
+	// base is the URL it's reached on.
+	addr string
+	base string
+	// password allows logging in to projects with a password.
+	password string
+	// token must be sent as a bearer token with requests to the
+	// daemon's own API, which would otherwise reveal and register
+	// projects to any local process.
+	token string
+	// configPath is the global config the daemon was started with, which
+	// the sail commands it runs must read too.
+	configPath string
+	// forwardCredentials is git.forward_credentials of the global config,
+	// which the projects' config can't enable.
+	forwardCredentials bool
+
+	mu sync.Mutex
+	// projects maps container names to their proxies.
+	projects map[string]*proxy
+}
+
+// serves reports whether the container named cntName with the
+// proxy URL u is served by the daemon.
+func (d *daemon) serves(cntName, u string) bool {
+	return u == daemonProjectURL(d.base, cntName)
+}
+
+// register starts serving the container named cntName.
+func (d *daemon) register(cntName string, running bool) (*proxy, error) {
+	u, err := proxyURL(cntName)
+	if err != nil {
+		return nil, err
+	}
+	if !d.serves(cntName, u) {
+		return nil, xerrors.Errorf("%v is served by %v", cntName, u)
+	}
+
+	auth, err := newProxyAuth(cntName, d.password)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	p, ok := d.projects[cntName]
+	if !ok {
+		p = newProxy(u, cntName, auth)
+		p.configPath = d.configPath
+		d.projects[cntName] = p
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		p.openAccessLog()
+		go p.watchIdle()
+		flog.Info("serving %v on %v", cntName, u)
+		if d.forwardCredentials {
+			err = p.forwardGitCredentials()
+			if err != nil {
+				// Everything but pushing over HTTPS still works.
+				flog.Error("failed to forward git credentials for %v: %v", cntName, err)
+			}
+		}
+	}
+
+	if !running {
+		p.stopped()
+		return p, nil
+	}
+	return p, p.refreshPort()
+}
+
+func (d *daemon) unregister(cntName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, ok := d.projects[cntName]; ok {
+		flog.Info("no longer serving %v", cntName)
+		p.close()
+		delete(d.projects, cntName)
+	}
+}
+
+func (d *daemon) project(cntName string) (*proxy, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.projects[cntName]
+	return p, ok
+}
+
+// sync registers every existing container served by the daemon.
+func (d *daemon) sync() error {
+	cnts, err := listContainers()
+	if err != nil {
+		return xerrors.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, cnt := range cnts {
+		name := trimDockerName(cnt)
+		if name == "" || !d.serves(name, cnt.Labels[proxyURLLabel]) {
+			continue
+		}
+		go func(name string, running bool) {
+			_, err := d.register(name, running)
+			if err != nil {
+				flog.Error("failed to register %v: %v", name, err)
+			}
+		}(name, cnt.State == "running")
+	}
+	return nil
+}
+
+// watch follows the Docker events of sail containers to keep the
+// served projects up to date, reconnecting if the stream fails.
+func (d *daemon) watch() {
+	cli := dockerClient()
+	defer cli.Close()
+
+	for {
+		filter := filters.NewArgs()
+		filter.Add("type", "container")
+		filter.Add("label", sailLabel)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		msgs, errs := cli.Events(ctx, types.EventsOptions{Filters: filter})
+
+	loop:
+		for {
+			select {
+			case msg := <-msgs:
+				d.handleEvent(msg)
+			case err := <-errs:
+				flog.Error("lost docker events: %v", err)
+				break loop
+			}
+		}
+		cancel()
+
+		time.Sleep(time.Second * 5)
+		// Events may have been missed.
+		err := d.sync()
+		if err != nil {
+			flog.Error("%v", err)
+		}
+	}
+}
+
+func (d *daemon) handleEvent(msg events.Message) {
+	name := msg.Actor.Attributes["name"]
+	if !d.serves(name, msg.Actor.Attributes[proxyURLLabel]) {
+		return
+	}
+
+	switch msg.Action {
+	case "start", "rename":
+		// sail edit renames the new container to the project's name.
+		go func() {
+			_, err := d.register(name, true)
+			if err != nil {
+				flog.Error("failed to register %v: %v", name, err)
+			}
+		}()
+	case "die":
+		if p, ok := d.project(name); ok {
+			p.stopped()
+		}
+	case "destroy":
+		d.unregister(name)
+	}
+}
+
+// prune removes the previous containers kept by sail edit once they expire.
+func (d *daemon) prune() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+
+	for range t.C {
+		d.mu.Lock()
+		names := make([]string, 0, len(d.projects))
+		for name := range d.projects {
+			names = append(names, name)
+		}
+		d.mu.Unlock()
+
+		for _, name := range names {
+			err := pruneExpiredPrevious(name)
+			if err != nil {
+				flog.Error("failed to remove expired previous container of %v: %v", name, err)
+			}
+		}
+	}
+}
+
+// lookup returns the proxy of the project the request is for, along
+// with the path prefix the project is served under.
+func (d *daemon) lookup(r *http.Request) (p *proxy, prefix string, ok bool) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if strings.HasSuffix(host, ".localhost") {
+		slug := strings.TrimSuffix(host, ".localhost")
+		if _, ok := portFromHost(host); ok {
+			// Other ports of the project are served on <n>.<project>.localhost.
+			slug = slug[strings.Index(slug, ".")+1:]
+		}
+		for name, p := range d.projects {
+			if projectSlug(name) == slug {
+				return p, "", true
+			}
+		}
+		return nil, "", false
+	}
+
+	if !strings.HasPrefix(r.URL.Path, daemonPathPrefix) {
+		return nil, "", false
+	}
+	name := strings.SplitN(strings.TrimPrefix(r.URL.Path, daemonPathPrefix), "/", 2)[0]
+	p, ok = d.projects[name]
+	return p, daemonPathPrefix + name, ok
+}
+
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, prefix, ok := d.lookup(r)
+	if ok {
+		if prefix == "" {
+			p.handler.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == prefix {
+			// Relative URLs only resolve correctly under the trailing slash.
+			http.Redirect(w, r, prefix+"/", http.StatusFound)
+			return
+		}
+		http.StripPrefix(prefix, p.handler).ServeHTTP(w, r)
+		return
+	}
+
+	switch {
+	case r.URL.Path == sailapi.Prefix+sailapi.PathHealthz:
+		w.Write([]byte("ok\n"))
+	case strings.HasPrefix(r.URL.Path, "/sail/api/v1/projects") && !bearerAuthorized(r, d.token):
+		http.Error(w, "unauthorized, send the token in "+daemonTokenPath()+" as a bearer token", http.StatusUnauthorized)
+	case r.URL.Path == "/sail/api/v1/projects":
+		d.listProjects(w, r)
+	case strings.HasPrefix(r.URL.Path, "/sail/api/v1/projects/"):
+		d.registerProject(w, r)
+	default:
+		http.Error(w, "unknown project", http.StatusNotFound)
+	}
+}
+
+// daemonProject is a project in the response of the projects endpoint.
+type daemonProject struct {
+	Container string `json:"container"`
+	URL       string `json:"url"`
+	Port      string `json:"port,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (d *daemon) listProjects(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	projects := make([]daemonProject, 0, len(d.projects))
+	for name, p := range d.projects {
+		port, err := p.getCodeServerPort()
+		dp := daemonProject{
+			Container: name,
+			URL:       p.url,
+			Port:      port,
+		}
+		if err != nil {
+			dp.Error = err.Error()
+		}
+		projects = append(projects, dp)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Container < projects[j].Container
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+func (d *daemon) registerProject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/sail/api/v1/projects/")
+
+	cli := dockerClient()
+	defer cli.Close()
+
+	running := true
+	cnt, err := cli.ContainerInspect(r.Context(), name)
+	if err == nil {
+		running = cnt.State.Running
+	}
+
+	_, err = d.register(name, running)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+type daemoncmd struct {
+	gf *globalFlags
+
+	addr string
+}
+
+func (c *daemoncmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name: "daemon",
+		Desc: `Runs the sail daemon, which proxies to the code-server of every project.
+It's started automatically by sail run when the config's proxy is "daemon".
+Projects are served on http://<org>--<repo>.localhost:<port>, or under
+http://localhost:<port>/p/<org>_<repo>/.`,
+	}
+}
+
+func (c *daemoncmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.StringVar(&c.addr, "addr", "", "Address to listen on. Defaults to the config's daemon_address.")
+}
+
+func (c *daemoncmd) Run(fl *flag.FlagSet) {
+	conf := c.gf.config()
+	addr := c.addr
+	if addr == "" {
+		addr = daemonAddress(conf)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		flog.Fatal("failed to listen on %v, is another daemon running? %v", addr, err)
+	}
+
+	// The local CA must cover the address the daemon is actually reached on.
+	conf.DaemonAddress = addr
+	tlsConf, err := proxyTLS(conf)
+	if err != nil {
+		flog.Fatal("failed to configure TLS: %v", err)
+	}
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+
+	token, err := daemonToken()
+	if err != nil {
+		flog.Fatal("failed to get daemon token: %v", err)
+	}
+
+	d := &daemon{
+		addr:               addr,
+		base:               daemonURL(addr, tlsConf != nil),
+		password:           conf.ProxyPassword,
+		token:              token,
+		projects:           make(map[string]*proxy),
+		forwardCredentials: conf.Git.ForwardCredentials,
+		configPath:         c.gf.configPath,
+	}
+	err = d.sync()
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+	go d.watch()
+	go d.prune()
+
+	flog.Info("listening on %v, reached on %v", addr, d.base)
+	err = http.Serve(l, d)
+	flog.Fatal("failed to serve: %v", err)
+}
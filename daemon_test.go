@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_daemonProjectURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		cntName string
+		addr    string
+		tls     bool
+		url     string
+		// base is the URL the daemon is reached on.
+		base string
+	}{
+		{"cdr_sail", "localhost:7080", false, "http://cdr--sail.localhost:7080", "http://localhost:7080"},
+		{"nhooyr_WebSocket", "127.0.0.1:8000", false, "http://nhooyr--websocket.localhost:8000", "http://localhost:8000"},
+		{"cdr_code-server", "0.0.0.0:7080", false, "http://cdr--code-server.localhost:7080", "http://localhost:7080"},
+		{"my.org_my_repo", "localhost:7080", false, "http://my-org--my-repo.localhost:7080", "http://localhost:7080"},
+		{"cdr_sail", "0.0.0.0:7443", true, "https://cdr--sail.localhost:7443", "https://localhost:7443"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.cntName, func(t *testing.T) {
+			t.Parallel()
+
+			base := daemonURL(tc.addr, tc.tls)
+			assert.Equal(t, tc.base, base)
+
+			u := daemonProjectURL(base, tc.cntName)
+			assert.Equal(t, tc.url, u)
+
+			base, ok := daemonURLFromProjectURL(u)
+			assert.True(t, ok)
+			assert.Equal(t, tc.base, base)
+		})
+	}
+
+	_, ok := daemonURLFromProjectURL("http://127.0.0.1:41234")
+	assert.False(t, ok)
+}
+
+func Test_daemonLookup(t *testing.T) {
+	t.Parallel()
+
+	sail := newProxy("http://cdr--sail.localhost:7080", "cdr_sail", &proxyAuth{})
+	d := &daemon{
+		addr: "localhost:7080",
+		projects: map[string]*proxy{
+			"cdr_sail": sail,
+		},
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		proxy  *proxy
+		prefix string
+	}{
+		{"Host", "http://cdr--sail.localhost:7080/static/main.js", sail, ""},
+		{"PortHost", "http://3000.cdr--sail.localhost:7080/", sail, ""},
+		{"PathPrefix", "http://localhost:7080/p/cdr_sail/static/main.js", sail, "/p/cdr_sail"},
+		{"UnknownHost", "http://cdr--other.localhost:7080/", nil, ""},
+		{"UnknownPrefix", "http://localhost:7080/p/cdr_other/", nil, ""},
+		{"API", "http://localhost:7080/sail/api/v1/projects", nil, ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, prefix, ok := d.lookup(httptest.NewRequest("GET", tc.url, nil))
+			assert.Equal(t, tc.proxy != nil, ok)
+			if ok {
+				assert.Equal(t, tc.proxy, p)
+				assert.Equal(t, tc.prefix, prefix)
+			}
+		})
+	}
+}
+
+func Test_daemonAPIAuth(t *testing.T) {
+	t.Parallel()
+
+	d := &daemon{
+		addr:     "localhost:7080",
+		token:    "secret",
+		projects: map[string]*proxy{},
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		status int
+	}{
+		{"Healthz", "GET", "/sail/api/v1/healthz", "", http.StatusOK},
+		{"ListNoToken", "GET", "/sail/api/v1/projects", "", http.StatusUnauthorized},
+		{"ListWrongToken", "GET", "/sail/api/v1/projects", "Bearer wrong", http.StatusUnauthorized},
+		{"List", "GET", "/sail/api/v1/projects", "Bearer secret", http.StatusOK},
+		{"RegisterNoToken", "POST", "/sail/api/v1/projects/cdr_sail", "", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(tc.method, "http://localhost:7080"+tc.path, nil)
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+			w := httptest.NewRecorder()
+			d.ServeHTTP(w, r)
+			assert.Equal(t, tc.status, w.Code)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/codeserver"
+	"go.coder.com/sail/internal/dockutil"
+)
+
+type doctorcmd struct {
+	gf *globalFlags
+}
+
+func (c *doctorcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "doctor",
+		Usage: "[repo]",
+		Desc: `Checks that sail and its integrations are working.
+If a repo is provided, the project's container is checked as well.`,
+	}
+}
+
+// doctorCheck is a single check run by sail doctor.
+type doctorCheck struct {
+	name string
+	// run returns an error if the check fails.
+	run func() error
+}
+
+func (c *doctorcmd) Run(fl *flag.FlagSet) {
+	checks := []doctorCheck{
+		{"docker", func() error {
+			out, err := exec.Command("docker", "info").CombinedOutput()
+			if err != nil {
+				return xerrors.Errorf("failed to run `docker info`: %s: %w", out, err)
+			}
+			return nil
+		}},
+		{"config", func() error {
+			problems, err := validateConfigFile(c.gf.configPath, false)
+			if err != nil {
+				return err
+			}
+			if len(problems) > 0 {
+				return xerrors.Errorf("%v, run `sail config validate` for details", problems[0])
+			}
+			return nil
+		}},
+	}
+
+	if fl.NArg() > 0 {
+		checks = append(checks, c.projectChecks(c.gf.project(schemaPrefs{}, fl))...)
+	}
+
+	failed := false
+	for _, check := range checks {
+		err := check.run()
+		if err != nil {
+			flog.Error("%v: %v", check.name, err)
+			failed = true
+			continue
+		}
+		flog.Success("%v", check.name)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// projectChecks checks the integrations of a project's container.
+func (c *doctorcmd) projectChecks(proj *project) []doctorCheck {
+	cnt := proj.cntName()
+
+	return []doctorCheck{
+		{"container running", func() error {
+			running, err := proj.running()
+			if err != nil {
+				return err
+			}
+			if !running {
+				return xerrors.Errorf("%v is not running, run `sail run %v`", cnt, proj.repo.trimPath())
+			}
+			return nil
+		}},
+		{"code-server", func() error {
+			_, err := codeserver.PID(cnt)
+			return err
+		}},
+		{"ssh-agent", func() error {
+			if _, ok := os.LookupEnv("SSH_AUTH_SOCK"); !ok {
+				return xerrors.New("SSH_AUTH_SOCK is not set on the host")
+			}
+			out, err := dockutil.Exec(cnt, "ssh-add", "-l").CombinedOutput()
+			// ssh-add exits with 1 if the agent has no identities, which
+			// still means it's reachable.
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+				return nil
+			}
+			if err != nil {
+				return xerrors.Errorf("failed to reach ssh-agent: %s: %w", out, err)
+			}
+			return nil
+		}},
+		{"git identity", func() error {
+			out, err := dockutil.Exec(cnt, "git", "config", "--global", "user.email").CombinedOutput()
+			if err != nil || strings.TrimSpace(string(out)) == "" {
+				return xerrors.New("user.email is not set inside the container")
+			}
+			return nil
+		}},
+		{"gpg-agent", func() error {
+			cli := dockerClient()
+			defer cli.Close()
+
+			insp, err := cli.ContainerInspect(context.Background(), cnt)
+			if err != nil {
+				return err
+			}
+			if insp.Config.Labels[forwardGPGLabel] != "true" {
+				flog.Info("gpg-agent forwarding is disabled, enable it with `sail run --gpg`")
+				return nil
+			}
+
+			out, err := dockutil.Exec(cnt, "gpg-connect-agent", "GETINFO version", "/bye").CombinedOutput()
+			if err != nil || !strings.Contains(string(out), "OK") {
+				return xerrors.Errorf("failed to reach the forwarded gpg-agent: %s", out)
+			}
+
+			out, err = dockutil.Exec(cnt, "gpg", "--list-keys").CombinedOutput()
+			if err != nil {
+				return xerrors.Errorf("failed to read the public keyring: %s: %w", out, err)
+			}
+			return nil
+		}},
+	}
+}
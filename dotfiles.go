@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+)
+
+const (
+	// containerDotfilesDir is where the dotfiles repository is mounted
+	// inside of the container.
+	containerDotfilesDir = "~/.dotfiles"
+	// dotfilesMarkerPath records the revision of the dotfiles that were
+	// installed in the container. Container labels can't be changed after
+	// creation, so completion is recorded inside the container.
+	dotfilesMarkerPath = "~/.config/sail/dotfiles-installed"
+	// dotfilesLogPath holds the output of the install command.
+	dotfilesLogPath = "~/.config/sail/dotfiles.log"
+)
+
+// dotfilesInstallScripts are tried in order when the config
+// doesn't provide an install command.
+var dotfilesInstallScripts = []string{
+	"install.sh",
+	"install",
+	"bootstrap.sh",
+	"bootstrap",
+	"setup.sh",
+	"setup",
+}
+
+// dotfilesConfig describes the [dotfiles] table of the config.
+type dotfilesConfig struct {
+	// Repo is the dotfiles repository, in any form accepted by sail run.
+	Repo string `toml:"repo"`
+	// Install is the command run from the root of the repository to install
+	// the dotfiles. When empty, the first of dotfilesInstallScripts that
+	// exists is run.
+	Install string `toml:"install"`
+}
+
+// dotfiles is a dotfiles repository cached on the host.
+type dotfiles struct {
+	repo    repo
+	install string
+	// rev is the commit of the cached clone.
+	rev string
+}
+
+// cacheDir returns the directory on the host the repository is cloned to.
+func (d *dotfiles) cacheDir() string {
+	return filepath.Join(metaRoot(), "dotfiles", d.repo.Host, d.repo.trimPath())
+}
+
+// String returns the repository and revision as stored in the dotfiles label.
+func (d *dotfiles) String() string {
+	return d.repo.trimPath() + "@" + d.rev
+}
+
+// sync clones the repository into the cache, or fast-forwards the cached
+// clone if it already exists, and records its revision.
+// If fetching fails the cached clone is used as is.
+func (d *dotfiles) sync() error {
+	dir := d.cacheDir()
+
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	switch {
+	case os.IsNotExist(err):
+		err = os.MkdirAll(filepath.Dir(dir), 0750)
+		if err != nil {
+			return xerrors.Errorf("failed to create dotfiles cache: %w", err)
+		}
+		err = clone(d.repo, dir)
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return xerrors.Errorf("failed to stat %v: %w", dir, err)
+	default:
+		out, err := exec.Command("git", "-C", dir, "pull", "--ff-only").CombinedOutput()
+		if err != nil {
+			flog.Error("failed to update dotfiles, using cached clone: %s", out)
+		}
+	}
+
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return xerrors.Errorf("failed to get dotfiles revision: %w", err)
+	}
+	d.rev = strings.TrimSpace(string(out))
+	return nil
+}
+
+// installCommand returns the bash command that installs the dotfiles inside
+// of the container. It does nothing if the current revision has already
+// been installed, and only records the revision if the install succeeds.
+func (d *dotfiles) installCommand() string {
+	install := d.install
+	if install == "" {
+		install = fmt.Sprintf(`for s in %v; do
+	if [ -x "$s" ]; then exec "./$s"; fi
+	if [ -f "$s" ]; then exec bash "$s"; fi
+done`, strings.Join(dotfilesInstallScripts, " "))
+	}
+
+	marker := resolvePath(containerHome, dotfilesMarkerPath)
+	logPath := resolvePath(containerHome, dotfilesLogPath)
+	return fmt.Sprintf(`[ "$(cat %[1]v 2>/dev/null)" = %[2]q ] && exit 0
+mkdir -p $(dirname %[1]v)
+(%[3]v) > %[4]v 2>&1 && echo %[2]q > %[1]v`,
+		marker, d.rev, install, logPath,
+	)
+}
+
+// dotfilesMounts mounts the cached dotfiles repository into the container.
+func (r *runner) dotfilesMounts(mounts []mount.Mount) []mount.Mount {
+	if r.dotfiles == nil {
+		return mounts
+	}
+
+	return append(mounts, mount.Mount{
+		Type:   mount.TypeBind,
+		Source: r.dotfiles.cacheDir(),
+		Target: containerDotfilesDir,
+	})
+}
+
+// installDotfiles runs the dotfiles install command in the container.
+// Like the on_start label, it runs detached so it doesn't hold up
+// the container from starting.
+func (r *runner) installDotfiles() error {
+	if r.dotfiles == nil {
+		return nil
+	}
+
+	dir := resolvePath(containerHome, containerDotfilesDir)
+	cmd := dockutil.DetachedExecDir(r.cntName, dir, "/bin/bash", "-c", r.dotfiles.installCommand())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return xerrors.Errorf("%s: %w", out, err)
+	}
+	return nil
+}
@@ -5,17 +5,17 @@ import (
 	"flag"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"time"
+	"syscall"
 
-	"github.com/docker/docker/api/types"
 	"golang.org/x/xerrors"
 
 	"go.coder.com/cli"
 	"go.coder.com/flog"
-	"go.coder.com/sail/internal/dockutil"
 	"go.coder.com/sail/internal/editor"
 	"go.coder.com/sail/internal/randstr"
+	"go.coder.com/sail/internal/sailapi"
 	"go.coder.com/sail/internal/xexec"
 )
 
@@ -25,6 +25,7 @@ type editcmd struct {
 	noEditor bool
 	hatPath  string
 	hat      bool
+	rollback bool
 }
 
 func (c *editcmd) Spec() cli.CommandSpec {
@@ -34,14 +35,18 @@ func (c *editcmd) Spec() cli.CommandSpec {
 		Desc: `This command allows you to edit your project's environment while it's running.
 Depending on what flags are set, the Dockerfile you want to change will be opened in your default
 editor which can be set using the "EDITOR" environment variable. Once your changes are complete
-and the editor is closed, the environment will be rebuilt and rerun with minimal downtime.
+and the editor is closed, the environment will be rebuilt alongside the running one, which is only
+replaced once the new environment is online and ready.
 
 If no flags are set, this will open your project's Dockerfile. If the -hat flag is set, this
 will open the hat Dockerfile associated with your running project in the editor. If the -new-hat
 flag is set, the project will be adjusted to use the new hat.
 
 VS Code users can edit their environment by editing their .sail/Dockerfile within the editor. VS Code
-will rebuild the container when they click on the 'rebuild' button.`,
+will rebuild the container when they click on the 'rebuild' button.
+
+The replaced container is kept for the config's edit_grace_period. If the -rollback flag is set,
+the project is swapped back to it.`,
 	}
 }
 
@@ -50,7 +55,22 @@ func (c *editcmd) Run(fl *flag.FlagSet) {
 
 	c.gf.ensureDockerDaemon()
 
-	err := os.MkdirAll(filepath.Dir(proj.dockerfilePath()), 0755)
+	if c.rollback {
+		err := rollbackEdit(proj)
+		if err != nil {
+			err = xerrors.Errorf("failed to roll back: %w", err)
+			rebuildEvents.fail(err)
+			flog.Fatal("%v", err)
+		}
+		os.Exit(0)
+	}
+
+	err := pruneExpiredPrevious(proj.cntName())
+	if err != nil {
+		flog.Error("failed to remove expired previous container: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(proj.dockerfilePath()), 0755)
 	if err != nil {
 		flog.Fatal("failed to create intermediate dirs: %v", err)
 	}
@@ -74,6 +94,15 @@ func (c *editcmd) Run(fl *flag.FlagSet) {
 
 	err = c.recreate(proj)
 	if err != nil {
+		rebuildEvents.fail(err)
+		flog.Fatal("%v", err)
+	}
+
+	// Run outside of recreate as the new container is in place,
+	// so a failing hook must not roll it back.
+	err = runHook(proj.cntName(), postRebuildHook)
+	if err != nil {
+		rebuildEvents.fail(err)
 		flog.Fatal("%v", err)
 	}
 	os.Exit(0)
@@ -86,6 +115,24 @@ func (c *editcmd) recreate(proj *project) (err error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// The proxy interrupts sail to cancel a rebuild. Interrupts stop the waits
+	// for the edit lock and for the new container, which is then removed, but
+	// they're ignored once the swap starts as the project must never be left
+	// without a container.
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	defer cancelWait()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			flog.Info("canceling rebuild")
+			cancelWait()
+		case <-ctx.Done():
+		}
+	}()
+
 	// Get the existing container's state so re-create is seamless.
 	b, err := hatBuilderFromContainer(proj.cntName())
 	if err != nil {
@@ -119,15 +166,39 @@ func (c *editcmd) recreate(proj *project) (err error) {
 		}
 	}
 
+	// Only lock once the editor is closed, so that the container can still
+	// be rebuilt from the browser while the Dockerfile is being edited.
+	unlock, err := lockEdit(waitCtx, proj.cntName())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	r, err := runnerFromContainer(proj.cntName())
 	if err != nil {
 		return xerrors.Errorf("failed to initialize runner: %w", err)
 	}
+	// Pick up any changes to the project's config.
+	err = r.applyConfig(proj.conf)
+	if err != nil {
+		return xerrors.Errorf("invalid project config: %w", err)
+	}
 
 	builderCntName := proj.cntName() + "-builder-" + randstr.Make(5)
 	r.cntName = builderCntName
-
-	image, ok, err := proj.buildImage()
+	r.rebuilt = true
+	// The original container keeps running while the new one starts,
+	// so let code-server pick a free port.
+	r.port = "0"
+
+	var (
+		image string
+		ok    bool
+	)
+	err = rebuildEvents.phase(sailapi.PhaseBuild, func() error {
+		image, ok, err = proj.buildImage()
+		return err
+	})
 	if err != nil {
 		return xerrors.Errorf("failed to build image: %w", err)
 	}
@@ -137,76 +208,91 @@ func (c *editcmd) recreate(proj *project) (err error) {
 		b.baseImage = image
 	}
 
-	// Apply the hat before we stop the original container in order to reduce the amount
-	// of downtime and to prevent any downtime in the event of a failed hat application.
 	if b.hatPath != "" {
-		image, err = b.applyHat()
+		err = rebuildEvents.phase(sailapi.PhaseHat, func() error {
+			image, err = b.applyHat()
+			return err
+		})
 		if err != nil {
 			return xerrors.Errorf("failed to apply hat: %w", err)
 		}
 	}
 
-	// The base and hat images have been fully built, stop the original container to swap
-	// it with the new one.
-	err = cli.ContainerStop(ctx, proj.cntName(), dockutil.DurationPtr(time.Second))
-	if err != nil {
-		return err
-	}
+	// Start the new container alongside the original one. Traffic is only switched
+	// over once it's online and ready, so a failed rebuild causes no downtime.
 	defer func() {
 		if err != nil {
-			flog.Error("failed to build and run new container: %v", err)
-			flog.Info("rolling back...")
-
-			err := cli.ContainerStart(ctx, proj.cntName(), types.ContainerStartOptions{})
+			flog.Info("removing %v, the original container is still running", builderCntName)
+			err := rebuildEvents.phase(sailapi.PhaseRollback, func() error {
+				return removeIfExists(ctx, cli, builderCntName)
+			})
 			if err != nil {
-				flog.Fatal("failed to restart original container %v in rollback: %v", proj.cntName(), err)
+				flog.Error("failed to remove builder container: %v", err)
 			}
 		}
 	}()
-
-	// Rename OG container with a temporary name that we'll remove at the end if
-	// everything completes successfully.
-	oldCntName := proj.cntName() + "-old-" + randstr.Make(5)
-	err = cli.ContainerRename(ctx, proj.cntName(), oldCntName)
+	err = rebuildEvents.phase(sailapi.PhaseCreate, func() error {
+		return r.runContainer(image)
+	})
 	if err != nil {
-		return xerrors.Errorf("failed to rename original container to %v: %w", oldCntName, err)
+		return err
 	}
-	defer func() {
-		// Roll the container rename back if something failed, but remove the old container from
-		// the system if everything succeeded.
-		if err != nil {
-			err := cli.ContainerRename(ctx, oldCntName, proj.cntName())
-			if err != nil {
-				flog.Fatal("failed to rename container from %v back to %v in rollback: %v", oldCntName, proj.cntName(), err)
-			}
-		} else {
-			_ = dockutil.StopRemove(ctx, cli, oldCntName)
-		}
-	}()
 
-	// Start our new container and try to rename it to the project container name.
-	err = r.runContainer(image)
+	timeout, err := proj.onlineTimeout()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err != nil {
-			err := dockutil.StopRemove(ctx, cli, builderCntName)
+	err = rebuildEvents.phase(sailapi.PhaseWaitOnline, func() error {
+		return untilCanceled(waitCtx, func() error {
+			err := waitOnline(builderCntName, timeout)
 			if err != nil {
-				flog.Error("failed to stop remove builder container in rollback: %v", err)
+				return err
 			}
-		}
-	}()
-
-	err = cli.ContainerRename(ctx, r.cntName, proj.cntName())
+			err = waitReady(builderCntName)
+			if err != nil {
+				return xerrors.Errorf("new container failed to become ready: %w", err)
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		return xerrors.Errorf("failed to rename builder to project name: %w", err)
+		return err
 	}
 
+	err = swapContainers(ctx, cli, proj, builderCntName)
+	if err != nil {
+		return err
+	}
 	flog.Info("replaced container")
+
+	refreshErr := refreshProxy(proj.cntName())
+	if refreshErr != nil {
+		flog.Error("failed to refresh proxy: %v", refreshErr)
+	}
+
+	keepErr := keepPrevious(ctx, cli, proj)
+	if keepErr != nil {
+		flog.Error("failed to keep previous container: %v", keepErr)
+	}
 	return nil
 }
 
+// untilCanceled runs fn, but returns early if ctx is done. fn keeps running
+// in the background, so it must be safe to abandon.
+func untilCanceled(ctx context.Context, fn func() error) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- fn()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		return xerrors.Errorf("rebuild canceled: %w", ctx.Err())
+	}
+}
+
 func runEditor(file string) error {
 	editor, err := editor.Env()
 	if err != nil {
@@ -234,4 +320,5 @@ var _ cli.FlaggedCommand = new(editcmd)
 func (c *editcmd) RegisterFlags(fl *flag.FlagSet) {
 	fl.StringVar(&c.hatPath, "new-hat", "", "Path to new hat.")
 	fl.BoolVar(&c.hat, "hat", false, "Edit the hat associated with this project.")
+	fl.BoolVar(&c.rollback, "rollback", false, "Swap back to the container replaced by the last edit.")
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+)
+
+// editLockPath returns the file locked while the container named cntName
+// is rebuilt or rolled back, so that sail edit in the terminal and rebuilds
+// from the browser don't replace the container at the same time.
+func editLockPath(cntName string) string {
+	return filepath.Join(metaRoot(), cntName, "edit.lock")
+}
+
+// lockEdit waits until no other sail edit is replacing the container named
+// cntName, or ctx is done. The lock is held until unlock is called or sail exits.
+func lockEdit(ctx context.Context, cntName string) (unlock func(), err error) {
+	path := editLockPath(cntName)
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open %v: %w", path, err)
+	}
+
+	waiting := false
+	for {
+		err = syscall.Flock(int(fi.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			fi.Close()
+			return nil, xerrors.Errorf("failed to lock %v: %w", path, err)
+		}
+
+		if !waiting {
+			flog.Info("waiting for another rebuild of %v to finish", toSailName(cntName))
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			fi.Close()
+			return nil, xerrors.Errorf("rebuild canceled: %w", ctx.Err())
+		case <-time.After(time.Millisecond * 250):
+		}
+	}
+
+	return func() {
+		// Closing the file releases the lock.
+		fi.Close()
+	}, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.coder.com/sail/internal/randstr"
+)
+
+func Test_lockEdit(t *testing.T) {
+	t.Parallel()
+
+	cntName := "sail-test-" + randstr.Make(5)
+
+	unlock, err := lockEdit(context.Background(), cntName)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	_, err = lockEdit(ctx, cntName)
+	assert.Error(t, err, "locked twice")
+
+	unlock()
+	unlock, err = lockEdit(context.Background(), cntName)
+	require.NoError(t, err)
+	unlock()
+}
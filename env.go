@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// containerSecretsDir is the tmpfs mounted into the container that holds
+// secrets. Secrets are written as files so they don't show up in the
+// container's config or in `docker inspect`.
+const containerSecretsDir = "/run/secrets"
+
+// envSource describes where the value of an environment variable in
+// the config's [env_from] table comes from.
+type envSource struct {
+	// File is a path on the host to read the value from.
+	File string `toml:"file"`
+	// Command is a shell command run on the host whose output is the value.
+	Command string `toml:"command"`
+	// Secret mounts the value as a file in containerSecretsDir instead
+	// of setting an environment variable.
+	Secret bool `toml:"secret"`
+}
+
+// resolve reads the value of the source.
+// Trailing newlines are trimmed as they're never intended.
+func (s envSource) resolve(ctx context.Context) (string, error) {
+	var (
+		val []byte
+		err error
+	)
+
+	switch {
+	case s.File != "" && s.Command != "":
+		return "", xerrors.New("only one of file or command may be set")
+	case s.File != "":
+		hostHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		val, err = ioutil.ReadFile(resolvePath(hostHomeDir, s.File))
+		if err != nil {
+			return "", xerrors.Errorf("failed to read %v: %w", s.File, err)
+		}
+	case s.Command != "":
+		cmd := exec.CommandContext(ctx, "bash", "-c", s.Command)
+		cmd.Stderr = os.Stderr
+		val, err = cmd.Output()
+		if err != nil {
+			return "", xerrors.Errorf("failed to run %q: %w", s.Command, err)
+		}
+	default:
+		return "", xerrors.New("one of file or command must be set")
+	}
+
+	return strings.TrimRight(string(val), "\r\n"), nil
+}
+
+// secret is an environment variable value that's mounted as a file.
+type secret struct {
+	name  string
+	value string
+}
+
+// containerPath returns the path of the secret inside the container.
+func (s secret) containerPath() string {
+	return path.Join(containerSecretsDir, s.name)
+}
+
+// resolveEnvSources resolves the sources of the [env_from] table into plain
+// environment variables in KEY=VALUE form and secrets.
+func resolveEnvSources(ctx context.Context, sources map[string]envSource) (envs []string, secrets []secret, _ error) {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		src := sources[name]
+		val, err := src.resolve(ctx)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("failed to resolve env_from.%v: %w", name, err)
+		}
+
+		if src.Secret {
+			secrets = append(secrets, secret{name: name, value: val})
+			continue
+		}
+		envs = append(envs, name+"="+val)
+	}
+
+	return envs, secrets, nil
+}
+
+// parseEnvFile parses a .env file into variables of KEY=VALUE form.
+// Blank lines and lines starting with # are ignored, a leading `export `
+// is allowed, and values may be wrapped in single or double quotes.
+func parseEnvFile(rd io.Reader) ([]string, error) {
+	var envs []string
+
+	sc := bufio.NewScanner(rd)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, xerrors.Errorf("line %v: expected KEY=VALUE", lineNum)
+		}
+		key := strings.TrimSpace(line[:eq])
+		val := strings.TrimSpace(line[eq+1:])
+
+		switch {
+		case len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"':
+			var err error
+			val, err = strconv.Unquote(val)
+			if err != nil {
+				return nil, xerrors.Errorf("line %v: invalid quoted value: %w", lineNum, err)
+			}
+		case len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'':
+			val = val[1 : len(val)-1]
+		}
+
+		envs = append(envs, key+"="+val)
+	}
+
+	return envs, sc.Err()
+}
+
+// readEnvFile parses the .env file at path.
+func readEnvFile(path string) ([]string, error) {
+	byt, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	envs, err := parseEnvFile(bytes.NewReader(byt))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse %v: %w", path, err)
+	}
+	return envs, nil
+}
+
+// dedupeEnv removes duplicate variables from envs, keeping
+// the last value set for each while preserving order.
+func dedupeEnv(envs []string) []string {
+	last := make(map[string]int, len(envs))
+	for i, env := range envs {
+		last[envKey(env)] = i
+	}
+
+	deduped := make([]string, 0, len(last))
+	for i, env := range envs {
+		if last[envKey(env)] == i {
+			deduped = append(deduped, env)
+		}
+	}
+	return deduped
+}
+
+func envKey(env string) string {
+	return strings.SplitN(env, "=", 2)[0]
+}
+
+// envFlag is a repeatable flag of environment variables.
+// Variables without a value are passed through from the host.
+type envFlag []string
+
+func (f *envFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *envFlag) Set(v string) error {
+	if v == "" || strings.HasPrefix(v, "=") {
+		return xerrors.Errorf("invalid environment variable %q", v)
+	}
+
+	if !strings.Contains(v, "=") {
+		val, ok := os.LookupEnv(v)
+		if !ok {
+			return xerrors.Errorf("%v is not set on the host", v)
+		}
+		v = fmt.Sprintf("%v=%v", v, val)
+	}
+
+	*f = append(*f, v)
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseEnvFile(t *testing.T) {
+	t.Parallel()
+
+	const envFile = `# A comment.
+API_URL=http://localhost:8080
+
+export TOKEN="abc \"def\""
+SINGLE='$NOT_EXPANDED'
+EMPTY=
+`
+	envs, err := parseEnvFile(strings.NewReader(envFile))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"API_URL=http://localhost:8080",
+		`TOKEN=abc "def"`,
+		"SINGLE=$NOT_EXPANDED",
+		"EMPTY=",
+	}, envs)
+
+	_, err = parseEnvFile(strings.NewReader("NOT_AN_ASSIGNMENT\n"))
+	require.Error(t, err)
+}
+
+func Test_dedupeEnv(t *testing.T) {
+	t.Parallel()
+
+	envs := dedupeEnv([]string{"A=1", "B=2", "A=3", "C=4"})
+	assert.Equal(t, []string{"B=2", "A=3", "C=4"}, envs)
+}
+
+func Test_runEnvFromContainer(t *testing.T) {
+	t.Parallel()
+
+	cntEnv := []string{"PATH=/usr/bin", "FOO=bar", "BAZ=a=b"}
+
+	assert.Equal(t, []string{"FOO=bar", "BAZ=a=b"}, runEnvFromContainer(cntEnv, "FOO,BAZ"))
+	assert.Nil(t, runEnvFromContainer(cntEnv, ""))
+}
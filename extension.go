@@ -21,6 +21,7 @@ import (
 
 	"go.coder.com/cli"
 	"go.coder.com/flog"
+	"go.coder.com/sail/internal/sailapi"
 )
 
 func runNativeMsgHost() {
@@ -87,7 +88,21 @@ func handleRun(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if streamRun(ctx, c, "run", req.Project) {
+	emit := func(e sailapi.Event) error {
+		err := wsjson.Write(ctx, c, e)
+		if err != nil {
+			log.Println(err)
+		}
+		return err
+	}
+	result := sailapi.Event{Type: sailapi.EventResult}
+	// Browsers start the native host without flags, so it uses the default config.
+	err = streamRun(ctx, "", emit, "run", req.Project)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	emit(result)
+	if err == nil {
 		c.Close(websocket.StatusNormalClosure, "")
 	}
 }
@@ -72,16 +72,19 @@ const doConnection = (socketUrl: string, projectUrl: string, onMessage: (data: W
 			if (!data) {
 				return;
 			}
-			const type = data.type;
-			const content = type === "data" ? atob(data.v) : data.v;
-
-			switch (type) {
+			// See Event in internal/sailapi for the message types.
+			switch (data.type) {
 				case "data":
-				case "error":
-					onMessage({ type, v: content });
+					onMessage({ type: "data", v: atob(data.v) });
+					break;
+				case "result":
+					if (data.v && data.v.error) {
+						onMessage({ type: "error", v: data.v.error });
+					}
 					break;
 				default:
-					throw new Error("unknown message type: " + type);
+					// Build progress isn't shown here yet.
+					break;
 			}
 		});
 	});
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// Tunnels relay raw TCP connections between the host and a container over
+// the stdio of docker exec, so they work whatever the container's networking.
+//
+// A local tunnel listens on the host and connects to a port inside of the
+// container for each connection. A reverse tunnel runs `sail forward-listen`
+// inside of the container, which prints an ID for each connection it accepts.
+// The host then connects to the port on the host and runs `sail forward-attach`
+// with the ID inside of the container to relay the connection.
+
+// containerForwardBin is where the sail binary is copied into the container
+// for reverse tunnels if it isn't mounted at containerSailBin.
+const containerForwardBin = "/tmp/sail"
+
+// forwardSpec describes a tunnel. Port is the port connected to, inside of the
+// container for local tunnels and on the host for reverse tunnels. Bind is the
+// port listened on at the other end.
+type forwardSpec struct {
+	Reverse bool   `json:"reverse"`
+	Port    string `json:"port"`
+	Bind    string `json:"bind"`
+}
+
+// parseForwardSpec parses a tunnel of the form <port>[:<bind>].
+func parseForwardSpec(s string, reverse bool) (forwardSpec, error) {
+	parts := strings.SplitN(s, ":", 2)
+	spec := forwardSpec{
+		Reverse: reverse,
+		Port:    parts[0],
+		Bind:    parts[0],
+	}
+	if len(parts) == 2 {
+		spec.Bind = parts[1]
+	}
+	if !validPort(spec.Port) || !validPort(spec.Bind) {
+		return forwardSpec{}, xerrors.Errorf("invalid forward %q, expected <port>[:<bind>]", s)
+	}
+	return spec, nil
+}
+
+func (s forwardSpec) String() string {
+	if s.Reverse {
+		return fmt.Sprintf("host:%v -> container:%v", s.Port, s.Bind)
+	}
+	return fmt.Sprintf("container:%v -> host:%v", s.Port, s.Bind)
+}
+
+// tunnel is a running tunnel to a container.
+type tunnel struct {
+	id      string
+	cntName string
+	spec    forwardSpec
+
+	closeOnce sync.Once
+	// stop stops accepting connections.
+	stop func()
+	done chan struct{}
+}
+
+// startTunnel starts the tunnel spec to the container named cntName.
+func startTunnel(cntName string, spec forwardSpec) (*tunnel, error) {
+	t := &tunnel{
+		cntName: cntName,
+		spec:    spec,
+		done:    make(chan struct{}),
+	}
+
+	var err error
+	if spec.Reverse {
+		err = t.startReverse()
+	} else {
+		err = t.startLocal()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Close stops the tunnel. Connections that are already relayed are kept.
+func (t *tunnel) Close() error {
+	t.closeOnce.Do(func() {
+		t.stop()
+	})
+	return nil
+}
+
+// Done is closed once the tunnel stops.
+func (t *tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *tunnel) startLocal() error {
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", t.spec.Bind))
+	if err != nil {
+		return xerrors.Errorf("failed to listen: %w", err)
+	}
+	t.stop = func() {
+		l.Close()
+	}
+
+	go func() {
+		defer close(t.done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				cnt, err := execDial(t.cntName, t.spec.Port)
+				if err != nil {
+					flog.Error("%v", err)
+					return
+				}
+				defer cnt.Close()
+				relay(conn, cnt)
+			}()
+		}
+	}()
+	return nil
+}
+
+func (t *tunnel) startReverse() error {
+	bin, err := ensureContainerSail(t.cntName)
+	if err != nil {
+		return err
+	}
+
+	cmd := dockutil.Exec(t.cntName, bin, "forward-listen", t.spec.Bind)
+	// The listener exits once its stdin is closed.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return xerrors.Errorf("failed to start listener in container: %w", err)
+	}
+
+	rd := bufio.NewReader(stdout)
+	// The listener prints a line once it's listening.
+	_, err = rd.ReadString('\n')
+	if err != nil {
+		cmd.Wait()
+		return xerrors.Errorf("failed to listen on %v inside of the container", t.spec.Bind)
+	}
+
+	t.stop = func() {
+		stdin.Close()
+		cmd.Process.Kill()
+	}
+
+	go func() {
+		defer close(t.done)
+		defer cmd.Wait()
+		for {
+			id, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			go t.attach(bin, strings.TrimSpace(id))
+		}
+	}()
+	return nil
+}
+
+// attach relays the connection with id accepted inside of the container
+// to the port on the host.
+func (t *tunnel) attach(bin, id string) {
+	cmd := dockutil.Exec(t.cntName, bin, "forward-attach", t.spec.Bind, id)
+	cnt, err := startExecConn(cmd)
+	if err != nil {
+		flog.Error("%v", err)
+		return
+	}
+	defer cnt.Close()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", t.spec.Port))
+	if err != nil {
+		flog.Error("failed to connect to port %v: %v", t.spec.Port, err)
+		return
+	}
+	defer conn.Close()
+	relay(conn, cnt)
+}
+
+// relay copies between a and b until either is closed.
+func relay(a, b io.ReadWriter) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// execDial connects to port inside of the container named cntName
+// through the stdio of docker exec.
+func execDial(cntName, port string) (net.Conn, error) {
+	// Relay the connection through bash inside of the container.
+	cmd := dockutil.FmtExec(cntName, "exec 3<>/dev/tcp/localhost/%v && { cat <&3 & cat >&3; }", port)
+	conn, err := startExecConn(cmd)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to connect to port %v: %w", port, err)
+	}
+	return conn, nil
+}
+
+// startExecConn starts cmd and returns a connection to its stdio.
+func startExecConn(cmd *exec.Cmd) (net.Conn, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &execConn{
+		cmd:    cmd,
+		Reader: stdout,
+		stdin:  stdin,
+	}, nil
+}
+
+// ensureContainerSail returns the path of the sail binary inside of the
+// container named cntName, copying it there if it isn't mounted. It's copied
+// every time so that it's never older than the host's.
+func ensureContainerSail(cntName string) (string, error) {
+	err := dockutil.Exec(cntName, "test", "-x", containerSailBin).Run()
+	if err == nil {
+		return containerSailBin, nil
+	}
+
+	// The binary on the host only runs in the container if
+	// the host runs the same platform.
+	if runtime.GOOS != "linux" {
+		return "", xerrors.Errorf("reverse tunnels are only supported on linux hosts")
+	}
+	sailBin, err := os.Executable()
+	if err != nil {
+		return "", xerrors.Errorf("failed to find sail binary: %w", err)
+	}
+	out, err := exec.Command("docker", "cp", sailBin, cntName+":"+containerForwardBin).CombinedOutput()
+	if err != nil {
+		return "", xerrors.Errorf("failed to copy sail into the container: %s: %w", out, err)
+	}
+	return containerForwardBin, nil
+}
+
+// forwardSockPath returns the socket, inside of the container, that
+// forward-attach connects to for connections accepted on port.
+func forwardSockPath(port string) string {
+	return filepath.Join(os.TempDir(), "sail-forward-"+port+".sock")
+}
+
+// forwardListen listens on port inside of the container and prints an ID
+// for each connection it accepts, which is relayed once forward-attach is
+// run with the ID. It returns once stdin is closed.
+func forwardListen(port string) error {
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	sockPath := forwardSockPath(port)
+	_ = os.Remove(sockPath)
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sockPath)
+	defer sock.Close()
+
+	var (
+		mu      sync.Mutex
+		out     = bufio.NewWriter(os.Stdout)
+		pending = make(map[string]net.Conn)
+		nextID  int
+	)
+	writeLine := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		out.WriteString(s + "\n")
+		out.Flush()
+	}
+	writeLine("listening")
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			nextID++
+			id := strconv.Itoa(nextID)
+			pending[id] = conn
+			mu.Unlock()
+			writeLine(id)
+		}
+	}()
+
+	go func() {
+		for {
+			attach, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer attach.Close()
+
+				id, err := bufio.NewReader(io.LimitReader(attach, 32)).ReadString('\n')
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				conn, ok := pending[strings.TrimSpace(id)]
+				delete(pending, strings.TrimSpace(id))
+				mu.Unlock()
+				if !ok {
+					return
+				}
+				defer conn.Close()
+				relay(conn, attach)
+			}()
+		}
+	}()
+
+	// The host closes stdin when the tunnel is closed.
+	io.Copy(ioutil.Discard, os.Stdin)
+	return nil
+}
+
+// forwardAttach relays stdio to the connection with id accepted by forward-listen.
+func forwardAttach(port, id string) error {
+	conn, err := net.Dial("unix", forwardSockPath(port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, id+"\n")
+	if err != nil {
+		return err
+	}
+	relay(conn, struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout})
+	return nil
+}
+
+// tunnels are the tunnels run in the background by a project's proxy.
+type tunnels struct {
+	cntName string
+
+	mu     sync.Mutex
+	nextID int
+	m      map[string]*tunnel
+}
+
+func newTunnels(cntName string) *tunnels {
+	return &tunnels{
+		cntName: cntName,
+		m:       make(map[string]*tunnel),
+	}
+}
+
+func (ts *tunnels) start(spec forwardSpec) (*tunnel, error) {
+	t, err := startTunnel(ts.cntName, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	ts.nextID++
+	t.id = strconv.Itoa(ts.nextID)
+	ts.m[t.id] = t
+	ts.mu.Unlock()
+
+	go func() {
+		<-t.Done()
+		ts.mu.Lock()
+		delete(ts.m, t.id)
+		ts.mu.Unlock()
+	}()
+
+	flog.Info("forwarding %v for %v", spec, ts.cntName)
+	return t, nil
+}
+
+func (ts *tunnels) close(id string) bool {
+	ts.mu.Lock()
+	t, ok := ts.m[id]
+	ts.mu.Unlock()
+	if ok {
+		t.Close()
+	}
+	return ok
+}
+
+func (ts *tunnels) closeAll() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.m {
+		t.Close()
+	}
+}
+
+// tunnelInfo is how tunnels are described by the proxy API.
+type tunnelInfo struct {
+	ID string `json:"id"`
+	forwardSpec
+}
+
+func (ts *tunnels) list() []tunnelInfo {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	infos := make([]tunnelInfo, 0, len(ts.m))
+	for _, t := range ts.m {
+		infos = append(infos, tunnelInfo{ID: t.id, forwardSpec: t.spec})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		a, _ := strconv.Atoi(infos[i].ID)
+		b, _ := strconv.Atoi(infos[j].ID)
+		return a < b
+	})
+	return infos
+}
+
+// forwards lists the tunnels run by the proxy, or starts one.
+func (p *proxy) forwards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, p.tunnels.list())
+	case http.MethodPost:
+		if !allowOrigin(w, r) {
+			return
+		}
+		var spec forwardSpec
+		err := json.NewDecoder(r.Body).Decode(&spec)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !validPort(spec.Port) || !validPort(spec.Bind) {
+			writeAPIError(w, http.StatusBadRequest, xerrors.New("invalid port"))
+			return
+		}
+		t, err := p.tunnels.start(spec)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tunnelInfo{ID: t.id, forwardSpec: t.spec})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, xerrors.Errorf("method %v not allowed", r.Method))
+	}
+}
+
+// closeForward closes the tunnel with the ID at the end of the path.
+func (p *proxy) closeForward(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) || !allowOrigin(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, sailapi.Prefix+sailapi.PathForwards+"/")
+	if !p.tunnels.close(id) {
+		writeAPIError(w, http.StatusNotFound, xerrors.Errorf("no such forward %v", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
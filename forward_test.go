@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseForwardSpec(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in      string
+		reverse bool
+		spec    forwardSpec
+		str     string
+		wantErr bool
+	}{
+		{"5432", false, forwardSpec{Port: "5432", Bind: "5432"}, "container:5432 -> host:5432", false},
+		{"5432:15432", false, forwardSpec{Port: "5432", Bind: "15432"}, "container:5432 -> host:15432", false},
+		{"5432:15432", true, forwardSpec{Reverse: true, Port: "5432", Bind: "15432"}, "host:5432 -> container:15432", false},
+		{"5432:", false, forwardSpec{}, "", true},
+		{"postgres", false, forwardSpec{}, "", true},
+		{"5432:15432:1", false, forwardSpec{}, "", true},
+		{"0", false, forwardSpec{}, "", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.in, func(t *testing.T) {
+			t.Parallel()
+
+			spec, err := parseForwardSpec(tc.in, tc.reverse)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.spec, spec)
+			assert.Equal(t, tc.str, spec.String())
+		})
+	}
+}
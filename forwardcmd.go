@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/sailapi"
+)
+
+type forwardcmd struct {
+	gf *globalFlags
+
+	reverse    bool
+	background bool
+}
+
+func (c *forwardcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "forward",
+		Usage: "[flags] <repo> <port>[:<bind>]",
+		Desc: `Tunnels TCP connections between the host and a project's container.
+By default, localhost:<bind> on the host is forwarded to <port> inside of the
+container. With -R, <bind> inside of the container is forwarded to <port> on the
+host. <bind> defaults to <port>. Connections are relayed through docker exec,
+so they work whatever the container's networking.`,
+	}
+}
+
+func (c *forwardcmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.BoolVar(&c.reverse, "R", false, "Forward a port on the host into the container.")
+	fl.BoolVar(&c.background, "d", false, "Run the tunnel in the background, in the project's proxy.")
+}
+
+func (c *forwardcmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&forwardLsCmd{gf: c.gf},
+		&forwardCloseCmd{gf: c.gf},
+	}
+}
+
+func (c *forwardcmd) Run(fl *flag.FlagSet) {
+	if fl.NArg() != 2 {
+		fl.Usage()
+		os.Exit(1)
+	}
+	c.gf.ensureDockerDaemon()
+
+	proj := c.gf.projectFromArg(schemaPrefs{}, fl.Arg(0))
+	proj.requireRunning()
+
+	spec, err := parseForwardSpec(fl.Arg(1), c.reverse)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+
+	if c.background {
+		err = ensureProxy(c.gf.configPath, proj.cntName())
+		if err != nil {
+			flog.Fatal("failed to start proxy: %v", err)
+		}
+
+		var info tunnelInfo
+		err = proxyRequest(proj.cntName(), http.MethodPost, sailapi.PathForwards, spec, &info)
+		if err != nil {
+			flog.Fatal("failed to forward: %v", err)
+		}
+		flog.Success("forwarding %v as %v, close it with sail forward close %v %v", spec, info.ID, fl.Arg(0), info.ID)
+		return
+	}
+
+	t, err := startTunnel(proj.cntName(), spec)
+	if err != nil {
+		flog.Fatal("failed to forward: %v", err)
+	}
+	flog.Info("forwarding %v, press Ctrl-C to stop", spec)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	select {
+	case <-sigs:
+		t.Close()
+	case <-t.Done():
+		flog.Fatal("tunnel closed, is the container still running?")
+	}
+}
+
+type forwardLsCmd struct {
+	gf *globalFlags
+}
+
+func (c *forwardLsCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "ls",
+		Usage: "<repo>",
+		Desc:  "Lists the tunnels of a project that run in the background.",
+	}
+}
+
+func (c *forwardLsCmd) Run(fl *flag.FlagSet) {
+	proj := c.gf.project(schemaPrefs{}, fl)
+	c.gf.ensureDockerDaemon()
+
+	var infos []tunnelInfo
+	err := proxyRequest(proj.cntName(), http.MethodGet, sailapi.PathForwards, nil, &infos)
+	if err != nil {
+		flog.Fatal("failed to list forwards: %v", err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(tw, "id\tforward\n")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%v\t%v\n", info.ID, info.forwardSpec)
+	}
+	tw.Flush()
+}
+
+type forwardCloseCmd struct {
+	gf *globalFlags
+}
+
+func (c *forwardCloseCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "close",
+		Usage: "<repo> <id>",
+		Desc:  "Closes a tunnel that runs in the background.",
+	}
+}
+
+func (c *forwardCloseCmd) Run(fl *flag.FlagSet) {
+	if fl.NArg() != 2 {
+		fl.Usage()
+		os.Exit(1)
+	}
+	c.gf.ensureDockerDaemon()
+
+	proj := c.gf.projectFromArg(schemaPrefs{}, fl.Arg(0))
+	err := proxyRequest(proj.cntName(), http.MethodDelete, sailapi.PathForwards+"/"+fl.Arg(1), nil, nil)
+	if err != nil {
+		flog.Fatal("failed to close forward: %v", err)
+	}
+}
+
+type forwardListenCmd struct{}
+
+func (c *forwardListenCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:   "forward-listen",
+		Usage:  "<port>",
+		Desc:   "Accepts connections for sail forward -R. It's run inside of sail containers.",
+		Hidden: true,
+	}
+}
+
+func (c *forwardListenCmd) Run(fl *flag.FlagSet) {
+	err := forwardListen(fl.Arg(0))
+	if err != nil {
+		flog.Fatal("failed to listen: %v", err)
+	}
+}
+
+type forwardAttachCmd struct{}
+
+func (c *forwardAttachCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:   "forward-attach",
+		Usage:  "<port> <id>",
+		Desc:   "Relays a connection for sail forward -R. It's run inside of sail containers.",
+		Hidden: true,
+	}
+}
+
+func (c *forwardAttachCmd) Run(fl *flag.FlagSet) {
+	err := forwardAttach(fl.Arg(0), fl.Arg(1))
+	if err != nil {
+		flog.Fatal("failed to attach: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+)
+
+// gitIdentityKeys are the git config keys copied from the host into the
+// container so commits are attributed and signed like they are on the host.
+var gitIdentityKeys = []string{
+	"user.name",
+	"user.email",
+	"user.signingkey",
+	"commit.gpgsign",
+	"tag.gpgsign",
+	"gpg.format",
+}
+
+const (
+	// containerSailDir is where sail's host sockets are mounted inside
+	// of the container.
+	containerSailDir = "/run/sail"
+	// containerSailBin is where the sail binary is mounted inside
+	// of the container so it can act as a client to the host.
+	containerSailBin = "/usr/local/bin/sail"
+
+	gitCredentialSockName = "git-credential.sock"
+)
+
+// hostSocketDir returns the directory on the host holding the sockets
+// that are mounted into the container at containerSailDir.
+func hostSocketDir(cntName string) string {
+	return filepath.Join(metaRoot(), cntName, "sock")
+}
+
+// hostGitConfig returns the values of keys in the host's global git config.
+// Keys that aren't set are omitted.
+func hostGitConfig(keys []string) [][2]string {
+	var kvs [][2]string
+	for _, key := range keys {
+		out, err := exec.Command("git", "config", "--global", "--get", key).Output()
+		if err != nil {
+			continue
+		}
+		kvs = append(kvs, [2]string{key, strings.TrimSpace(string(out))})
+	}
+	return kvs
+}
+
+// canForwardGitCredentials reports whether the sail binary can be mounted into
+// the container to act as its credential helper, which requires the host to be
+// running the same platform as the container.
+func canForwardGitCredentials() bool {
+	return runtime.GOOS == "linux"
+}
+
+// gitMounts mounts the sail binary and the host socket directory into the
+// container so that git inside of it can ask the host for credentials.
+func (r *runner) gitMounts(mounts []mount.Mount) ([]mount.Mount, error) {
+	if !r.forwardGitCredentials || !canForwardGitCredentials() {
+		return mounts, nil
+	}
+
+	sailBin, err := os.Executable()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to find sail binary: %w", err)
+	}
+
+	return append(mounts,
+		mount.Mount{
+			Type:   mount.TypeBind,
+			Source: sailBin,
+			Target: containerSailBin,
+		},
+		mount.Mount{
+			Type:   mount.TypeBind,
+			Source: hostSocketDir(r.projectCnt()),
+			Target: containerSailDir,
+		},
+	), nil
+}
+
+// configureGit copies the host's git identity into the container and
+// configures sail as the container's git credential helper.
+func (r *runner) configureGit() error {
+	var kvs [][2]string
+	if r.forwardGitIdentity {
+		kvs = hostGitConfig(gitIdentityKeys)
+	}
+	if r.forwardGitCredentials && canForwardGitCredentials() {
+		kvs = append(kvs, [2]string{"credential.helper", "!" + containerSailBin + " git-credential"})
+	}
+
+	for _, kv := range kvs {
+		out, err := dockutil.Exec(r.cntName, "git", "config", "--global", kv[0], kv[1]).CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to set %v: %s: %w", kv[0], out, err)
+		}
+	}
+	return nil
+}
+
+// gitCredentialOps maps the operations git sends to credential helpers to
+// the equivalent `git credential` subcommands.
+var gitCredentialOps = map[string]string{
+	"get":   "fill",
+	"store": "approve",
+	"erase": "reject",
+}
+
+// serveGitCredentials answers credential requests from the container's
+// git credential helper using the host's git credential helpers.
+//
+// The protocol is the operation on the first line, followed by git's
+// credential description. For get requests, the host's answer is written back.
+func serveGitCredentials(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// The listener is closed along with the proxy.
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			err := handleGitCredential(conn)
+			if err != nil {
+				flog.Error("git credential request failed: %v", err)
+			}
+		}()
+	}
+}
+
+func handleGitCredential(conn net.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	rd := bufio.NewReader(conn)
+	op, err := rd.ReadString('\n')
+	if err != nil {
+		return xerrors.Errorf("failed to read operation: %w", err)
+	}
+	gitOp, ok := gitCredentialOps[strings.TrimSpace(op)]
+	if !ok {
+		return xerrors.Errorf("unknown operation %q", op)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "credential", gitOp)
+	cmd.Stdin = rd
+	cmd.Stdout = &out
+	// There's nobody to answer a prompt, fail instead.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	err = cmd.Run()
+	if err != nil {
+		return xerrors.Errorf("git credential %v failed: %w", gitOp, err)
+	}
+
+	if gitOp == "fill" {
+		_, err = io.Copy(conn, &out)
+		if err != nil {
+			return xerrors.Errorf("failed to write credentials: %w", err)
+		}
+	}
+	return nil
+}
+
+// listenGitCredentials starts serving git credentials for the container
+// on the socket that is mounted into it. Closing the returned listener stops it.
+func listenGitCredentials(cntName string) (net.Listener, error) {
+	dir := hostSocketDir(cntName)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create %v: %w", dir, err)
+	}
+
+	sockPath := filepath.Join(dir, gitCredentialSockName)
+	// Remove the socket of a previous proxy.
+	_ = os.Remove(sockPath)
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to listen on %v: %w", sockPath, err)
+	}
+	// The user inside the container may have a different uid.
+	err = os.Chmod(sockPath, 0777)
+	if err != nil {
+		l.Close()
+		return nil, xerrors.Errorf("failed to chmod %v: %w", sockPath, err)
+	}
+
+	go serveGitCredentials(l)
+	return l, nil
+}
+
+type gitCredentialCmd struct{}
+
+func (c *gitCredentialCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "git-credential",
+		Usage: "<get|store|erase>",
+		Desc: `A git credential helper that forwards requests to the host.
+It's run by git inside of sail containers.`,
+		Hidden: true,
+	}
+}
+
+func (c *gitCredentialCmd) Run(fl *flag.FlagSet) {
+	op := fl.Arg(0)
+	if _, ok := gitCredentialOps[op]; !ok {
+		// Git expects helpers to ignore operations they don't support.
+		return
+	}
+
+	conn, err := net.Dial("unix", filepath.Join(containerSailDir, gitCredentialSockName))
+	if err != nil {
+		flog.Fatal("failed to connect to sail on the host: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, op+"\n")
+	if err != nil {
+		flog.Fatal("failed to write request: %v", err)
+	}
+	_, err = io.Copy(conn, os.Stdin)
+	if err != nil {
+		flog.Fatal("failed to write request: %v", err)
+	}
+	err = conn.(*net.UnixConn).CloseWrite()
+	if err != nil {
+		flog.Fatal("failed to close request: %v", err)
+	}
+
+	_, err = io.Copy(os.Stdout, conn)
+	if err != nil {
+		flog.Fatal("failed to read response: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_proxyGitCredentials(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy("http://localhost:7080", "cdr_git-credentials", &proxyAuth{})
+	require.NoError(t, p.forwardGitCredentials())
+
+	sockPath := filepath.Join(hostSocketDir(p.cntName), gitCredentialSockName)
+	conn, err := net.Dial("unix", sockPath)
+	require.NoError(t, err)
+	conn.Close()
+
+	p.close()
+	_, err = net.Dial("unix", sockPath)
+	assert.Error(t, err, "listener still open after close")
+	_, err = os.Stat(sockPath)
+	assert.True(t, os.IsNotExist(err), "socket left behind")
+}
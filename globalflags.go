@@ -20,6 +20,9 @@ import (
 type globalFlags struct {
 	verbose    bool
 	configPath string
+
+	// conf caches the global config once it's read.
+	conf *config
 }
 
 func (gf *globalFlags) debug(msg string, args ...interface{}) {
@@ -34,7 +37,11 @@ func (gf *globalFlags) debug(msg string, args ...interface{}) {
 }
 
 func (gf *globalFlags) config() config {
-	return mustReadConfig(gf.configPath)
+	if gf.conf == nil {
+		conf := mustReadConfig(gf.configPath)
+		gf.conf = &conf
+	}
+	return *gf.conf
 }
 
 // ensureDockerDaemon verifies that Docker is running.
@@ -56,11 +63,10 @@ func (gf *globalFlags) ensureDockerDaemon() {
 	gf.debug("verified Docker is running")
 }
 
-func requireRepo(conf config, prefs schemaPrefs, fl *flag.FlagSet) repo {
+func requireRepo(conf config, prefs schemaPrefs, repoURI string) repo {
 	var (
-		repoURI = strings.Join(fl.Args(), "/")
-		r       repo
-		err     error
+		r   repo
+		err error
 	)
 
 	if repoURI == "" {
@@ -151,10 +157,35 @@ func defaultSchema(conf config, prefs schemaPrefs) string {
 }
 
 // project reads the project as the first parameter.
+// The project's config has any per-project overrides applied.
 func (gf *globalFlags) project(prefs schemaPrefs, fl *flag.FlagSet) *project {
+	return gf.projectFromArg(prefs, strings.Join(fl.Args(), "/"))
+}
+
+// projectFromArg reads the project from repoURI. It's used by commands
+// that take more arguments than the project.
+func (gf *globalFlags) projectFromArg(prefs schemaPrefs, repoURI string) *project {
 	conf := gf.config()
-	return &project{
+	proj := &project{
 		conf: conf,
-		repo: requireRepo(conf, prefs, fl),
+		repo: requireRepo(conf, prefs, repoURI),
+	}
+	gf.resolveProjectConfig(proj)
+	return proj
+}
+
+// resolveProjectConfig merges the project's config files over the global config.
+// It should be called again once the project is cloned so that the
+// repository's .sail/sail.toml is taken into account.
+func (gf *globalFlags) resolveProjectConfig(proj *project) {
+	// Ensures the global config exists.
+	gf.config()
+
+	paths := projectConfigPaths(proj)
+	conf, sources, err := readConfigLayers(gf.configPath, paths[0], paths[1:]...)
+	if err != nil {
+		flog.Fatal("%v", err)
 	}
+	proj.conf = conf
+	proj.confSources = sources
 }
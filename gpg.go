@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"golang.org/x/xerrors"
+)
+
+// containerGnuPGHome is the gpg home directory inside of the container.
+const containerGnuPGHome = "~/.gnupg"
+
+// gpgPublicKeyringFiles are mounted read-only from the host's gpg home so
+// that gpg inside the container knows about the user's keys.
+// The private keys stay with the host's agent.
+var gpgPublicKeyringFiles = []string{
+	"pubring.kbx",
+	"pubring.gpg",
+	"trustdb.gpg",
+}
+
+// gpgconfDir returns the host directory gpgconf reports for name,
+// e.g "agent-extra-socket".
+func gpgconfDir(name string) (string, error) {
+	out, err := exec.Command("gpgconf", "--list-dirs", name).Output()
+	if err != nil {
+		return "", xerrors.Errorf("failed to run gpgconf --list-dirs %v: %w", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gpgMounts forwards the host's gpg-agent extra socket into the container
+// where gpg expects the agent's socket, and mounts the public keyring read-only.
+// The extra socket is the agent's restricted socket intended for remote use.
+func (r *runner) gpgMounts(mounts []mount.Mount) ([]mount.Mount, error) {
+	if !r.forwardGPG {
+		return mounts, nil
+	}
+
+	extraSocket, err := gpgconfDir("agent-extra-socket")
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(extraSocket)
+	if err != nil {
+		return nil, xerrors.Errorf("gpg-agent extra socket isn't available, is gpg-agent running?: %w", err)
+	}
+
+	mounts = append(mounts, mount.Mount{
+		Type:   mount.TypeBind,
+		Source: extraSocket,
+		Target: filepath.Join(containerGnuPGHome, "S.gpg-agent"),
+	})
+
+	homeDir, err := gpgconfDir("homedir")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range gpgPublicKeyringFiles {
+		src := filepath.Join(homeDir, name)
+		_, err = os.Stat(src)
+		if err != nil {
+			continue
+		}
+
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   src,
+			Target:   filepath.Join(containerGnuPGHome, name),
+			ReadOnly: true,
+		})
+	}
+
+	return mounts, nil
+}
@@ -14,6 +14,7 @@ import (
 
 	"go.coder.com/flog"
 	"go.coder.com/sail/internal/hat"
+	"go.coder.com/sail/internal/sailapi"
 	"go.coder.com/sail/internal/xexec"
 )
 
@@ -105,7 +106,9 @@ func (b *hatBuilder) applyHat() (string, error) {
 		imageName, fi.Name(), hatPath, baseImageLabel, b.baseImage, hatLabel, b.hatPath,
 	)
 	xexec.Attach(cmd)
+	doneSteps := rebuildEvents.attachBuild(cmd, sailapi.PhaseHat)
 	err = cmd.Run()
+	doneSteps()
 	if err != nil {
 		return "", xerrors.Errorf("failed to build hatted baseImage: %w", err)
 	}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+)
+
+// Lifecycle hooks are commands declared with image labels that are run inside
+// of the container's project directory, e.g
+//
+//	LABEL on_create="npm install"
+//	LABEL on_create.mode="blocking"
+//	LABEL on_create.timeout="5m"
+//
+// Docker copies image labels onto the container, so hooks are read from
+// the container's labels.
+const (
+	// onCreateHook runs when the container is created by sail run,
+	// but not when it's recreated by sail edit.
+	onCreateHook = "on_create"
+	// onStartHook runs every time the container is started.
+	onStartHook = onStartLabel
+	// onStopHook runs before the container is stopped or removed.
+	onStopHook = "on_stop"
+	// postRebuildHook runs after sail edit has swapped in the rebuilt container.
+	postRebuildHook = "post_rebuild"
+)
+
+// hookNames are all of the hooks in the order they run in.
+var hookNames = []string{onCreateHook, onStartHook, postRebuildHook, onStopHook}
+
+type hookMode string
+
+const (
+	// hookBlocking hooks are waited on and have their output shown.
+	// A failure is reported as the command's error.
+	hookBlocking hookMode = "blocking"
+	// hookBackground hooks are run detached. Their output and exit
+	// status can be read with sail logs.
+	hookBackground hookMode = "background"
+)
+
+// containerHooksDir holds the output and exit status of each hook
+// inside of the container.
+const containerHooksDir = "~/.config/sail/hooks"
+
+// hookTimeoutExitCode is the exit code of timeout(1) when the command times out.
+const hookTimeoutExitCode = 124
+
+// hook is a lifecycle hook read from the container's labels.
+type hook struct {
+	name string
+	cmd  string
+	mode hookMode
+	// timeout is how long the hook may run for. Zero means no limit.
+	timeout time.Duration
+}
+
+// defaultHooks holds the mode and timeout of hooks that don't set them.
+// on_start runs in the background by default as it always has.
+var defaultHooks = map[string]hook{
+	onCreateHook:    {mode: hookBlocking, timeout: time.Minute * 10},
+	onStartHook:     {mode: hookBackground},
+	onStopHook:      {mode: hookBlocking, timeout: time.Second * 30},
+	postRebuildHook: {mode: hookBlocking, timeout: time.Minute * 10},
+}
+
+// hookFromLabels reads the hook name from labels.
+// ok is false if the hook isn't set.
+func hookFromLabels(name string, labels map[string]string) (_ hook, ok bool, _ error) {
+	cmd, ok := labels[name]
+	if !ok || strings.TrimSpace(cmd) == "" {
+		return hook{}, false, nil
+	}
+
+	h := defaultHooks[name]
+	h.name = name
+	h.cmd = cmd
+
+	if mode, ok := labels[name+".mode"]; ok {
+		h.mode = hookMode(mode)
+		if h.mode != hookBlocking && h.mode != hookBackground {
+			return hook{}, false, xerrors.Errorf("%v.mode must be %v or %v, not %q", name, hookBlocking, hookBackground, mode)
+		}
+	}
+
+	if timeout, ok := labels[name+".timeout"]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return hook{}, false, xerrors.Errorf("invalid %v.timeout: %w", name, err)
+		}
+		if d < 0 {
+			return hook{}, false, xerrors.Errorf("%v.timeout must not be negative", name)
+		}
+		h.timeout = d
+	}
+
+	return h, true, nil
+}
+
+// hookLogPath returns the path of the hook's output inside of the container.
+func hookLogPath(name string) string {
+	return path.Join(resolvePath(containerHome, containerHooksDir), name+".log")
+}
+
+// hookExitPath returns the path of the file holding the hook's exit status
+// inside of the container. It's removed while the hook is running.
+func hookExitPath(name string) string {
+	return path.Join(resolvePath(containerHome, containerHooksDir), name+".exit")
+}
+
+// script returns the bash script that runs the hook, recording its output
+// and exit status. Blocking hooks also write their output to stdout.
+func (h hook) script() string {
+	output := "> " + hookLogPath(h.name) + " 2>&1"
+	if h.mode == hookBlocking {
+		output = "2>&1 | tee " + hookLogPath(h.name)
+	}
+
+	return fmt.Sprintf(`mkdir -p %[1]v
+rm -f %[2]v
+timeout -k 5s %[3]vs bash -c %[4]v %[5]v
+status=${PIPESTATUS[0]}
+echo $status > %[2]v
+exit $status`,
+		resolvePath(containerHome, containerHooksDir),
+		hookExitPath(h.name),
+		strconv.FormatFloat(h.timeout.Seconds(), 'f', -1, 64),
+		shellQuote(h.cmd),
+		output,
+	)
+}
+
+// shellQuote quotes s so that it's passed to bash as a single word.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// runHook runs the hook name of the container if its image sets it.
+func runHook(cntName, name string) error {
+	cli := dockerClient()
+	defer cli.Close()
+
+	cnt, err := cli.ContainerInspect(context.Background(), cntName)
+	if err != nil {
+		return xerrors.Errorf("failed to inspect %v: %w", cntName, err)
+	}
+
+	h, ok, err := hookFromLabels(name, cnt.Config.Labels)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	projectDir := resolvePath(containerHome, cnt.Config.Labels[projectDirLabel])
+
+	if h.mode == hookBackground {
+		cmd := dockutil.DetachedExecDir(cntName, projectDir, "/bin/bash", "-c", h.script())
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to start %v: %s: %w", name, out, err)
+		}
+		return nil
+	}
+
+	flog.Info("running %v", name)
+	cmd := dockutil.ExecDir(cntName, projectDir, "/bin/bash", "-c", h.script())
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if exitErr.ExitCode() == hookTimeoutExitCode {
+			return xerrors.Errorf("%v timed out after %v", name, h.timeout)
+		}
+		return xerrors.Errorf("%v exited with status %v, see sail logs", name, exitErr.ExitCode())
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to run %v: %w", name, err)
+	}
+	return nil
+}
+
+// runOnStop runs the container's on_stop hook if the container is running.
+// Failures are logged rather than returned so they never prevent
+// the container from being stopped.
+func runOnStop(cntName string) {
+	cli := dockerClient()
+	defer cli.Close()
+
+	cnt, err := cli.ContainerInspect(context.Background(), cntName)
+	if err != nil || !cnt.State.Running {
+		return
+	}
+
+	err = runHook(cntName, onStopHook)
+	if err != nil {
+		flog.Error("%v", err)
+	}
+}
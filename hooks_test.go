@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_hookFromLabels(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name   string
+		hook   string
+		labels map[string]string
+
+		exp    hook
+		expOK  bool
+		expErr bool
+	}{
+		{
+			"Unset",
+			onCreateHook,
+			map[string]string{onStartHook: "make"},
+			hook{}, false, false,
+		},
+		{
+			"Defaults",
+			onStartHook,
+			map[string]string{onStartHook: "make"},
+			hook{name: onStartHook, cmd: "make", mode: hookBackground}, true, false,
+		},
+		{
+			"Overrides",
+			onCreateHook,
+			map[string]string{
+				onCreateHook:              "npm install",
+				onCreateHook + ".mode":    "background",
+				onCreateHook + ".timeout": "90s",
+			},
+			hook{name: onCreateHook, cmd: "npm install", mode: hookBackground, timeout: time.Second * 90}, true, false,
+		},
+		{
+			"InvalidMode",
+			onStopHook,
+			map[string]string{onStopHook: "make clean", onStopHook + ".mode": "async"},
+			hook{}, false, true,
+		},
+		{
+			"InvalidTimeout",
+			onStopHook,
+			map[string]string{onStopHook: "make clean", onStopHook + ".timeout": "soon"},
+			hook{}, false, true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			h, ok, err := hookFromLabels(test.hook, test.labels)
+			if test.expErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expOK, ok)
+			assert.Equal(t, test.exp, h)
+		})
+	}
+}
+
+func Test_shellQuote(t *testing.T) {
+	t.Parallel()
+
+	const s = `echo "$HOME" 'quoted' \n`
+	out, err := exec.Command("bash", "-c", "printf %s "+shellQuote(s)).Output()
+	require.NoError(t, err)
+	assert.Equal(t, s, string(out))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+)
+
+// idleTimeoutLabel holds the idle_timeout of the project's config so that
+// the proxy knows when to stop the container.
+const idleTimeoutLabel = sailLabel + ".idle_timeout"
+
+// resumeTimeout is how long a request waits for a stopped project to start.
+const resumeTimeout = time.Minute
+
+// containerIdleTimeout returns the idle timeout of the container named
+// cntName, or zero if it's never stopped. It also reports whether the
+// container is running.
+func containerIdleTimeout(cntName string) (time.Duration, bool, error) {
+	cli := dockerClient()
+	defer cli.Close()
+
+	cnt, err := cli.ContainerInspect(context.Background(), cntName)
+	if err != nil {
+		return 0, false, err
+	}
+
+	label := cnt.Config.Labels[idleTimeoutLabel]
+	if label == "" {
+		return 0, cnt.State.Running, nil
+	}
+	d, err := time.ParseDuration(label)
+	if err != nil {
+		return 0, cnt.State.Running, xerrors.Errorf("invalid %v label %q: %w", idleTimeoutLabel, label, err)
+	}
+	return d, cnt.State.Running, nil
+}
+
+// ttyActivity returns the last time a terminal inside of the container named
+// cntName was used, such as those of code-server or sail shell.
+func ttyActivity(cntName string) (time.Time, error) {
+	out, err := dockutil.FmtExec(cntName, "stat -c %%Y /dev/pts/[0-9]* 2>/dev/null || true").Output()
+	if err != nil {
+		return time.Time{}, xerrors.Errorf("failed to stat terminals: %w", err)
+	}
+
+	var last int64
+	for _, field := range strings.Fields(string(out)) {
+		sec, err := strconv.ParseInt(field, 10, 64)
+		if err == nil && sec > last {
+			last = sec
+		}
+	}
+	if last == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(last, 0), nil
+}
+
+// touch records activity on the project.
+func (p *proxy) touch() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+}
+
+func (p *proxy) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastActive))
+}
+
+// track records requests to h as activity. Websockets, like those of
+// open editor tabs, keep the project active for as long as they're open.
+func (p *proxy) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// sail polls the API, which isn't use of the project.
+		if strings.HasPrefix(r.URL.Path, "/sail/api/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		p.touch()
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			atomic.AddInt64(&p.conns, 1)
+			defer func() {
+				atomic.AddInt64(&p.conns, -1)
+				p.touch()
+			}()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// idle reports whether the project hasn't been used for timeout.
+func (p *proxy) idle(timeout time.Duration) bool {
+	if atomic.LoadInt64(&p.conns) > 0 {
+		return false
+	}
+
+	last := p.lastActivity()
+	if time.Since(last) < timeout {
+		return false
+	}
+
+	tty, err := ttyActivity(p.cntName)
+	if err != nil {
+		flog.Error("%v", err)
+		return false
+	}
+	if tty.After(last) {
+		last = tty
+	}
+	return time.Since(last) >= timeout
+}
+
+// watchIdle stops the container once it has been idle for its idle timeout.
+func (p *proxy) watchIdle() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-p.closed:
+			return
+		}
+
+		timeout, running, err := containerIdleTimeout(p.cntName)
+		if err != nil {
+			if isContainerNotFoundError(err) {
+				return
+			}
+			flog.Error("%v", err)
+			continue
+		}
+		if timeout <= 0 || !running || !p.idle(timeout) {
+			continue
+		}
+
+		flog.Info("stopping %v, it has been idle for %v", p.cntName, timeout)
+		err = stopContainer(p.cntName)
+		if err != nil {
+			flog.Error("%v", err)
+			p.recordError(err)
+			continue
+		}
+		p.stopped()
+	}
+}
+
+// resume starts the stopped container and waits for code-server to come
+// online. It returns a channel that's closed once it's done. Concurrent
+// calls share the same attempt.
+func (p *proxy) resume() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.resuming != nil {
+		return p.resuming
+	}
+	done := make(chan struct{})
+	p.resuming = done
+	p.resumeErr = nil
+
+	go func() {
+		flog.Info("starting %v for a request", p.cntName)
+		err := startContainer(p.cntName)
+		if err == nil {
+			err = waitOnline(p.cntName, resumeTimeout)
+		}
+		if err == nil {
+			err = p.refreshPort()
+		}
+		if err != nil {
+			flog.Error("failed to start %v: %v", p.cntName, err)
+			p.recordError(xerrors.Errorf("failed to start %v: %w", p.cntName, err))
+		}
+
+		p.mu.Lock()
+		p.resuming = nil
+		p.resumeErr = err
+		p.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+var startingTmpl = template.Must(template.New("starting").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>sail - {{ .Project }}</title>
+{{ if not .Error }}<meta http-equiv="refresh" content="2">{{ end }}
+</head>
+<body>
+{{ if .Error }}<p>Failed to start {{ .Project }}: {{ .Error }}</p>
+<p>Reload to try again.</p>
+{{ else }}<p>Starting {{ .Project }}...</p>
+{{ end }}</body>
+</html>
+`))
+
+// ensureRunning starts the container if it was stopped. Browsers are shown a
+// page that reloads until the project is up, while other requests wait for
+// it. It returns false if the request was answered.
+func (p *proxy) ensureRunning(w http.ResponseWriter, r *http.Request) bool {
+	html := strings.Contains(r.Header.Get("Accept"), "text/html")
+
+	p.mu.Lock()
+	off := p.off
+	var failed error
+	if html && p.resuming == nil {
+		// Show why the last start failed once, the next request retries.
+		failed = p.resumeErr
+		p.resumeErr = nil
+	}
+	p.mu.Unlock()
+	if !off {
+		return true
+	}
+
+	if html {
+		data := map[string]interface{}{
+			"Project": toSailName(p.cntName),
+		}
+		if failed != nil {
+			data["Error"] = failed.Error()
+		} else {
+			p.resume()
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		startingTmpl.Execute(w, data)
+		return false
+	}
+
+	done := p.resume()
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return false
+	}
+
+	p.mu.Lock()
+	err := p.resumeErr
+	p.mu.Unlock()
+	if err != nil {
+		http.Error(w, xerrors.Errorf("failed to start %v: %w", p.cntName, err).Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
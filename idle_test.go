@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
+)
+
+func Test_proxyTrack(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy("http://127.0.0.1:7123", "cdr_sail", &proxyAuth{})
+	p.lastActive = 0
+
+	var conns int64
+	h := p.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns = atomic.LoadInt64(&p.conns)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/sail/api/v1/status", nil))
+	assert.True(t, p.lastActivity().Before(time.Now().Add(-time.Hour)), "API requests aren't activity")
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/static/main.js", nil))
+	assert.WithinDuration(t, time.Now(), p.lastActivity(), time.Second)
+	assert.EqualValues(t, 0, conns)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Upgrade", "websocket")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.EqualValues(t, 1, conns, "websockets are counted while open")
+	assert.EqualValues(t, 0, atomic.LoadInt64(&p.conns))
+
+	assert.False(t, p.idle(time.Hour))
+}
+
+func Test_proxyEnsureRunning(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy("http://127.0.0.1:7123", "cdr_sail", &proxyAuth{})
+
+	w := httptest.NewRecorder()
+	assert.True(t, p.ensureRunning(w, httptest.NewRequest("GET", "/", nil)))
+
+	// A failed start is shown to the browser instead of starting again.
+	p.stopped()
+	p.resumeErr = xerrors.New("no space left on device")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	assert.False(t, p.ensureRunning(w, r))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "Failed to start cdr/sail: no space left on device")
+	assert.NotContains(t, w.Body.String(), "refresh")
+	assert.Nil(t, p.resumeErr)
+}
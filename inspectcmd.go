@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+)
+
+type inspectcmd struct {
+	gf *globalFlags
+
+	json bool
+}
+
+func (c *inspectcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "inspect",
+		Usage: "[flags] <repo>",
+		Desc: `Shows the configuration a project's container was created with, such as
+its image, hat and the version of code-server mounted into it.`,
+	}
+}
+
+func (c *inspectcmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.BoolVar(&c.json, "json", false, "Print the configuration as JSON, as served by the proxy API.")
+}
+
+func (c *inspectcmd) Run(fl *flag.FlagSet) {
+	proj := c.gf.project(schemaPrefs{}, fl)
+	c.gf.ensureDockerDaemon()
+
+	conf, err := containerConfig(proj.cntName())
+	if err != nil {
+		flog.Fatal("failed to inspect %v: %v", proj.cntName(), err)
+	}
+
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(conf)
+		if err != nil {
+			flog.Fatal("%v", err)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"project", conf.Project},
+		{"image", conf.Image},
+		{"hat", conf.Hat},
+		{"code-server", conf.CodeServerVersion},
+		{"project dir", conf.ProjectDir},
+		{"local dir", conf.LocalDir},
+		{"proxy url", conf.ProxyURL},
+		{"idle timeout", conf.IdleTimeout},
+		{"forward gpg", fmt.Sprint(conf.ForwardGPG)},
+		{"dotfiles", conf.Dotfiles},
+		{"env", strings.Join(conf.Env, ", ")},
+		{"probes", strings.Join(conf.Probes, ", ")},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		fmt.Fprintf(tw, "%v:\t%v\n", f.name, f.value)
+	}
+	tw.Flush()
+}
@@ -2,38 +2,98 @@ package codeserver
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"io"
 	"path/filepath"
+	"regexp"
 	"strings"
 
 	"github.com/google/go-github/v24/github"
 	"golang.org/x/xerrors"
 )
 
-// DownloadURL gets a URL for the latest version of code-server.
-func DownloadURL(ctx context.Context) (string, error) {
+// DefaultMirror is where code-server releases are downloaded from by default.
+// Mirrors must serve the archives at the same paths, see ArchiveURL.
+const DefaultMirror = "https://github.com/cdr/code-server/releases/download"
+
+// ChecksumsName is the name of the checksum manifest of a release, in the
+// format of sha256sum.
+const ChecksumsName = "SHA256SUMS"
+
+// LatestVersion returns the version of the latest release of code-server.
+func LatestVersion(ctx context.Context) (string, error) {
 	client := github.NewClient(nil)
 	rel, _, err := client.Repositories.GetLatestRelease(ctx, "cdr", "code-server")
 	if err != nil {
 		return "", xerrors.Errorf("failed to get latest code-server release: %w", err)
 	}
-	for _, v := range rel.Assets {
-		// TODO: fix this jank, detect container architecture instead of hardcoding to x86_64
-		if strings.Index(*v.Name, "linux-x86_64") < 0 {
+	return rel.GetTagName(), nil
+}
+
+var versionRx = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z.+-]*$`)
+
+// ValidateVersion checks that version looks like a code-server version.
+// Versions end up in file paths and URLs, so they can't hold path separators
+// or dot segments.
+func ValidateVersion(version string) error {
+	if !versionRx.MatchString(version) || strings.Contains(version, "..") {
+		return xerrors.Errorf("invalid code-server version %q", version)
+	}
+	return nil
+}
+
+// ArchiveName returns the name of the release archive of version.
+func ArchiveName(version string) string {
+	// TODO: detect container architecture instead of hardcoding to x86_64.
+	return "code-server" + version + "-linux-x86_64.tar.gz"
+}
+
+// ArchiveURL returns the URL of the release archive of version on mirror.
+func ArchiveURL(mirror, version string) string {
+	return strings.TrimSuffix(mirror, "/") + "/" + version + "/" + ArchiveName(version)
+}
+
+// ChecksumsURL returns the URL of the checksum manifest of version on mirror.
+func ChecksumsURL(mirror, version string) string {
+	return strings.TrimSuffix(mirror, "/") + "/" + version + "/" + ChecksumsName
+}
+
+// ParseChecksums parses a checksum manifest in the format of sha256sum into
+// a map of file names to their hex encoded SHA-256.
+func ParseChecksums(r io.Reader) (map[string]string, error) {
+	sums := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		return *v.BrowserDownloadURL, nil
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, xerrors.Errorf("invalid checksum line %q", line)
+		}
+		// A * marks files that were read in binary mode.
+		name := strings.TrimPrefix(fields[1], "*")
+		sums[name] = strings.ToLower(fields[0])
 	}
-	return "", xerrors.New("no released found for platform")
+	return sums, s.Err()
 }
 
 // Extract takes a code-server release tar and writes out the main binary to bin.
 func Extract(ctx context.Context, tarFi io.Reader) (io.Reader, error) {
+	_, rd, err := ExtractFile(ctx, tarFi)
+	return rd, err
+}
+
+// ExtractFile is like Extract, but also returns the path of the binary in
+// the archive, which holds the version, see ArchiveVersion.
+func ExtractFile(ctx context.Context, tarFi io.Reader) (string, io.Reader, error) {
 	grd, err := gzip.NewReader(tarFi)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to create gzip decoder: %w", err)
+		return "", nil, xerrors.Errorf("failed to create gzip decoder: %w", err)
 	}
 	defer grd.Close()
 
@@ -42,12 +102,25 @@ func Extract(ctx context.Context, tarFi io.Reader) (io.Reader, error) {
 		hdr, err := rd.Next()
 		if err != nil {
 			if err == io.EOF {
-				return nil, xerrors.New("code-server not found")
+				return "", nil, xerrors.New("code-server not found")
 			}
-			return nil, err
+			return "", nil, err
 		}
 		if filepath.Base(hdr.Name) == "code-server" {
-			return rd, nil
+			return hdr.Name, rd, nil
 		}
 	}
 }
+
+var archiveVersionRx = regexp.MustCompile(`code-server([0-9A-Za-z.+-]+)-linux-x86_64`)
+
+// ArchiveVersion returns the version of code-server from the name of a
+// release archive or of a path inside of it, e.g
+// code-server2.1523-vsc1.38.1-linux-x86_64/code-server.
+func ArchiveVersion(name string) (string, bool) {
+	m := archiveVersionRx.FindStringSubmatch(name)
+	if m == nil || ValidateVersion(m[1]) != nil {
+		return "", false
+	}
+	return m[1], true
+}
@@ -1,28 +1,138 @@
 package codeserver
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 )
 
-func TestDownloadURL_Extract(t *testing.T) {
+func TestArchiveURL(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t,
+		"https://github.com/cdr/code-server/releases/download/2.1523-vsc1.38.1/code-server2.1523-vsc1.38.1-linux-x86_64.tar.gz",
+		ArchiveURL(DefaultMirror, "2.1523-vsc1.38.1"),
+	)
+	assert.Equal(t,
+		"https://mirror.example.com/code-server/2.1523-vsc1.38.1/SHA256SUMS",
+		ChecksumsURL("https://mirror.example.com/code-server/", "2.1523-vsc1.38.1"),
+	)
+}
+
+func TestParseChecksums(t *testing.T) {
+	t.Parallel()
+
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	sums, err := ParseChecksums(strings.NewReader(
+		"# code-server\n" +
+			sum + "  code-server2.1523-vsc1.38.1-linux-x86_64.tar.gz\n" +
+			"\n" +
+			strings.ToUpper(sum) + " *code-server2.1523-vsc1.38.1-darwin-x86_64.zip\n",
+	))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"code-server2.1523-vsc1.38.1-linux-x86_64.tar.gz": sum,
+		"code-server2.1523-vsc1.38.1-darwin-x86_64.zip":   sum,
+	}, sums)
+
+	_, err = ParseChecksums(strings.NewReader("abc  code-server.tar.gz\n"))
+	assert.Error(t, err)
+}
+
+func TestValidateVersion(t *testing.T) {
+	t.Parallel()
+
+	for _, v := range []string{"2.1523-vsc1.38.1", "3.0.0", "v3.4.1+build.2"} {
+		assert.NoError(t, ValidateVersion(v), v)
+	}
+	for _, v := range []string{"", ".", "..", "../../..", "2.1523/../x", "a..b", "-v", "2.1 x", "a?b", "a#b"} {
+		assert.Error(t, ValidateVersion(v), v)
+	}
+}
+
+func TestArchiveVersion(t *testing.T) {
+	t.Parallel()
+
+	tcases := []struct {
+		name    string
+		version string
+		ok      bool
+	}{
+		{"code-server2.1523-vsc1.38.1-linux-x86_64.tar.gz", "2.1523-vsc1.38.1", true},
+		{"code-server2.1523-vsc1.38.1-linux-x86_64/code-server", "2.1523-vsc1.38.1", true},
+		{"downloads/code-server2.1485-vsc1.38.1-linux-x86_64.tar.gz", "2.1485-vsc1.38.1", true},
+		{"code-server.tar.gz", "", false},
+		{"code-server2.1523-vsc1.38.1-darwin-x86_64.zip", "", false},
+		{"code-server..-linux-x86_64.tar.gz", "", false},
+		{"code-server../../etc-linux-x86_64.tar.gz", "", false},
+	}
+
+	for _, tcase := range tcases {
+		version, ok := ArchiveVersion(tcase.name)
+		assert.Equal(t, tcase.ok, ok, tcase.name)
+		assert.Equal(t, tcase.version, version, tcase.name)
+	}
+}
+
+func TestExtractFile(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{
+		"code-server2.1523-vsc1.38.1-linux-x86_64/README.md",
+		"code-server2.1523-vsc1.38.1-linux-x86_64/code-server",
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0750,
+			Size: int64(len(name)),
+		}))
+		_, err := tw.Write([]byte(name))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+
+	name, rd, err := ExtractFile(context.Background(), &buf)
+	require.NoError(t, err)
+	assert.Equal(t, "code-server2.1523-vsc1.38.1-linux-x86_64/code-server", name)
+
+	byt, err := ioutil.ReadAll(rd)
+	require.NoError(t, err)
+	assert.Equal(t, name, string(byt))
+}
+
+func TestLatestVersion_Extract(t *testing.T) {
 	t.Parallel()
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*2)
 	defer cancel()
 
-	url, err := DownloadURL(ctx)
+	version, err := LatestVersion(ctx)
+	var netErr net.Error
+	if xerrors.As(err, &netErr) {
+		t.Skipf("no network: %v", err)
+	}
 	require.NoError(t, err)
 
-	resp, err := http.Get(url)
+	resp, err := http.Get(ArchiveURL(DefaultMirror, version))
 	require.NoError(t, err)
 	defer resp.Body.Close()
 
@@ -29,22 +29,14 @@ func PID(containerName string) (int, error) {
 // Port returns the port that code-server is listening on, or
 // PortNotFoundError if code-server isn't listening on any port.
 func Port(containerName string) (string, error) {
-	// Example output:
-	// Proto Recv-Q Send-Q Local Address           Foreign Address         State       PID/Program name
-	// tcp        0      0 localhost:4774          0.0.0.0:*               LISTEN      6/code-server
-	// tcp        0      0 127.0.0.53:domain       0.0.0.0:*               LISTEN      -
-	out, err := dockutil.Exec(containerName, "netstat", "-tpl").CombinedOutput()
+	ls, err := dockutil.Listeners(containerName)
 	if err != nil {
-		return "", xerrors.Errorf("failed to netstat: %s, %w", out, err)
+		return "", err
 	}
 
-	lines := strings.Split(string(out), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "code-server") {
-			fields := strings.Fields(line)
-			const localAddrIndex = 3
-			localAddrField := fields[localAddrIndex]
-			return strings.TrimLeft(localAddrField, "localhost:"), nil
+	for _, l := range ls {
+		if l.Program == "code-server" {
+			return l.Port, nil
 		}
 	}
 
@@ -39,3 +39,8 @@ func ExecEnv(cntName string, envs []string, cmd string, args ...string) *exec.Cm
 	args = append([]string{"exec", "-e", strings.Join(envs, ","), "-i", cntName, cmd}, args...)
 	return exec.Command("docker", args...)
 }
+
+func ExecUser(cntName, user, cmd string, args ...string) *exec.Cmd {
+	args = append([]string{"exec", "-u", user, "-i", cntName, cmd}, args...)
+	return exec.Command("docker", args...)
+}
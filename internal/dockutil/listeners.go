@@ -0,0 +1,81 @@
+package dockutil
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Listener is a TCP port listened on inside of a container.
+type Listener struct {
+	Port string
+	// Addr is the local address listened on, e.g 127.0.0.1 or ::.
+	Addr string
+	// Program is the name of the listening process, or empty
+	// if netstat can't tell.
+	Program string
+}
+
+// Listeners returns the TCP ports listened on inside of the container, sorted by port.
+func Listeners(cntName string) ([]Listener, error) {
+	out, err := Exec(cntName, "netstat", "-tpln").CombinedOutput()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to netstat: %s, %w", out, err)
+	}
+	return parseNetstat(string(out)), nil
+}
+
+// parseNetstat parses the output of netstat -tpln.
+func parseNetstat(out string) []Listener {
+	// Example output:
+	// Active Internet connections (only servers)
+	// Proto Recv-Q Send-Q Local Address           Foreign Address         State       PID/Program name
+	// tcp        0      0 127.0.0.1:4774          0.0.0.0:*               LISTEN      6/code-server
+	// tcp        0      0 127.0.0.53:53           0.0.0.0:*               LISTEN      -
+	// tcp6       0      0 :::3000                 :::*                    LISTEN      112/node
+	const (
+		localAddrIndex = 3
+		programIndex   = 6
+	)
+
+	seen := make(map[string]struct{})
+	var ls []Listener
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) <= programIndex || !strings.HasPrefix(fields[0], "tcp") {
+			continue
+		}
+
+		// IPv6 addresses aren't bracketed, e.g :::3000.
+		local := fields[localAddrIndex]
+		i := strings.LastIndex(local, ":")
+		if i < 0 {
+			continue
+		}
+		addr, port := local[:i], local[i+1:]
+		// Programs listening on both IPv4 and IPv6 show up twice.
+		if _, ok := seen[port]; ok {
+			continue
+		}
+		seen[port] = struct{}{}
+
+		// Some programs rename their process, e.g "40/nginx: master pr".
+		var program string
+		if i := strings.Index(fields[programIndex], "/"); i >= 0 {
+			program = strings.TrimSuffix(fields[programIndex][i+1:], ":")
+		}
+
+		ls = append(ls, Listener{
+			Port:    port,
+			Addr:    addr,
+			Program: program,
+		})
+	}
+
+	sort.Slice(ls, func(i, j int) bool {
+		return len(ls[i].Port) < len(ls[j].Port) ||
+			len(ls[i].Port) == len(ls[j].Port) && ls[i].Port < ls[j].Port
+	})
+	return ls
+}
@@ -0,0 +1,29 @@
+package dockutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseNetstat(t *testing.T) {
+	t.Parallel()
+
+	out := `Active Internet connections (only servers)
+Proto Recv-Q Send-Q Local Address           Foreign Address         State       PID/Program name
+tcp        0      0 127.0.0.1:4774          0.0.0.0:*               LISTEN      6/code-server
+tcp        0      0 127.0.0.53:53           0.0.0.0:*               LISTEN      -
+tcp        0      0 0.0.0.0:3000            0.0.0.0:*               LISTEN      112/node
+tcp6       0      0 :::3000                 :::*                    LISTEN      112/node
+tcp6       0      0 :::80                   :::*                    LISTEN      40/nginx: master pr
+`
+
+	assert.Equal(t, []Listener{
+		{Port: "53", Addr: "127.0.0.53"},
+		{Port: "80", Addr: "::", Program: "nginx"},
+		{Port: "3000", Addr: "0.0.0.0", Program: "node"},
+		{Port: "4774", Addr: "127.0.0.1", Program: "code-server"},
+	}, parseNetstat(out))
+
+	assert.Empty(t, parseNetstat(""))
+}
@@ -0,0 +1,277 @@
+// Package metrics implements counters, gauges and histograms that are
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets for request latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the Prometheus text format.
+type Registry struct {
+	// labels are added to every metric.
+	labels []labelPair
+
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type labelPair struct {
+	name, value string
+}
+
+type metric interface {
+	write(w *bufio.Writer, constLabels []labelPair)
+}
+
+// NewRegistry returns a registry that adds labels to every metric.
+func NewRegistry(labels map[string]string) *Registry {
+	r := &Registry{}
+	for name, value := range labels {
+		r.labels = append(r.labels, labelPair{name, value})
+	}
+	sort.Slice(r.labels, func(i, j int) bool {
+		return r.labels[i].name < r.labels[j].name
+	})
+	return r
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric to w in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw, r.labels)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// desc describes a metric and the names of its labels.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", d.name, d.typ)
+}
+
+// pairs returns the label pairs of a series with values.
+func (d desc) pairs(values []string) []labelPair {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %v has %v labels, got %v values", d.name, len(d.labels), len(values)))
+	}
+	pairs := make([]labelPair, len(values))
+	for i, v := range values {
+		pairs[i] = labelPair{d.labels[i], v}
+	}
+	return pairs
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w *bufio.Writer, name string, labels []labelPair, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%v="%v"`, l.name, labelValueReplacer.Replace(l.value))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series holds the values of a metric by their label values.
+type series struct {
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// keys returns the keys of the series in a stable order.
+func (s *series) keys() []string {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, partitioned by labels.
+type Counter struct {
+	desc
+	series
+	counts map[string]float64
+}
+
+// Counter registers a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		series: series{values: make(map[string][]string)},
+		counts: make(map[string]float64),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter with the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter with the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	c.pairs(values)
+	key := seriesKey(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = values
+	c.counts[key] += v
+}
+
+func (c *Counter) write(w *bufio.Writer, constLabels []labelPair) {
+	c.writeHeader(w)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.keys() {
+		writeSample(w, c.name, append(append([]labelPair(nil), constLabels...), c.pairs(c.values[key])...), c.counts[key])
+	}
+}
+
+// gaugeFunc is a gauge whose value is read when written.
+type gaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// GaugeFunc registers a gauge whose value is returned by fn.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{
+		desc: desc{name: name, help: help, typ: "gauge"},
+		fn:   fn,
+	})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer, constLabels []labelPair) {
+	g.writeHeader(w)
+	writeSample(w, g.name, constLabels, g.fn())
+}
+
+// Histogram counts observations in buckets, partitioned by labels.
+type Histogram struct {
+	desc
+	series
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+// Histogram registers a histogram with the given buckets and label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		series:  series{values: make(map[string][]string)},
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+		totals:  make(map[string]uint64),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds v to the histogram with the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.pairs(values)
+	key := seriesKey(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.values[key] = values
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[key] = counts
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			counts[i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+func (h *Histogram) write(w *bufio.Writer, constLabels []labelPair) {
+	h.writeHeader(w)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range h.keys() {
+		labels := append(append([]labelPair(nil), constLabels...), h.pairs(h.values[key])...)
+		for i, b := range h.buckets {
+			writeSample(w, h.name+"_bucket", append(labels, labelPair{"le", formatFloat(b)}), float64(h.counts[key][i]))
+		}
+		writeSample(w, h.name+"_bucket", append(labels, labelPair{"le", "+Inf"}), float64(h.totals[key]))
+		writeSample(w, h.name+"_sum", labels, h.sums[key])
+		writeSample(w, h.name+"_count", labels, float64(h.totals[key]))
+	}
+}
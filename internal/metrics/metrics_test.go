@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry(map[string]string{"project": `cdr/"sail"`})
+
+	reqs := r.Counter("requests_total", "Requests handled.", "route", "code")
+	reqs.Inc("code-server", "200")
+	reqs.Inc("code-server", "200")
+	reqs.Inc("api", "401")
+
+	r.GaugeFunc("open_websockets", "Open websockets.", func() float64 { return 3 })
+
+	latency := r.Histogram("request_duration_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	latency.Observe(0.05, "api")
+	latency.Observe(0.5, "api")
+	latency.Observe(2, "api")
+
+	var b bytes.Buffer
+	n, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	assert.EqualValues(t, b.Len(), n)
+
+	assert.Equal(t, `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{project="cdr/\"sail\"",route="api",code="401"} 1
+requests_total{project="cdr/\"sail\"",route="code-server",code="200"} 2
+# HELP open_websockets Open websockets.
+# TYPE open_websockets gauge
+open_websockets{project="cdr/\"sail\""} 3
+# HELP request_duration_seconds Request latency.
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{project="cdr/\"sail\"",route="api",le="0.1"} 1
+request_duration_seconds_bucket{project="cdr/\"sail\"",route="api",le="1"} 2
+request_duration_seconds_bucket{project="cdr/\"sail\"",route="api",le="+Inf"} 3
+request_duration_seconds_sum{project="cdr/\"sail\"",route="api"} 2.55
+request_duration_seconds_count{project="cdr/\"sail\"",route="api"} 3
+`, b.String())
+}
+
+func TestCounterLabels(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry(nil)
+	c := r.Counter("refreshes_total", "Refreshes.", "result")
+	assert.Panics(t, func() { c.Inc() })
+}
@@ -0,0 +1,258 @@
+package sailapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// Client talks to the API of a project's proxy.
+type Client struct {
+	// URL is the URL the project is proxied on.
+	URL string
+	// Token is the project's proxy token.
+	Token string
+	// HTTPClient defaults to http.DefaultClient. Its timeout doesn't
+	// apply to streamed responses.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the project proxied on u.
+func New(u, token string, hc *http.Client) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(u, "/"),
+		Token:      token,
+		HTTPClient: hc,
+	}
+}
+
+func (c *Client) httpClient(stream bool) *http.Client {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	if stream && hc.Timeout != 0 {
+		cp := *hc
+		cp.Timeout = 0
+		hc = &cp
+	}
+	return hc
+}
+
+func (c *Client) request(ctx context.Context, method, path string, in interface{}, stream bool) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		byt, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(byt)
+	}
+
+	req, err := http.NewRequest(method, c.URL+Prefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return c.httpClient(stream).Do(req)
+}
+
+// responseError returns the error of a failed response.
+func responseError(resp *http.Response) error {
+	byt, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	err := json.Unmarshal(byt, apiErr)
+	if err != nil || apiErr.Message == "" {
+		// Not every failure comes from the API, e.g a missing token.
+		apiErr.Message = strings.TrimSpace(string(byt))
+	}
+	return xerrors.Errorf("proxy responded with %v: %w", resp.Status, apiErr)
+}
+
+// Do makes a request to path, relative to Prefix. in is sent as JSON if
+// it isn't nil, and the response is decoded into out if it isn't nil.
+func (c *Client) Do(ctx context.Context, method, path string, in, out interface{}) error {
+	resp, err := c.request(ctx, method, path, in, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// stream makes a request to path and calls fn with each JSON line of the response.
+func (c *Client) stream(ctx context.Context, method, path string, fn func(line []byte) error) error {
+	resp, err := c.request(ctx, method, path, nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	s := bufio.NewScanner(resp.Body)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		err = fn(s.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// Healthz returns nil once the proxy is up.
+func (c *Client) Healthz(ctx context.Context) error {
+	resp, err := c.request(ctx, http.MethodGet, PathHealthz, nil, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// Status returns the state of the project. It isn't an error for the
+// project not to be ready.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	resp, err := c.request(ctx, http.MethodGet, PathStatus, nil, false)
+	if err != nil {
+		return Status{}, err
+	}
+	defer resp.Body.Close()
+
+	// The status is still sent while the project isn't ready.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return Status{}, responseError(resp)
+	}
+
+	var st Status
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	if err != nil {
+		return Status{}, xerrors.Errorf("failed to decode status: %w", err)
+	}
+	return st, nil
+}
+
+// Rebuild rebuilds the project's container with sail edit. fn is called
+// with each event until the rebuild is done. It returns the error of the
+// result event if the rebuild failed. Canceling ctx cancels the rebuild
+// unless the new container is already replacing the old one.
+func (c *Client) Rebuild(ctx context.Context, fn func(Event)) error {
+	var result *Event
+	err := c.stream(ctx, http.MethodPost, PathRebuild, func(line []byte) error {
+		var e Event
+		err := json.Unmarshal(line, &e)
+		if err != nil {
+			return xerrors.Errorf("failed to decode event: %w", err)
+		}
+		if fn != nil {
+			fn(e)
+		}
+		if e.Type == EventResult {
+			result = &e
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return xerrors.New("rebuild ended without a result")
+	}
+	if result.Error != "" {
+		return xerrors.New(result.Error)
+	}
+	return nil
+}
+
+// Stop stops the project's container. The proxy starts it again on the
+// next request.
+func (c *Client) Stop(ctx context.Context) (Status, error) {
+	var st Status
+	err := c.Do(ctx, http.MethodPost, PathStop, nil, &st)
+	return st, err
+}
+
+// LogsOptions are the options of Client.Logs.
+type LogsOptions struct {
+	// Sources are the hooks, or code-server, to read the output of.
+	// All of them are read if it's empty.
+	Sources []string
+	// Follow keeps streaming new lines until ctx is done.
+	Follow bool
+}
+
+// Logs calls fn with each line of output of the project's lifecycle hooks
+// and code-server.
+func (c *Client) Logs(ctx context.Context, opts LogsOptions, fn func(LogLine)) error {
+	q := url.Values{}
+	for _, src := range opts.Sources {
+		q.Add("source", src)
+	}
+	if opts.Follow {
+		q.Set("follow", "true")
+	}
+	path := PathLogs
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	return c.stream(ctx, http.MethodGet, path, func(line []byte) error {
+		var l LogLine
+		err := json.Unmarshal(line, &l)
+		if err != nil {
+			return xerrors.Errorf("failed to decode log line: %w", err)
+		}
+		fn(l)
+		return nil
+	})
+}
+
+// Ports returns the ports listened on inside of the container, except
+// code-server's own.
+func (c *Client) Ports(ctx context.Context) ([]Port, error) {
+	var ports []Port
+	err := c.Do(ctx, http.MethodGet, PathPorts, nil, &ports)
+	return ports, err
+}
+
+// Config returns the configuration the project's container was created with.
+func (c *Client) Config(ctx context.Context) (Config, error) {
+	var conf Config
+	err := c.Do(ctx, http.MethodGet, PathConfig, nil, &conf)
+	return conf, err
+}
+
+// Refresh makes the proxy find the code-server port again.
+func (c *Client) Refresh(ctx context.Context) error {
+	return c.Do(ctx, http.MethodPost, PathRefresh, nil, nil)
+}
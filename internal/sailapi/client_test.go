@@ -0,0 +1,129 @@
+package sailapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestEvent_JSON(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		e    Event
+		wire string
+	}{
+		{Event{Type: EventData, Output: []byte("hi\n")}, `{"type":"data","v":"aGkK"}`},
+		{Event{Type: EventPhaseStart, Phase: PhaseBuild}, `{"type":"phase_start","v":{"phase":"build"}}`},
+		{Event{Type: EventStep, Phase: PhaseBuild, Step: 2, Steps: 5, Message: "RUN make"}, `{"type":"step","v":{"phase":"build","step":2,"steps":5,"message":"RUN make"}}`},
+		{Event{Type: EventPhaseEnd, Phase: PhaseWaitOnline, Error: "timed out"}, `{"type":"phase_end","v":{"phase":"wait-online","error":"timed out"}}`},
+		{Event{Type: EventResult}, `{"type":"result","v":{}}`},
+	}
+
+	for _, test := range tests {
+		byt, err := json.Marshal(test.e)
+		require.NoError(t, err)
+		assert.JSONEq(t, test.wire, string(byt))
+
+		var e Event
+		require.NoError(t, json.Unmarshal([]byte(test.wire), &e))
+		assert.Equal(t, test.e, e)
+	}
+}
+
+func testClient(h http.HandlerFunc) (*Client, func()) {
+	srv := httptest.NewServer(h)
+	return New(srv.URL+"/", "token", srv.Client()), srv.Close
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Status", func(t *testing.T) {
+		t.Parallel()
+
+		c, closeSrv := testClient(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, Prefix+PathStatus, r.URL.Path)
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(Status{Project: "cdr/sail", State: "running"})
+		})
+		defer closeSrv()
+
+		st, err := c.Status(context.Background())
+		require.NoError(t, err, "a project that isn't ready still has a status")
+		assert.Equal(t, "cdr/sail", st.Project)
+		assert.False(t, st.Ready)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		t.Parallel()
+
+		c, closeSrv := testClient(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(Error{Message: "container cdr_sail is not running"})
+		})
+		defer closeSrv()
+
+		_, err := c.Ports(context.Background())
+		var apiErr *Error
+		require.True(t, xerrors.As(err, &apiErr), "%v", err)
+		assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+		assert.Equal(t, "container cdr_sail is not running", apiErr.Message)
+	})
+
+	t.Run("Rebuild", func(t *testing.T) {
+		t.Parallel()
+
+		fail := false
+		c, closeSrv := testClient(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			enc := json.NewEncoder(w)
+			enc.Encode(Event{Type: EventData, Output: []byte("building\n")})
+			if fail {
+				enc.Encode(Event{Type: EventResult, Error: "failed to build image: exit status 1"})
+				return
+			}
+			enc.Encode(Event{Type: EventResult})
+		})
+		defer closeSrv()
+
+		var out []byte
+		err := c.Rebuild(context.Background(), func(e Event) {
+			out = append(out, e.Output...)
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "building\n", string(out))
+
+		fail = true
+		err = c.Rebuild(context.Background(), nil)
+		assert.EqualError(t, err, "failed to build image: exit status 1")
+	})
+
+	t.Run("Logs", func(t *testing.T) {
+		t.Parallel()
+
+		c, closeSrv := testClient(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, []string{"on_start", "code-server"}, r.URL.Query()["source"])
+			assert.Equal(t, "true", r.URL.Query().Get("follow"))
+			json.NewEncoder(w).Encode(LogLine{Source: "on_start", Line: "hello"})
+		})
+		defer closeSrv()
+
+		var lines []LogLine
+		err := c.Logs(context.Background(), LogsOptions{
+			Sources: []string{"on_start", "code-server"},
+			Follow:  true,
+		}, func(l LogLine) {
+			lines = append(lines, l)
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []LogLine{{Source: "on_start", Line: "hello"}}, lines)
+	})
+}
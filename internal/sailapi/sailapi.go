@@ -0,0 +1,214 @@
+// Package sailapi defines the HTTP API that each project's proxy serves
+// under /sail/api/v1, and a client for it. The proxy and its clients share
+// the paths and types here so they can't drift apart.
+package sailapi
+
+import (
+	"encoding/json"
+)
+
+// Prefix is the path that the API is served under.
+const Prefix = "/sail/api/v1"
+
+// Paths of the API, relative to Prefix.
+const (
+	// PathHealthz responds once the proxy is up. It's the only path
+	// that doesn't require the project's token.
+	PathHealthz = "/healthz"
+	PathStatus  = "/status"
+	PathRebuild = "/rebuild"
+	PathStop    = "/stop"
+	PathLogs    = "/logs"
+	PathPorts   = "/ports"
+	PathConfig  = "/config"
+	// PathRefresh makes the proxy find the code-server port again after
+	// the container was replaced.
+	PathRefresh = "/refresh"
+	// PathForwards lists and starts tunnels, and PathForwards/<id>
+	// closes one.
+	PathForwards = "/forwards"
+	// PathMetrics serves metrics in the Prometheus text format.
+	PathMetrics = "/metrics"
+)
+
+// Error is the body of responses that failed.
+type Error struct {
+	// StatusCode is the status of the response. It isn't part of the body.
+	StatusCode int    `json:"-"`
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Status is the state of a project.
+type Status struct {
+	// Project is the name of the project, e.g cdr/sail.
+	Project   string `json:"project"`
+	Container string `json:"container"`
+	// State is the state of the container, e.g running or exited.
+	State      string `json:"state"`
+	CodeServer bool   `json:"code_server"`
+	// Port is the port code-server listens on inside of the container.
+	Port   string  `json:"port,omitempty"`
+	Ready  bool    `json:"ready"`
+	Probes []Probe `json:"probes"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Probe is the result of a readiness probe.
+type Probe struct {
+	Name  string `json:"name"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+// Port is a port listened on inside of the container.
+type Port struct {
+	Port string `json:"port"`
+	// Addr is the local address listened on, e.g 127.0.0.1 or ::.
+	Addr    string `json:"addr"`
+	Program string `json:"program,omitempty"`
+	// URL is where the proxy serves the port.
+	URL string `json:"url"`
+}
+
+// Config is the configuration the project's container was created with.
+type Config struct {
+	Project     string   `json:"project"`
+	Image       string   `json:"image"`
+	Hat         string   `json:"hat,omitempty"`
+	ProjectDir  string   `json:"project_dir"`
+	LocalDir    string   `json:"local_dir"`
+	ProxyURL    string   `json:"proxy_url"`
+	IdleTimeout string   `json:"idle_timeout,omitempty"`
+	ForwardGPG  bool     `json:"forward_gpg"`
+	Dotfiles    string   `json:"dotfiles,omitempty"`
+	Env         []string `json:"env"`
+	Probes      []string `json:"probes"`
+	// CodeServerVersion is the version of code-server mounted into the container.
+	CodeServerVersion string `json:"code_server_version,omitempty"`
+}
+
+// LogLine is a line of output of a lifecycle hook or of code-server.
+type LogLine struct {
+	// Source is the name of the hook or code-server.
+	Source string `json:"source"`
+	Line   string `json:"line"`
+}
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventData carries output of the command.
+	EventData EventType = "data"
+	// EventPhaseStart and EventPhaseEnd mark the phases of a rebuild.
+	// The end of a phase that failed carries the error.
+	EventPhaseStart EventType = "phase_start"
+	EventPhaseEnd   EventType = "phase_end"
+	// EventStep is the progress of an image build.
+	EventStep EventType = "step"
+	// EventResult ends the stream. It carries the error if the command failed.
+	EventResult EventType = "result"
+)
+
+// Phase is a phase of a rebuild.
+type Phase string
+
+// The phases of a rebuild, in the order they run in. Rollback only runs if
+// the rebuild failed, to remove the new container. sail edit -rollback runs
+// the wait-online, stop and swap phases.
+const (
+	PhaseBuild      Phase = "build"
+	PhaseHat        Phase = "hat"
+	PhaseCreate     Phase = "create"
+	PhaseWaitOnline Phase = "wait-online"
+	PhaseStop       Phase = "stop"
+	PhaseSwap       Phase = "swap"
+	PhaseRollback   Phase = "rollback"
+)
+
+// Event is a message of a streamed sail command, such as a rebuild.
+// It's encoded as {"type": ..., "v": ...}. v is the base64 encoded output
+// of data events, and an object with the other fields for the rest.
+type Event struct {
+	Type EventType
+	// Output is set on data events.
+	Output []byte
+	// Phase is set on phase and step events.
+	Phase Phase
+	// Step is the number of the build step out of Steps, which is
+	// zero if it isn't known. Message describes the step.
+	Step    int
+	Steps   int
+	Message string
+	// Error is set on phase end and result events if they failed.
+	Error string
+}
+
+type wireEvent struct {
+	Type EventType       `json:"type"`
+	V    json.RawMessage `json:"v,omitempty"`
+}
+
+type wireEventValue struct {
+	Phase   Phase  `json:"phase,omitempty"`
+	Step    int    `json:"step,omitempty"`
+	Steps   int    `json:"steps,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e Event) MarshalJSON() ([]byte, error) {
+	var (
+		v   []byte
+		err error
+	)
+	if e.Type == EventData {
+		v, err = json.Marshal(e.Output)
+	} else {
+		v, err = json.Marshal(wireEventValue{
+			Phase:   e.Phase,
+			Step:    e.Step,
+			Steps:   e.Steps,
+			Message: e.Message,
+			Error:   e.Error,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(wireEvent{Type: e.Type, V: v})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var we wireEvent
+	err := json.Unmarshal(b, &we)
+	if err != nil {
+		return err
+	}
+
+	*e = Event{Type: we.Type}
+	if len(we.V) == 0 {
+		return nil
+	}
+	if we.Type == EventData {
+		return json.Unmarshal(we.V, &e.Output)
+	}
+
+	var v wireEventValue
+	err = json.Unmarshal(we.V, &v)
+	if err != nil {
+		return err
+	}
+	e.Phase = v.Phase
+	e.Step = v.Step
+	e.Steps = v.Steps
+	e.Message = v.Message
+	e.Error = v.Error
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// languageDetection describes the language detected in a project directory
+// and why it was chosen.
+type languageDetection struct {
+	// lang is the lowercase language name, e.g "go" or "c++".
+	// It is empty if no language could be determined.
+	lang   string
+	reason string
+}
+
+// languageManifests maps well-known manifest files found at the root of a
+// project to the language they imply. Manifests are a stronger signal than
+// the extension census as they describe how the project is built.
+var languageManifests = []struct {
+	file string
+	lang string
+}{
+	{"go.mod", "go"},
+	{"Gopkg.toml", "go"},
+	{"tsconfig.json", "typescript"},
+	{"package.json", "javascript"},
+	{"pyproject.toml", "python"},
+	{"setup.py", "python"},
+	{"Pipfile", "python"},
+	{"requirements.txt", "python"},
+	{"Gemfile", "ruby"},
+	{"pom.xml", "java"},
+	{"build.gradle", "java"},
+	{"build.gradle.kts", "java"},
+	{"CMakeLists.txt", "c++"},
+}
+
+// languageExtensions maps source file extensions to languages for the
+// extension census.
+var languageExtensions = map[string]string{
+	".go":    "go",
+	".js":    "javascript",
+	".jsx":   "javascript",
+	".mjs":   "javascript",
+	".ts":    "typescript",
+	".tsx":   "typescript",
+	".py":    "python",
+	".c":     "c",
+	".h":     "c",
+	".cc":    "c++",
+	".cpp":   "c++",
+	".cxx":   "c++",
+	".hh":    "c++",
+	".hpp":   "c++",
+	".java":  "java",
+	".rb":    "ruby",
+	".rs":    "rust",
+	".php":   "php",
+	".cs":    "c#",
+	".kt":    "kotlin",
+	".scala": "scala",
+	".swift": "swift",
+}
+
+// censusSkipDirs are directories that hold vendored, generated or
+// tooling files which shouldn't count towards the project's language.
+var censusSkipDirs = map[string]struct{}{
+	".git":         {},
+	".hg":          {},
+	".svn":         {},
+	".sail":        {},
+	"node_modules": {},
+	"vendor":       {},
+	"third_party":  {},
+	"dist":         {},
+	"target":       {},
+}
+
+// censusMaxFiles bounds the amount of files we stat during the census so
+// detection stays fast on huge repositories.
+const censusMaxFiles = 20000
+
+// errCensusLimit stops the census walk once censusMaxFiles is reached.
+var errCensusLimit = xerrors.New("census file limit reached")
+
+// detectLanguage determines the language of the project checked out at dir.
+// It first looks for a build manifest at the root of the project, falling back
+// to counting the bytes of source files by extension, similar to linguist.
+func detectLanguage(dir string) languageDetection {
+	for _, m := range languageManifests {
+		_, err := os.Stat(filepath.Join(dir, m.file))
+		if err == nil {
+			return languageDetection{
+				lang:   m.lang,
+				reason: fmt.Sprintf("found %v manifest", m.file),
+			}
+		}
+	}
+
+	return languageCensus(dir)
+}
+
+// languageCensus walks dir and returns the language with the most bytes of
+// source code.
+func languageCensus(dir string) languageDetection {
+	var (
+		sizes = make(map[string]int64)
+		total int64
+		files int
+	)
+
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Best effort, skip anything we can't read.
+			return nil
+		}
+		if info.IsDir() {
+			if _, ok := censusSkipDirs[info.Name()]; ok && path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		files++
+		if files > censusMaxFiles {
+			return errCensusLimit
+		}
+
+		lang, ok := languageExtensions[strings.ToLower(filepath.Ext(path))]
+		if !ok {
+			return nil
+		}
+		sizes[lang] += info.Size()
+		total += info.Size()
+		return nil
+	})
+
+	if total == 0 {
+		return languageDetection{
+			reason: "no manifest or recognized source files found",
+		}
+	}
+
+	langs := make([]string, 0, len(sizes))
+	for lang := range sizes {
+		langs = append(langs, lang)
+	}
+	// Sort by size, then by name so ties are deterministic.
+	sort.Slice(langs, func(i, j int) bool {
+		if sizes[langs[i]] != sizes[langs[j]] {
+			return sizes[langs[i]] > sizes[langs[j]]
+		}
+		return langs[i] < langs[j]
+	})
+
+	lang := langs[0]
+	return languageDetection{
+		lang: lang,
+		reason: fmt.Sprintf("%.0f%% of %v bytes of source code",
+			float64(sizes[lang])/float64(total)*100, total,
+		),
+	}
+}
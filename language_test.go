@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_detectLanguage(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name    string
+		files   map[string]int
+		expLang string
+	}{
+		{
+			"Manifest",
+			map[string]int{"go.mod": 10, "main.py": 1000},
+			"go",
+		},
+		{
+			"TypeScriptManifest",
+			map[string]int{"package.json": 10, "tsconfig.json": 10},
+			"typescript",
+		},
+		{
+			"Census",
+			map[string]int{"a.rb": 100, "b.rb": 100, "c.py": 150},
+			"ruby",
+		},
+		{
+			"SkipsVendored",
+			map[string]int{"main.c": 100, "node_modules/dep/index.js": 5000},
+			"c",
+		},
+		{
+			"Unknown",
+			map[string]int{"README.md": 100},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "sail-lang")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			for name, size := range test.files {
+				path := filepath.Join(dir, name)
+				err = os.MkdirAll(filepath.Dir(path), 0750)
+				require.NoError(t, err)
+
+				err = ioutil.WriteFile(path, []byte(strings.Repeat("a", size)), 0640)
+				require.NoError(t, err)
+			}
+
+			det := detectLanguage(dir)
+			assert.Equal(t, test.expLang, det.lang)
+			assert.NotEmpty(t, det.reason)
+		})
+	}
+}
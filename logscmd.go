@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+)
+
+type logscmd struct {
+	gf *globalFlags
+
+	hook string
+}
+
+func (c *logscmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "logs",
+		Usage: "[flags] <repo>",
+		Desc:  `Shows the output and exit status of a project's lifecycle hooks.`,
+	}
+}
+
+func (c *logscmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.StringVar(&c.hook, "hook", "", fmt.Sprintf("Only show the output of this hook, one of %v.", strings.Join(hookNames, ", ")))
+}
+
+func (c *logscmd) Run(fl *flag.FlagSet) {
+	proj := c.gf.project(schemaPrefs{}, fl)
+	c.gf.ensureDockerDaemon()
+	proj.requireRunning()
+
+	names := hookNames
+	if c.hook != "" {
+		if _, ok := defaultHooks[c.hook]; !ok {
+			flog.Fatal("unknown hook %q, must be one of %v", c.hook, strings.Join(hookNames, ", "))
+		}
+		names = []string{c.hook}
+	}
+
+	for _, name := range names {
+		out, err := dockutil.Exec(proj.cntName(), "cat", hookLogPath(name)).Output()
+		if err != nil {
+			// The hook hasn't run in this container.
+			if len(names) == 1 {
+				flog.Info("%v hasn't run", name)
+			}
+			continue
+		}
+
+		status := "running"
+		exit, err := dockutil.Exec(proj.cntName(), "cat", hookExitPath(name)).Output()
+		if err == nil {
+			status = "exited with status " + strings.TrimSpace(string(exit))
+		}
+
+		fmt.Printf("==> %v (%v) <==\n", name, status)
+		os.Stdout.Write(out)
+	}
+}
@@ -57,6 +57,10 @@ func listProjects() ([]projectInfo, error) {
 			flog.Error("container %v doesn't have a name.", cnt.ID)
 			continue
 		}
+		// Containers kept by sail edit for rolling back aren't projects.
+		if isPreviousCnt(dockerName, cnt.Labels) {
+			continue
+		}
 		info.name = toSailName(dockerName)
 
 		url, err := proxyURL(dockerName)
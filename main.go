@@ -66,7 +66,24 @@ func (r rootCmd) Subcommands() []cli.Command {
 		&editcmd{gf: &r.globalFlags},
 		&lscmd{},
 		&rmcmd{gf: &r.globalFlags},
-		&proxycmd{},
+		&stopcmd{gf: &r.globalFlags},
+		&logscmd{gf: &r.globalFlags},
+		&snapshotcmd{gf: &r.globalFlags},
+		&restorecmd{gf: &r.globalFlags},
+		&exportcmd{gf: &r.globalFlags},
+		&importcmd{gf: &r.globalFlags},
+		&proxycmd{gf: &r.globalFlags},
+		&portscmd{gf: &r.globalFlags},
+		&forwardcmd{gf: &r.globalFlags},
+		&daemoncmd{gf: &r.globalFlags},
+		&cacmd{gf: &r.globalFlags},
+		&configcmd{gf: &r.globalFlags},
+		&gitCredentialCmd{},
+		&forwardListenCmd{},
+		&forwardAttachCmd{},
+		&doctorcmd{gf: &r.globalFlags},
+		&inspectcmd{gf: &r.globalFlags},
+		&codeservercmd{gf: &r.globalFlags},
 		extHostCmd,
 		&chromeExtInstallCmd{cmd: extHostCmd},
 		&versioncmd{},
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// The proxy forwards requests to other ports inside of the container, e.g
+// for dev servers, when they're made to /port/<n>/ or to <n>.<project>.localhost.
+const portPathPrefix = "/port/"
+
+// containerPortsOnHost reports whether ports listened on inside of containers
+// are reachable on the host. On macOS containers don't use host networking.
+func containerPortsOnHost() bool {
+	// See justification in `runner.hostConfig`.
+	return runtime.GOOS != "darwin"
+}
+
+// dialContainer connects to port inside of the container named cntName.
+func dialContainer(ctx context.Context, cntName, port string) (net.Conn, error) {
+	if containerPortsOnHost() {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", net.JoinHostPort("localhost", port))
+	}
+
+	return execDial(cntName, port)
+}
+
+// execConn is a connection relayed through the stdin and stdout of a command.
+type execConn struct {
+	cmd *exec.Cmd
+	io.Reader
+	stdin io.WriteCloser
+}
+
+func (c *execConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *execConn) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+type execAddr struct{}
+
+func (execAddr) Network() string { return "exec" }
+func (execAddr) String() string  { return "exec" }
+
+func (c *execConn) LocalAddr() net.Addr                { return execAddr{} }
+func (c *execConn) RemoteAddr() net.Addr               { return execAddr{} }
+func (c *execConn) SetDeadline(t time.Time) error      { return nil }
+func (c *execConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *execConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// validPort reports whether port is a TCP port number.
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536 && strconv.Itoa(n) == port
+}
+
+// portFromHost returns the port requested through a host of the
+// form <n>.<project>.localhost.
+func portFromHost(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.HasSuffix(host, ".localhost") {
+		return "", false
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 || !validPort(labels[0]) {
+		return "", false
+	}
+	return labels[0], true
+}
+
+// portFromPath returns the port requested through a path of the form
+// /port/<n>/..., along with the path it's forwarded as.
+func portFromPath(path string) (port, rest string, ok bool) {
+	if !strings.HasPrefix(path, portPathPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, portPathPrefix), "/", 2)
+	if !validPort(parts[0]) {
+		return "", "", false
+	}
+	if len(parts) == 1 {
+		return parts[0], "", true
+	}
+	return parts[0], "/" + parts[1], true
+}
+
+// portURL returns the URL of port inside of the container proxied on u.
+// Projects served on a subdomain of localhost get one per port.
+func portURL(u, port string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(pu.Hostname(), ".localhost") {
+		pu.Host = port + "." + pu.Host
+		return pu.String(), nil
+	}
+	pu.Path = strings.TrimSuffix(pu.Path, "/") + portPathPrefix + port
+	return pu.String(), nil
+}
+
+// containerPorts returns the ports listened on inside of the container
+// named cntName, except code-server's own, with the URL they're proxied on
+// by the proxy serving the project on u.
+func containerPorts(cntName, u string) ([]sailapi.Port, error) {
+	ls, err := dockutil.Listeners(cntName)
+	if err != nil {
+		return nil, err
+	}
+
+	ports := make([]sailapi.Port, 0, len(ls))
+	for _, l := range ls {
+		if l.Program == "code-server" {
+			continue
+		}
+		pu, err := portURL(u, l.Port)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, sailapi.Port{
+			Port:    l.Port,
+			Addr:    l.Addr,
+			Program: l.Program,
+			URL:     pu,
+		})
+	}
+	return ports, nil
+}
+
+// portTransport returns a transport that connects to ports inside
+// of the container named cntName.
+func portTransport(cntName string) http.RoundTripper {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialContainer(ctx, cntName, port)
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     time.Minute,
+	}
+}
+
+// forwardPort proxies r to port inside of the container. Websockets are
+// proxied as well. prefix is the path the port is served under, if any.
+func (p *proxy) forwardPort(w http.ResponseWriter, r *http.Request, port, prefix string) {
+	if !p.ensureRunning(w, r) {
+		return
+	}
+
+	rp := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort("localhost", port),
+	})
+	rp.Transport = p.portTransport
+	director := rp.Director
+	rp.Director = func(req *http.Request) {
+		director(req)
+		stripProxyAuth(req.Header)
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		if prefix != "" {
+			req.Header.Set("X-Forwarded-Prefix", prefix)
+		}
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		http.Error(w, xerrors.Errorf("failed to reach port %v in %v: %w", port, p.cntName, err).Error(), http.StatusBadGateway)
+	}
+	rp.ServeHTTP(w, r)
+}
+
+// routePorts forwards requests for other ports inside of the
+// container and passes the rest to h.
+func (p *proxy) routePorts(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if port, ok := portFromHost(r.Host); ok {
+			p.forwardPort(w, r, port, "")
+			return
+		}
+
+		port, rest, ok := portFromPath(r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if rest == "" {
+			// Relative URLs only resolve correctly under the trailing slash.
+			w.Header().Set("Location", port+"/")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		p.forwardPort(w, r2, port, portPathPrefix+port)
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_portFromHost(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		host string
+		port string
+		ok   bool
+	}{
+		{"3000.cdr--sail.localhost:7080", "3000", true},
+		{"8080.cdr--sail.localhost", "8080", true},
+		{"cdr--sail.localhost:7080", "", false},
+		{"3000.localhost:7080", "", false},
+		{"70000.cdr--sail.localhost:7080", "", false},
+		{"192.168.1.20:7080", "", false},
+		{"3000.example.com", "", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.host, func(t *testing.T) {
+			t.Parallel()
+
+			port, ok := portFromHost(tc.host)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.port, port)
+		})
+	}
+}
+
+func Test_portFromPath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		path string
+		port string
+		rest string
+		ok   bool
+	}{
+		{"/port/3000/static/main.js", "3000", "/static/main.js", true},
+		{"/port/3000/", "3000", "/", true},
+		{"/port/3000", "3000", "", true},
+		{"/port/03000/", "", "", false},
+		{"/port/abc/", "", "", false},
+		{"/static/main.js", "", "", false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			port, rest, ok := portFromPath(tc.path)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.port, port)
+			assert.Equal(t, tc.rest, rest)
+		})
+	}
+}
+
+func Test_portURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		url string
+		exp string
+	}{
+		{"http://cdr--sail.localhost:7080", "http://3000.cdr--sail.localhost:7080"},
+		{"https://cdr--sail.localhost:7443", "https://3000.cdr--sail.localhost:7443"},
+		{"http://127.0.0.1:7123", "http://127.0.0.1:7123/port/3000"},
+		{"http://localhost:7080/p/cdr_sail/", "http://localhost:7080/p/cdr_sail/port/3000"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.url, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := portURL(tc.url, "3000")
+			require.NoError(t, err)
+			assert.Equal(t, tc.exp, u)
+		})
+	}
+}
+
+func Test_proxyRoutePorts(t *testing.T) {
+	t.Parallel()
+
+	if !containerPortsOnHost() {
+		t.Skip("container ports aren't reachable on the host")
+	}
+
+	dev := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Forwarded-Prefix")))
+	}))
+	defer dev.Close()
+	du, err := url.Parse(dev.URL)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(du.Host)
+	require.NoError(t, err)
+
+	p := newProxy("http://127.0.0.1:7123", "cdr_sail", &proxyAuth{})
+	h := p.routePorts(http.NotFoundHandler())
+
+	tests := []struct {
+		name string
+		url  string
+		code int
+		body string
+	}{
+		{"Path", "http://127.0.0.1:7123/port/" + port + "/static/main.js", http.StatusOK, "/static/main.js /port/" + port},
+		{"Host", "http://" + port + ".cdr--sail.localhost:7123/static/main.js", http.StatusOK, "/static/main.js "},
+		{"TrailingSlash", "http://127.0.0.1:7123/port/" + port, http.StatusFound, ""},
+		{"CodeServer", "http://127.0.0.1:7123/static/main.js", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		// The subtests aren't parallel so they run before dev is closed.
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tc.url, nil))
+
+			resp := w.Result()
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tc.code, resp.StatusCode)
+			assert.Equal(t, tc.body, string(body))
+		})
+	}
+
+	t.Run("StripsToken", func(t *testing.T) {
+		var got http.Header
+		creds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header
+		}))
+		defer creds.Close()
+		cu, err := url.Parse(creds.URL)
+		require.NoError(t, err)
+		_, port, err := net.SplitHostPort(cu.Host)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest("GET", "http://127.0.0.1:7123/port/"+port+"/", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Cookie", "session=abc; sail_token_cdr_sail=secret; theme=dark")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Empty(t, got.Get("Authorization"))
+		assert.Equal(t, "session=abc; theme=dark", got.Get("Cookie"))
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/xnet"
+)
+
+type portscmd struct {
+	gf *globalFlags
+
+	forward bool
+}
+
+func (c *portscmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "ports",
+		Usage: "[flags] <repo>",
+		Desc: `Lists the ports listened on inside of a project's container and the URLs
+they're proxied on. With -forward, it keeps watching for newly opened ports and
+forwards each to the same port on localhost.`,
+	}
+}
+
+func (c *portscmd) RegisterFlags(fl *flag.FlagSet) {
+	fl.BoolVar(&c.forward, "forward", false, "Keep watching and forward newly opened ports to localhost.")
+}
+
+// portInfo describes a port listened on inside of a project's container.
+type portInfo struct {
+	dockutil.Listener
+	url string
+}
+
+// listPorts returns the ports listened on inside of the container named
+// cntName, except code-server's own.
+func listPorts(cntName string) ([]portInfo, error) {
+	u, err := proxyURL(cntName)
+	if err != nil {
+		return nil, err
+	}
+	token, err := proxyToken(cntName)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get proxy token: %w", err)
+	}
+
+	ports, err := containerPorts(cntName, u)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]portInfo, len(ports))
+	for i, p := range ports {
+		infos[i] = portInfo{
+			Listener: dockutil.Listener{Port: p.Port, Addr: p.Addr, Program: p.Program},
+			url:      tokenURL(p.URL, token),
+		}
+	}
+	return infos, nil
+}
+
+func (c *portscmd) Run(fl *flag.FlagSet) {
+	proj := c.gf.project(schemaPrefs{}, fl)
+	c.gf.ensureDockerDaemon()
+	proj.requireRunning()
+
+	err := ensureProxy(c.gf.configPath, proj.cntName())
+	if err != nil {
+		flog.Fatal("failed to start proxy: %v", err)
+	}
+
+	ports, err := listPorts(proj.cntName())
+	if err != nil {
+		flog.Fatal("failed to list ports: %v", err)
+	}
+
+	if !c.forward {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintf(tw, "port\tprogram\turl\n")
+		for _, p := range ports {
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", p.Port, p.Program, p.url)
+		}
+		tw.Flush()
+		return
+	}
+
+	f := &portForwarder{
+		cntName:   proj.cntName(),
+		listeners: make(map[string]net.Listener),
+	}
+	for {
+		f.update(ports)
+
+		time.Sleep(time.Second)
+		ports, err = listPorts(proj.cntName())
+		if err != nil {
+			flog.Fatal("failed to list ports: %v", err)
+		}
+	}
+}
+
+// portForwarder forwards ports opened inside of a container to localhost.
+type portForwarder struct {
+	cntName string
+	// listeners holds the forwarded ports, or nil for ports that are
+	// reachable on the host without forwarding.
+	listeners map[string]net.Listener
+}
+
+// update forwards the ports that were opened and stops
+// forwarding those that were closed.
+func (f *portForwarder) update(ports []portInfo) {
+	open := make(map[string]struct{}, len(ports))
+	for _, p := range ports {
+		open[p.Port] = struct{}{}
+		if _, ok := f.listeners[p.Port]; ok {
+			continue
+		}
+
+		l, err := f.forward(p.Port)
+		if err != nil {
+			flog.Error("failed to forward port %v (%v): %v", p.Port, p.Program, err)
+		} else {
+			flog.Info("port %v (%v) opened on localhost:%v and %v", p.Port, p.Program, p.Port, p.url)
+		}
+		f.listeners[p.Port] = l
+	}
+
+	for port, l := range f.listeners {
+		if _, ok := open[port]; ok {
+			continue
+		}
+		if l != nil {
+			l.Close()
+		}
+		delete(f.listeners, port)
+		flog.Info("port %v closed", port)
+	}
+}
+
+// forward listens on port on localhost and relays connections to it
+// inside of the container. It returns nil if the port is already
+// reachable on the host.
+func (f *portForwarder) forward(port string) (net.Listener, error) {
+	if containerPortsOnHost() {
+		return nil, nil
+	}
+	if !xnet.PortFree(port) {
+		return nil, xerrors.Errorf("localhost:%v is in use on the host", port)
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.relay(conn, port)
+		}
+	}()
+	return l, nil
+}
+
+func (f *portForwarder) relay(conn net.Conn, port string) {
+	defer conn.Close()
+
+	cnt, err := dialContainer(context.Background(), f.cntName, port)
+	if err != nil {
+		flog.Error("%v", err)
+		return
+	}
+	defer cnt.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(cnt, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, cnt)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// Readiness probes declare when a project is ready to be used, beyond
+// code-server having started. They're declared with image labels of the form
+// `probe.<name>.<kind>`, e.g
+//
+//	LABEL probe.db.tcp="localhost:5432"
+//	LABEL probe.db.timeout="1m"
+//
+// or in the config's [probes] table. Probes in the config replace those
+// of the same name from the image.
+const probeLabelPrefix = "probe."
+
+// probesLabel holds the JSON encoded probes of the container so that
+// they can be checked by the proxy.
+const probesLabel = sailLabel + ".probes"
+
+const (
+	// defaultProbeTimeout is how long a probe is waited on if it doesn't set a timeout.
+	defaultProbeTimeout = time.Minute * 2
+	// probeInterval is the time between checks of a probe that isn't ready.
+	probeInterval = time.Second
+	// probeCheckTimeout limits a single check of a probe.
+	probeCheckTimeout = time.Second * 10
+)
+
+// probe checks that a service inside of the container is ready.
+// Exactly one of Command, HTTP or TCP must be set.
+type probe struct {
+	// Command is a bash command run in the project directory
+	// that exits 0 when the service is ready.
+	Command string `toml:"command" json:"command,omitempty"`
+	// HTTP is a URL that responds with a 2xx or 3xx status when the service is ready.
+	HTTP string `toml:"http" json:"http,omitempty"`
+	// TCP is a host:port address that accepts connections when the service is ready.
+	TCP string `toml:"tcp" json:"tcp,omitempty"`
+	// Timeout is how long to wait for the probe, e.g "30s".
+	Timeout string `toml:"timeout" json:"timeout,omitempty"`
+}
+
+// validate checks that the probe is well formed.
+func (p probe) validate() error {
+	set := 0
+	for _, v := range []string{p.Command, p.HTTP, p.TCP} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return xerrors.New("exactly one of command, http or tcp must be set")
+	}
+
+	if p.TCP != "" {
+		_, _, err := net.SplitHostPort(p.TCP)
+		if err != nil {
+			return xerrors.Errorf("invalid tcp address %q: %w", p.TCP, err)
+		}
+	}
+	if p.HTTP != "" && !strings.HasPrefix(p.HTTP, "http://") && !strings.HasPrefix(p.HTTP, "https://") {
+		return xerrors.Errorf("invalid http url %q: must start with http:// or https://", p.HTTP)
+	}
+
+	_, err := p.timeout()
+	return err
+}
+
+// timeout returns how long to wait for the probe to be ready.
+func (p probe) timeout() (time.Duration, error) {
+	if p.Timeout == "" {
+		return defaultProbeTimeout, nil
+	}
+	d, err := time.ParseDuration(p.Timeout)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid timeout %q: %w", p.Timeout, err)
+	}
+	return d, nil
+}
+
+// script returns the bash script that checks the probe inside of the container.
+func (p probe) script() string {
+	var check string
+	switch {
+	case p.Command != "":
+		check = "bash -c " + shellQuote(p.Command)
+	case p.HTTP != "":
+		url := shellQuote(p.HTTP)
+		check = fmt.Sprintf(`if command -v curl > /dev/null; then curl -fsS -o /dev/null %[1]v; else wget -q -O /dev/null %[1]v; fi`, url)
+	case p.TCP != "":
+		host, port, _ := net.SplitHostPort(p.TCP)
+		check = fmt.Sprintf("exec 3<>/dev/tcp/%v/%v", host, port)
+	}
+	return fmt.Sprintf("timeout %v bash -c %v", probeCheckTimeout.Seconds(), shellQuote(check))
+}
+
+// check runs the probe once inside of the container.
+func (p probe) check(cntName, dir string) error {
+	out, err := dockutil.ExecDir(cntName, dir, "bash", "-c", p.script()).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			return err
+		}
+		return xerrors.Errorf("%v: %w", msg, err)
+	}
+	return nil
+}
+
+// probesFromLabels reads the probes declared by image labels.
+func probesFromLabels(labels map[string]string) (map[string]probe, error) {
+	probes := make(map[string]probe)
+	for k, v := range labels {
+		if !strings.HasPrefix(k, probeLabelPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(k, probeLabelPrefix), ".", 2)
+		if len(parts) != 2 {
+			return nil, xerrors.Errorf("invalid probe label %q: expected probe.<name>.<field>", k)
+		}
+
+		p := probes[parts[0]]
+		switch parts[1] {
+		case "command":
+			p.Command = v
+		case "http":
+			p.HTTP = v
+		case "tcp":
+			p.TCP = v
+		case "timeout":
+			p.Timeout = v
+		default:
+			return nil, xerrors.Errorf("invalid probe label %q: unknown field %q", k, parts[1])
+		}
+		probes[parts[0]] = p
+	}
+	return probes, nil
+}
+
+// mergeProbes returns the probes of the image with those of the config
+// replacing any of the same name.
+func mergeProbes(image, conf map[string]probe) (map[string]probe, error) {
+	probes := make(map[string]probe, len(image)+len(conf))
+	for name, p := range image {
+		probes[name] = p
+	}
+	for name, p := range conf {
+		probes[name] = p
+	}
+
+	for name, p := range probes {
+		err := p.validate()
+		if err != nil {
+			return nil, xerrors.Errorf("invalid probe %v: %w", name, err)
+		}
+	}
+	return probes, nil
+}
+
+// containerProbes returns the probes stored on the container
+// along with the directory they're run in.
+func containerProbes(cntName string) (probes map[string]probe, dir string, _ error) {
+	cli := dockerClient()
+	defer cli.Close()
+
+	cnt, err := cli.ContainerInspect(context.Background(), cntName)
+	if err != nil {
+		return nil, "", xerrors.Errorf("failed to inspect %v: %w", cntName, err)
+	}
+	dir = resolvePath(containerHome, cnt.Config.Labels[projectDirLabel])
+
+	label, ok := cnt.Config.Labels[probesLabel]
+	if !ok {
+		return nil, dir, nil
+	}
+	err = json.Unmarshal([]byte(label), &probes)
+	if err != nil {
+		return nil, "", xerrors.Errorf("failed to decode %v label: %w", probesLabel, err)
+	}
+	return probes, dir, nil
+}
+
+// sortedProbeNames returns the names of probes in a stable order.
+func sortedProbeNames(probes map[string]probe) []string {
+	names := make([]string, 0, len(probes))
+	for name := range probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// waitReady waits until all of the container's probes are ready, logging
+// their status as they go. It fails if any probe doesn't become ready in time.
+func waitReady(cntName string) error {
+	probes, dir, err := containerProbes(cntName)
+	if err != nil {
+		return err
+	}
+	if len(probes) == 0 {
+		return nil
+	}
+
+	flog.Info("waiting for %v to be ready", strings.Join(sortedProbeNames(probes), ", "))
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	for name, p := range probes {
+		wg.Add(1)
+		go func(name string, p probe) {
+			defer wg.Done()
+
+			err := waitProbe(cntName, dir, name, p)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err.Error())
+				mu.Unlock()
+			}
+		}(name, p)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return xerrors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// waitProbe checks the probe until it's ready or its timeout passes.
+func waitProbe(cntName, dir, name string, p probe) error {
+	timeout, err := p.timeout()
+	if err != nil {
+		return xerrors.Errorf("probe %v: %w", name, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	lastReport := start
+	for {
+		err = p.check(cntName, dir)
+		if err == nil {
+			flog.Success("%v ready after %v", name, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+
+		if time.Since(lastReport) >= time.Second*10 {
+			flog.Info("still waiting for %v: %v", name, err)
+			lastReport = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return xerrors.Errorf("probe %v not ready after %v: %w", name, timeout, err)
+		case <-time.After(probeInterval):
+		}
+	}
+}
+
+// checkProbes checks each of the container's probes once.
+func checkProbes(cntName string) ([]sailapi.Probe, error) {
+	probes, dir, err := containerProbes(cntName)
+	if err != nil {
+		return nil, err
+	}
+
+	names := sortedProbeNames(probes)
+	statuses := make([]sailapi.Probe, len(names))
+
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+
+			statuses[i] = sailapi.Probe{Name: name, Ready: true}
+			err := probes[name].check(cntName, dir)
+			if err != nil {
+				statuses[i].Ready = false
+				statuses[i].Error = err.Error()
+			}
+		}(i, name)
+	}
+	wg.Wait()
+
+	return statuses, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_probesFromLabels(t *testing.T) {
+	t.Parallel()
+
+	probes, err := probesFromLabels(map[string]string{
+		"probe.db.tcp":         "localhost:5432",
+		"probe.db.timeout":     "1m",
+		"probe.gopls.command":  "pgrep gopls",
+		"on_start":             "make",
+		"share.go_mod":         "~/go/pkg/mod:~/go/pkg/mod",
+		"probe.web.http":       "http://localhost:3000/healthz",
+		"com.coder.sail.probe": "ignored",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]probe{
+		"db":    {TCP: "localhost:5432", Timeout: "1m"},
+		"gopls": {Command: "pgrep gopls"},
+		"web":   {HTTP: "http://localhost:3000/healthz"},
+	}, probes)
+
+	_, err = probesFromLabels(map[string]string{"probe.db.port": "5432"})
+	require.Error(t, err)
+	_, err = probesFromLabels(map[string]string{"probe.db": "localhost:5432"})
+	require.Error(t, err)
+}
+
+func Test_mergeProbes(t *testing.T) {
+	t.Parallel()
+
+	probes, err := mergeProbes(
+		map[string]probe{
+			"db":  {TCP: "localhost:5432"},
+			"web": {HTTP: "http://localhost:3000"},
+		},
+		map[string]probe{
+			"db": {TCP: "localhost:5433", Timeout: "30s"},
+		},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]probe{
+		"db":  {TCP: "localhost:5433", Timeout: "30s"},
+		"web": {HTTP: "http://localhost:3000"},
+	}, probes)
+
+	_, err = mergeProbes(nil, map[string]probe{"both": {TCP: "localhost:1", Command: "true"}})
+	require.Error(t, err)
+}
+
+func Test_probeValidate(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		name   string
+		probe  probe
+		expErr bool
+	}{
+		{"Command", probe{Command: "true"}, false},
+		{"None", probe{}, true},
+		{"BadTCP", probe{TCP: "5432"}, true},
+		{"BadHTTP", probe{HTTP: "localhost:3000"}, true},
+		{"BadTimeout", probe{Command: "true", Timeout: "1 minute"}, true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := test.probe.validate()
+			if test.expErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	d, err := probe{Command: "true"}.timeout()
+	require.NoError(t, err)
+	assert.Equal(t, defaultProbeTimeout, d)
+	d, err = probe{Command: "true", Timeout: "90s"}.timeout()
+	require.NoError(t, err)
+	assert.Equal(t, time.Second*90, d)
+}
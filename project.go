@@ -15,6 +15,7 @@ import (
 	"go.coder.com/sail/internal/browserapp"
 	"go.coder.com/sail/internal/codeserver"
 	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/sailapi"
 	"go.coder.com/sail/internal/xexec"
 )
 
@@ -27,8 +28,12 @@ const (
 
 // project represents a sail project.
 type project struct {
+	// conf is the effective config of the project, the global
+	// config merged with any per-project overrides.
 	conf config
-	repo repo
+	// confSources records where each value in conf came from.
+	confSources configSources
+	repo        repo
 }
 
 func (p *project) pathName() string {
@@ -141,6 +146,16 @@ func (p *project) buildImage() (string, bool, error) {
 		return "", false, nil
 	}
 
+	imageID, err := p.buildDockerfile(path)
+	if err != nil {
+		return "", false, err
+	}
+	return imageID, true, nil
+}
+
+// buildDockerfile builds the Dockerfile at path with the project
+// directory as its context.
+func (p *project) buildDockerfile(path string) (string, error) {
 	// Docker image names must be completely lowercase.
 	imageID := strings.ToLower(p.repo.DockerName())
 
@@ -150,39 +165,50 @@ func (p *project) buildImage() (string, bool, error) {
 	flog.Info("running %v", cmdStr)
 	cmd := xexec.Fmt(cmdStr)
 	xexec.Attach(cmd)
-	err = cmd.Run()
+	doneSteps := rebuildEvents.attachBuild(cmd, sailapi.PhaseBuild)
+	err := cmd.Run()
+	doneSteps()
 	if err != nil {
-		return "", false, xerrors.Errorf("failed to build: %w", err)
+		return "", xerrors.Errorf("failed to build: %w", err)
 	}
-	return imageID, true, nil
+	return imageID, nil
 }
 
 func fmtImage(img string) string {
 	return fmt.Sprintf("codercom/ubuntu-dev-%s:latest", img)
 }
 
+// defaultLanguageImages maps languages to the images used for them when the
+// config doesn't provide its own mapping through language_images.
+var defaultLanguageImages = map[string]string{
+	"go":         fmtImage("go"),
+	"javascript": fmtImage("node12"),
+	"typescript": fmtImage("node12"),
+	"python":     fmtImage("python3.7"),
+	"c":          fmtImage("gcc8"),
+	"c++":        fmtImage("gcc8"),
+	"java":       fmtImage("openjdk12"),
+	"ruby":       fmtImage("ruby2.6"),
+}
+
 // defaultRepoImage returns a base image suitable for development with the
-// repo's language. If the repo language isn't able to be determined, this
-// returns the default image from the sail config.
-func (p *project) defaultRepoImage() string {
-	lang := p.repo.language()
-
-	switch strings.ToLower(lang) {
-	case "go":
-		return fmtImage("go")
-	case "javascript", "typescript":
-		return fmtImage("node12")
-	case "python":
-		return fmtImage("python3.7")
-	case "c", "c++":
-		return fmtImage("gcc8")
-	case "java":
-		return fmtImage("openjdk12")
-	case "ruby":
-		return fmtImage("ruby2.6")
-	default:
-		return p.conf.DefaultImage
+// repo's language, along with the detection that chose it.
+// The language is detected from the local clone, so the project
+// must exist on disk. If the repo language isn't able to be determined
+// or has no image mapped to it, this returns the default image from the sail config.
+func (p *project) defaultRepoImage() (string, languageDetection) {
+	det := detectLanguage(p.localDir())
+	if det.lang == "" {
+		return p.conf.DefaultImage, det
+	}
+
+	if image, ok := p.conf.LanguageImages[det.lang]; ok {
+		return image, det
 	}
+	if image, ok := defaultLanguageImages[det.lang]; ok {
+		return image, det
+	}
+	return p.conf.DefaultImage, det
 }
 
 func ensureImage(image string) error {
@@ -245,24 +271,50 @@ func (p *project) readCodeServerLog() ([]byte, error) {
 	return out, nil
 }
 
+// defaultOnlineTimeout is how long to wait for code-server to start
+// if the config doesn't set online_timeout.
+const defaultOnlineTimeout = time.Second * 10
+
+// onlineTimeout returns how long to wait for code-server to start.
+func (p *project) onlineTimeout() (time.Duration, error) {
+	if p.conf.OnlineTimeout == "" {
+		return defaultOnlineTimeout, nil
+	}
+	d, err := time.ParseDuration(p.conf.OnlineTimeout)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid online_timeout: %w", err)
+	}
+	return d, nil
+}
+
 // waitOnline waits until code-server has bound to it's port.
 func (p *project) waitOnline() error {
+	timeout, err := p.onlineTimeout()
+	if err != nil {
+		return err
+	}
+	return waitOnline(p.cntName(), timeout)
+}
+
+// waitOnline waits until code-server has bound to it's port
+// in the container named cntName.
+func waitOnline(cntName string, timeout time.Duration) error {
 	cli := dockerClient()
 	defer cli.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	for ctx.Err() == nil {
-		cnt, err := cli.ContainerInspect(ctx, p.cntName())
+		cnt, err := cli.ContainerInspect(ctx, cntName)
 		if err != nil {
 			return err
 		}
 		if !cnt.State.Running {
-			return xerrors.Errorf("container %v not running", p.cntName())
+			return xerrors.Errorf("container %v not running", cntName)
 		}
 
-		_, err = codeserver.PID(p.cntName())
+		_, err = codeserver.PID(cntName)
 		if err == nil {
 			return nil
 		}
@@ -270,22 +322,64 @@ func (p *project) waitOnline() error {
 		time.Sleep(time.Millisecond * 100)
 	}
 
-	return ctx.Err()
+	return xerrors.Errorf("code-server didn't start within %v, see online_timeout in the config", timeout)
 }
 
-func (p *project) open() error {
+// startContainer starts the container named cntName and runs its on_start hook.
+func startContainer(cntName string) error {
 	cli := dockerClient()
 	defer cli.Close()
 
-	err := cli.ContainerStart(context.Background(), p.cntName(), types.ContainerStartOptions{})
+	err := cli.ContainerStart(context.Background(), cntName, types.ContainerStartOptions{})
 	if err != nil {
 		return xerrors.Errorf("failed to start container: %w", err)
 	}
+	return runHook(cntName, onStartHook)
+}
+
+// stopContainer runs the on_stop hook of the container named cntName and stops it.
+func stopContainer(cntName string) error {
+	runOnStop(cntName)
+
+	cli := dockerClient()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	err := cli.ContainerStop(ctx, cntName, dockutil.DurationPtr(time.Second*10))
+	if err != nil {
+		return xerrors.Errorf("failed to stop %v: %w", cntName, err)
+	}
+	return nil
+}
+
+func (p *project) open(configPath string) error {
+	running, err := p.running()
+	if err != nil {
+		return err
+	}
+	if !running {
+		err = startContainer(p.cntName())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ensureProxy(configPath, p.cntName())
+	if err != nil {
+		return err
+	}
 
 	u, err := p.proxyURL()
 	if err != nil {
 		return err
 	}
+	token, err := proxyToken(p.cntName())
+	if err != nil {
+		return xerrors.Errorf("failed to get proxy token: %w", err)
+	}
+	u = tokenURL(u, token)
 
 	if os.Getenv("DISPLAY") == "" {
 		flog.Info("please visit %v", u)
@@ -305,5 +399,12 @@ func (p *project) delete() error {
 	cli := dockerClient()
 	defer cli.Close()
 
+	runOnStop(p.cntName())
+
+	err := removeIfExists(context.Background(), cli, previousCntName(p.cntName()))
+	if err != nil {
+		return xerrors.Errorf("failed to remove previous container: %w", err)
+	}
+
 	return dockutil.StopRemove(context.Background(), cli, p.cntName())
 }
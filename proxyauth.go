@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// Requests to a project's proxy must carry the project's token, either in a
+// cookie or as a bearer token. The browser gets the cookie by opening the
+// project's URL with the token as the sail_token query parameter, which is
+// then removed from the URL with a redirect.
+const (
+	proxyTokenParam        = "sail_token"
+	proxyTokenCookiePrefix = "sail_token_"
+	proxyPasswordField     = "sail_password"
+)
+
+// proxyTokenPath returns the file holding the proxy token of the
+// project container named cntName.
+func proxyTokenPath(cntName string) string {
+	return filepath.Join(metaRoot(), cntName, "proxy_token")
+}
+
+// proxyToken returns the proxy token of the project container named
+// cntName, generating it if it doesn't exist yet.
+func proxyToken(cntName string) (string, error) {
+	return readToken(proxyTokenPath(cntName))
+}
+
+// daemonTokenPath returns the file holding the token that requests to the
+// daemon's own API must carry.
+func daemonTokenPath() string {
+	return filepath.Join(metaRoot(), "daemon_token")
+}
+
+// daemonToken returns the token of the daemon's own API, generating it
+// if it doesn't exist yet.
+func daemonToken() (string, error) {
+	return readToken(daemonTokenPath())
+}
+
+// readToken returns the token stored at path, generating it if it
+// doesn't exist yet.
+func readToken(path string) (string, error) {
+	byt, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(byt)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		// Another process created it first.
+		return readToken(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(token + "\n")
+	if err != nil {
+		return "", xerrors.Errorf("failed to write %v: %w", path, err)
+	}
+	return token, f.Close()
+}
+
+// bearerAuthorized reports whether r carries token in its Authorization header.
+func bearerAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") && secureEqual(strings.TrimPrefix(auth, "Bearer "), token)
+}
+
+// tokenURL returns the project URL u with token set so
+// opening it in a browser logs in.
+func tokenURL(u, token string) string {
+	return u + "/?" + url.Values{proxyTokenParam: {token}}.Encode()
+}
+
+// proxyAuth authenticates requests to the proxy of a project.
+type proxyAuth struct {
+	cntName string
+	token   string
+	// password allows logging in with a password instead of the token
+	// if it's set.
+	password string
+}
+
+func newProxyAuth(cntName, password string) (*proxyAuth, error) {
+	token, err := proxyToken(cntName)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get proxy token: %w", err)
+	}
+	return &proxyAuth{
+		cntName:  cntName,
+		token:    token,
+		password: password,
+	}, nil
+}
+
+// cookieName is specific to the project as cookies
+// are shared by every port of a host.
+func (a *proxyAuth) cookieName() string {
+	return proxyTokenCookiePrefix + a.cntName
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authorized reports whether r carries the project's token.
+func (a *proxyAuth) authorized(r *http.Request) bool {
+	if c, err := r.Cookie(a.cookieName()); err == nil && secureEqual(c.Value, a.token) {
+		return true
+	}
+	return bearerAuthorized(r, a.token)
+}
+
+// login sets the token cookie and redirects to the URL of the request
+// without the token parameter.
+func (a *proxyAuth) login(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.cookieName(),
+		Value:    a.token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	w.Header().Set("Location", loginRedirect(r.URL))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// loginRedirect returns u without the token parameter as a reference relative
+// to u, as the proxy may be served under a path prefix it doesn't know about.
+func loginRedirect(u *url.URL) string {
+	q := u.Query()
+	q.Del(proxyTokenParam)
+
+	ref := "./" + u.Path[strings.LastIndex(u.Path, "/")+1:]
+	if len(q) > 0 {
+		ref += "?" + q.Encode()
+	}
+	return ref
+}
+
+var loginTmpl = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>sail - {{ .Project }}</title></head>
+<body>
+<form method="POST">
+	<p>Log in to {{ .Project }}</p>
+	{{ if .Failed }}<p>Wrong password.</p>{{ end }}
+	<input type="password" name="{{ .Field }}" autofocus>
+	<input type="submit" value="Log in">
+</form>
+</body>
+</html>
+`))
+
+// passwordLogin serves the login form and checks the password posted to it.
+func (a *proxyAuth) passwordLogin(w http.ResponseWriter, r *http.Request) {
+	failed := false
+	if r.Method == http.MethodPost {
+		if secureEqual(r.PostFormValue(proxyPasswordField), a.password) {
+			a.login(w, r)
+			return
+		}
+		failed = true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	loginTmpl.Execute(w, map[string]interface{}{
+		"Project": toSailName(a.cntName),
+		"Field":   proxyPasswordField,
+		"Failed":  failed,
+	})
+}
+
+// wrap requires requests to h to be authorized.
+func (a *proxyAuth) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The health check is used to find out whether the proxy is running.
+		if r.URL.Path == sailapi.Prefix+sailapi.PathHealthz {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if token := r.URL.Query().Get(proxyTokenParam); token != "" {
+			if !secureEqual(token, a.token) {
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+			a.login(w, r)
+			return
+		}
+
+		if a.authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if a.password != "" {
+			a.passwordLogin(w, r)
+			return
+		}
+
+		msg := fmt.Sprintf("unauthorized, open the project with `sail run %v`", toSailName(a.cntName))
+		http.Error(w, msg, http.StatusUnauthorized)
+	})
+}
+
+// stripProxyAuth removes the proxy's token from the headers of a request,
+// so it isn't passed on to whatever listens on a forwarded port.
+func stripProxyAuth(h http.Header) {
+	if strings.HasPrefix(h.Get("Authorization"), "Bearer ") {
+		h.Del("Authorization")
+	}
+
+	cookies := (&http.Request{Header: h}).Cookies()
+	h.Del("Cookie")
+	var kept []string
+	for _, c := range cookies {
+		if strings.HasPrefix(c.Name, proxyTokenCookiePrefix) {
+			continue
+		}
+		kept = append(kept, c.String())
+	}
+	if len(kept) > 0 {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// checkOrigin reports whether the request was made by a page of the project
+// itself. Browsers always set the Origin header of websocket handshakes.
+func checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return xerrors.New("missing Origin header")
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return xerrors.Errorf("invalid Origin header %q: %w", origin, err)
+	}
+	if !strings.EqualFold(u.Host, r.Host) {
+		return xerrors.Errorf("origin %q doesn't match host %q", origin, r.Host)
+	}
+	return nil
+}
+
+// proxyRequest makes a request to the API of the proxy of the container named
+// cntName. in is sent as JSON if it isn't nil, and the response is decoded
+// into out if it isn't nil.
+func proxyRequest(cntName, method, path string, in, out interface{}) error {
+	c, err := apiClient(cntName)
+	if err != nil {
+		return err
+	}
+	return c.Do(context.Background(), method, path, in, out)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_proxyAuth(t *testing.T) {
+	t.Parallel()
+
+	a := &proxyAuth{
+		cntName:  "cdr_sail",
+		token:    "secret",
+		password: "hunter2",
+	}
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Token", func(t *testing.T) {
+		t.Parallel()
+
+		w := serve(httptest.NewRequest("GET", "/?sail_token=secret", nil))
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "./", w.Header().Get("Location"))
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, "sail_token_cdr_sail", cookies[0].Name)
+
+		r := httptest.NewRequest("GET", "/static/main.js", nil)
+		r.AddCookie(cookies[0])
+		assert.Equal(t, http.StatusOK, serve(r).Code)
+	})
+
+	t.Run("InvalidToken", func(t *testing.T) {
+		t.Parallel()
+
+		w := serve(httptest.NewRequest("GET", "/?sail_token=wrong", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Empty(t, w.Result().Cookies())
+	})
+
+	t.Run("Bearer", func(t *testing.T) {
+		t.Parallel()
+
+		r := httptest.NewRequest("POST", "/sail/api/v1/refresh", nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		assert.Equal(t, http.StatusOK, serve(r).Code)
+
+		r = httptest.NewRequest("POST", "/sail/api/v1/refresh", nil)
+		r.Header.Set("Authorization", "Bearer wrong")
+		assert.Equal(t, http.StatusUnauthorized, serve(r).Code)
+	})
+
+	t.Run("Healthz", func(t *testing.T) {
+		t.Parallel()
+
+		assert.Equal(t, http.StatusOK, serve(httptest.NewRequest("GET", "/sail/api/v1/healthz", nil)).Code)
+	})
+
+	t.Run("Password", func(t *testing.T) {
+		t.Parallel()
+
+		w := serve(httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), `name="sail_password"`)
+
+		login := func(password string) *httptest.ResponseRecorder {
+			form := url.Values{proxyPasswordField: {password}}.Encode()
+			r := httptest.NewRequest("POST", "/", strings.NewReader(form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return serve(r)
+		}
+
+		w = login("wrong")
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "Wrong password")
+
+		w = login("hunter2")
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Len(t, w.Result().Cookies(), 1)
+	})
+}
+
+func Test_loginRedirect(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"/?sail_token=x":                   "./",
+		"/?sail_token=x&folder=%2Fproject": "./?folder=%2Fproject",
+		"/static/main.js?sail_token=x":     "./main.js",
+	}
+	for in, exp := range tests {
+		u, err := url.Parse(in)
+		require.NoError(t, err)
+		assert.Equal(t, exp, loginRedirect(u), in)
+	}
+}
+
+func Test_checkOrigin(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"http://cdr--sail.localhost:7080", true},
+		{"http://evil.com", false},
+		{"http://cdr--other.localhost:7080", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("POST", "http://cdr--sail.localhost:7080/sail/api/v1/rebuild", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		err := checkOrigin(r)
+		assert.Equal(t, tc.ok, err == nil, tc.origin)
+	}
+}
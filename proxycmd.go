@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -18,7 +19,6 @@ import (
 	"time"
 
 	"golang.org/x/xerrors"
-	"nhooyr.io/websocket"
 
 	"go.coder.com/cli"
 	"go.coder.com/flog"
@@ -76,9 +76,72 @@ type proxy struct {
 	cntName    string
 	refreshing int64
 
+	// cntID is the ID of the container the port was found in. It changes
+	// when sail edit replaces the container.
+	cntID string
+
 	mu             sync.Mutex
 	codeServerPort string
 	portErr        error
+
+	handler http.Handler
+	// portTransport connects to other ports inside of the container.
+	portTransport http.RoundTripper
+	// tunnels are run in the background for sail forward -d.
+	tunnels *tunnels
+	// configPath is the global config the proxy was started with, which
+	// the sail commands it runs must read too.
+	configPath string
+	// gitCredentials serves the container's git credential requests
+	// if git.forward_credentials is enabled.
+	gitCredentials net.Listener
+
+	// lastActive is the time of the last request in unix nanoseconds,
+	// and conns is the number of open websockets.
+	lastActive int64
+	conns      int64
+	// off is set while the container is stopped. resuming is closed
+	// once an attempt to start it is done, which failed with resumeErr.
+	off       bool
+	resuming  chan struct{}
+	resumeErr error
+
+	// closed is closed once the proxy is no longer used.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// rebuilding is the rebuild that's running, if any.
+	rebuildMu  sync.Mutex
+	rebuilding *rebuildRun
+
+	metrics *proxyMetrics
+	history proxyHistory
+	// accessLog receives a JSON line per request, if set.
+	accessLogMu sync.Mutex
+	accessLog   io.Writer
+}
+
+func newProxy(url, cntName string, auth *proxyAuth) *proxy {
+	p := &proxy{
+		url:           url,
+		cntName:       cntName,
+		portTransport: portTransport(cntName),
+		tunnels:       newTunnels(cntName),
+		lastActive:    time.Now().UnixNano(),
+		closed:        make(chan struct{}),
+	}
+	p.metrics = newProxyMetrics(p)
+
+	m := http.NewServeMux()
+	m.HandleFunc("/sail.js", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(sailJS))
+	})
+	p.handleAPI(m)
+	m.HandleFunc("/sail/status", p.statusPage)
+	m.HandleFunc("/", p.proxy)
+	p.handler = p.observe(auth.wrap(p.track(p.routePorts(m))))
+
+	return p
 }
 
 func (p *proxy) getCodeServerPort() (string, error) {
@@ -87,7 +150,7 @@ func (p *proxy) getCodeServerPort() (string, error) {
 	return p.codeServerPort, p.portErr
 }
 
-func (p *proxy) refreshPort() {
+func (p *proxy) refreshPort() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
@@ -95,23 +158,122 @@ func (p *proxy) refreshPort() {
 	defer atomic.StoreInt64(&p.refreshing, 0)
 
 	for {
+		id, _ := containerID(p.cntName)
 		port, err := codeServerPort(p.cntName)
 		p.mu.Lock()
+		p.cntID = id
 		p.codeServerPort = port
 		p.portErr = err
+		if err == nil {
+			p.off = false
+		}
 		p.mu.Unlock()
 		if err == nil {
-			return
+			// The idle timeout starts over when the container starts.
+			p.touch()
+			p.metrics.portRefreshes.Inc("ok")
+			return nil
 		}
 
 		time.Sleep(time.Millisecond * 100)
 		if ctx.Err() != nil {
-			flog.Fatal("failed to refresh code-server port: %v", err)
+			err = xerrors.Errorf("failed to refresh code-server port: %w", err)
+			p.metrics.portRefreshes.Inc("error")
+			p.recordError(err)
+			return err
 		}
 	}
 }
 
-func (p *proxy) shouldDie() error {
+// close stops the background work of the proxy.
+func (p *proxy) close() {
+	p.closeOnce.Do(func() {
+		p.tunnels.closeAll()
+		close(p.closed)
+
+		p.mu.Lock()
+		if p.gitCredentials != nil {
+			p.gitCredentials.Close()
+		}
+		p.mu.Unlock()
+
+		p.accessLogMu.Lock()
+		if c, ok := p.accessLog.(io.Closer); ok {
+			c.Close()
+		}
+		p.accessLog = nil
+		p.accessLogMu.Unlock()
+	})
+}
+
+// forwardGitCredentials starts serving the container's git credential
+// requests until the proxy is closed.
+func (p *proxy) forwardGitCredentials() error {
+	l, err := listenGitCredentials(p.cntName)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		l.Close()
+	default:
+		p.gitCredentials = l
+	}
+	return nil
+}
+
+// stopped records that the container isn't running, so requests fail
+// right away instead of trying to reach code-server.
+func (p *proxy) stopped() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.codeServerPort = ""
+	p.portErr = xerrors.Errorf("container %v is not running", p.cntName)
+	p.off = true
+}
+
+// containerID returns the ID of the container named cntName.
+func containerID(cntName string) (string, error) {
+	cli := dockerClient()
+	defer cli.Close()
+
+	cnt, err := cli.ContainerInspect(context.Background(), cntName)
+	if err != nil {
+		return "", err
+	}
+	return cnt.ID, nil
+}
+
+// refreshIfReplaced refreshes the code-server port if the container was
+// replaced since it was last found, or was started again by something
+// other than the proxy.
+func (p *proxy) refreshIfReplaced() {
+	id, err := containerID(p.cntName)
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	replaced := id != p.cntID
+	started := p.off && p.resuming == nil
+	p.mu.Unlock()
+
+	if (replaced || started) && atomic.LoadInt64(&p.refreshing) == 0 {
+		flog.Info("container was replaced or started, refreshing code-server port")
+		err = p.refreshPort()
+		if err != nil {
+			flog.Error("%v", err)
+		}
+	}
+}
+
+// shouldDie returns an error if the proxy is no longer needed. It also
+// reports whether the container is running, as stopped containers are
+// kept proxied to so they can be started by the next request.
+func (p *proxy) shouldDie() (bool, error) {
 	cli := dockerClient()
 	defer cli.Close()
 
@@ -120,18 +282,14 @@ func (p *proxy) shouldDie() error {
 
 	cnt, err := cli.ContainerInspect(ctx, p.cntName)
 	if err != nil {
-		return xerrors.Errorf("failed to inspect container: %w", err)
+		return false, xerrors.Errorf("failed to inspect container: %w", err)
 	}
 
 	if cnt.Config.Labels[proxyURLLabel] != p.url {
-		return xerrors.Errorf("container is being serviced by a different proxy")
+		return false, xerrors.Errorf("container is being serviced by a different proxy")
 	}
 
-	if cnt.State.Status != "running" {
-		return xerrors.Errorf("container is not running: %v", cnt.State.Status)
-	}
-
-	return nil
+	return cnt.State.Running, nil
 }
 
 func (p *proxy) gc() {
@@ -140,48 +298,47 @@ func (p *proxy) gc() {
 
 	errs := 0
 	for range t.C {
-		err := p.shouldDie()
+		running, err := p.shouldDie()
 		if err != nil {
 			flog.Error("%v", err)
+			p.metrics.shouldDieChecks.Inc("error")
+			p.recordError(err)
 			errs++
 		} else {
 			errs = 0
 		}
+		if running {
+			p.metrics.shouldDieChecks.Inc("running")
+		} else if err == nil {
+			p.metrics.shouldDieChecks.Inc("stopped")
+		}
 		// On the 2nd error we fatal. We wait till the 2nd in case
 		// the container is being restarted.
 		if errs == 2 {
 			flog.Fatal("terminating due to too many should die errors")
 		}
-	}
-}
-
-type muxMsg struct {
-	Type string      `json:"type"`
-	V    interface{} `json:"v"`
-}
-
-func (p *proxy) reload(w http.ResponseWriter, r *http.Request) {
-	c, err := websocket.Accept(w, r, websocket.AcceptOptions{})
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	defer c.Close(websocket.StatusInternalError, "something failed")
-
-	ctx, cancel := context.WithTimeout(r.Context(), time.Minute*5)
-	defer cancel()
-
-	success := streamRun(ctx, c, "edit", toSailName(p.cntName))
+		if errs > 0 {
+			continue
+		}
 
-	// Need to refresh the port before we signal the stream was successful.
-	p.refreshPort()
+		if !running {
+			p.stopped()
+			continue
+		}
+		p.refreshIfReplaced()
 
-	if success {
-		c.Close(websocket.StatusNormalClosure, "")
+		err = pruneExpiredPrevious(p.cntName)
+		if err != nil {
+			flog.Error("failed to remove expired previous container: %v", err)
+		}
 	}
 }
 
 func (p *proxy) proxy(w http.ResponseWriter, r *http.Request) {
+	if !p.ensureRunning(w, r) {
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), time.Second*45)
 	defer cancel()
 
@@ -217,10 +374,22 @@ please try to reload soon
 }
 
 type proxycmd struct {
+	gf *globalFlags
 }
 
 func (c *proxycmd) proxy(cntName string) (addr string, err error) {
-	l, err := net.Listen("tcp", "localhost:0")
+	port, err := allocateProxyPort(cntName)
+	if err != nil {
+		return "", xerrors.Errorf("failed to allocate port: %w", err)
+	}
+
+	conf := c.gf.config()
+	host := conf.ProxyAddress
+	if host == "" {
+		host = "localhost"
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
 	if err != nil {
 		return "", xerrors.Errorf("failed to listen: %w", err)
 	}
@@ -230,31 +399,61 @@ func (c *proxycmd) proxy(cntName string) (addr string, err error) {
 		}
 	}()
 
-	p := &proxy{
-		url:     "http://" + l.Addr().String(),
-		cntName: cntName,
+	tlsConf, err := proxyTLS(conf)
+	if err != nil {
+		return "", xerrors.Errorf("failed to configure TLS: %w", err)
+	}
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+
+	auth, err := newProxyAuth(cntName, conf.ProxyPassword)
+	if err != nil {
+		return "", err
 	}
-	go p.refreshPort()
-	go p.gc()
 
+	p := newProxy(forkedProxyURL(l.Addr(), tlsConf != nil), cntName, auth)
+	p.configPath = c.gf.configPath
+	p.openAccessLog()
 	go func() {
-		m := http.NewServeMux()
-		m.HandleFunc("/sail.js", func(w http.ResponseWriter, r *http.Request) {
-			w.Write([]byte(sailJS))
-		})
-		m.HandleFunc("/sail/api/v1/healthz", func(w http.ResponseWriter, r *http.Request) {
-			w.Write([]byte("ok\n"))
-		})
-		m.HandleFunc("/sail/api/v1/reload", p.reload)
-		m.HandleFunc("/", p.proxy)
-		http.Serve(l, m)
+		err := p.refreshPort()
+		if err != nil {
+			flog.Fatal("%v", err)
+		}
 	}()
+	go p.gc()
+	go p.watchIdle()
+
+	if conf.Git.ForwardCredentials {
+		err = p.forwardGitCredentials()
+		if err != nil {
+			// Everything but pushing over HTTPS still works.
+			flog.Error("failed to forward git credentials: %v", err)
+		}
+	}
+
+	go http.Serve(l, p.handler)
 
 	flog.Info("listening on %v", p.url)
 
 	return p.url, nil
 }
 
+// forkedProxyURL returns the URL of a forked proxy listening on addr.
+// Proxies listening on every interface are reached on the loopback address.
+func forkedProxyURL(addr net.Addr, tls bool) string {
+	scheme := "http"
+	if tls {
+		scheme = "https"
+	}
+
+	host, port, _ := net.SplitHostPort(addr.String())
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
 func (c *proxycmd) Spec() cli.CommandSpec {
 	return cli.CommandSpec{
 		Name:   "proxy",
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/xnet"
+)
+
+// Forked proxies listen on a port allocated to the project the first time
+// it's proxied, so that its URL stays the same across restarts.
+const (
+	minProxyPort = 7100
+	maxProxyPort = 7999
+)
+
+// proxyPortPath returns the file holding the proxy port of the
+// project container named cntName.
+func proxyPortPath(cntName string) string {
+	return filepath.Join(metaRoot(), cntName, "proxy_port")
+}
+
+// reservedProxyPorts returns the proxy ports allocated to projects
+// other than the container named cntName.
+func reservedProxyPorts(cntName string) (map[string]struct{}, error) {
+	paths, err := filepath.Glob(proxyPortPath("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	reserved := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		if path == proxyPortPath(cntName) {
+			continue
+		}
+		byt, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		reserved[strings.TrimSpace(string(byt))] = struct{}{}
+	}
+	return reserved, nil
+}
+
+// pickProxyPort returns current if it's free. Otherwise it picks a free port
+// that isn't reserved by another project.
+func pickProxyPort(current string, reserved map[string]struct{}, free func(port string) bool) (string, error) {
+	if current != "" && free(current) {
+		return current, nil
+	}
+
+	for _, port := range rand.Perm(maxProxyPort - minProxyPort + 1) {
+		port := strconv.Itoa(port + minProxyPort)
+		if _, ok := reserved[port]; ok {
+			continue
+		}
+		if free(port) {
+			return port, nil
+		}
+	}
+	return "", xerrors.New("no available proxy ports")
+}
+
+// allocateProxyPort returns the proxy port of the project container named
+// cntName, allocating a new one if it has none or its port is taken.
+func allocateProxyPort(cntName string) (string, error) {
+	path := proxyPortPath(cntName)
+
+	var current string
+	byt, err := ioutil.ReadFile(path)
+	if err == nil {
+		current = strings.TrimSpace(string(byt))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	reserved, err := reservedProxyPorts(cntName)
+	if err != nil {
+		return "", xerrors.Errorf("failed to read allocated proxy ports: %w", err)
+	}
+
+	port, err := pickProxyPort(current, reserved, xnet.PortFree)
+	if err != nil {
+		return "", err
+	}
+	if port == current {
+		return port, nil
+	}
+	if current != "" {
+		flog.Error("proxy port %v of %v is in use, moving it to %v", current, cntName, port)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(path, []byte(port+"\n"), 0640)
+	if err != nil {
+		return "", xerrors.Errorf("failed to write %v: %w", path, err)
+	}
+	return port, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pickProxyPort(t *testing.T) {
+	t.Parallel()
+
+	allFree := func(string) bool { return true }
+
+	t.Run("Reuse", func(t *testing.T) {
+		t.Parallel()
+
+		port, err := pickProxyPort("7123", nil, allFree)
+		require.NoError(t, err)
+		assert.Equal(t, "7123", port)
+	})
+
+	t.Run("Taken", func(t *testing.T) {
+		t.Parallel()
+
+		port, err := pickProxyPort("7123", nil, func(port string) bool {
+			return port != "7123"
+		})
+		require.NoError(t, err)
+		assert.NotEqual(t, "7123", port)
+	})
+
+	t.Run("Reserved", func(t *testing.T) {
+		t.Parallel()
+
+		// Reserve every port but one.
+		reserved := make(map[string]struct{})
+		for p := minProxyPort; p <= maxProxyPort; p++ {
+			if p != 7500 {
+				reserved[strconv.Itoa(p)] = struct{}{}
+			}
+		}
+
+		port, err := pickProxyPort("", reserved, allFree)
+		require.NoError(t, err)
+		assert.Equal(t, "7500", port)
+
+		_, err = pickProxyPort("", reserved, func(port string) bool {
+			return port != "7500"
+		})
+		assert.Error(t, err)
+	})
+}
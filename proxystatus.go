@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/metrics"
+)
+
+// proxyMetrics are the metrics of a project's proxy, served on
+// /sail/api/v1/metrics in the Prometheus text format.
+type proxyMetrics struct {
+	reg *metrics.Registry
+
+	requests        *metrics.Counter
+	requestDuration *metrics.Histogram
+	portRefreshes   *metrics.Counter
+	shouldDieChecks *metrics.Counter
+	rebuilds        *metrics.Counter
+	rebuildDuration *metrics.Histogram
+}
+
+func newProxyMetrics(p *proxy) *proxyMetrics {
+	reg := metrics.NewRegistry(map[string]string{
+		"project": toSailName(p.cntName),
+	})
+	m := &proxyMetrics{
+		reg: reg,
+		requests: reg.Counter("sail_proxy_requests_total",
+			"Requests handled by the proxy.", "route", "code"),
+		requestDuration: reg.Histogram("sail_proxy_request_duration_seconds",
+			"Time taken to handle requests, excluding websockets.", metrics.DefaultBuckets, "route"),
+		portRefreshes: reg.Counter("sail_proxy_port_refreshes_total",
+			"Attempts to find the code-server port.", "result"),
+		shouldDieChecks: reg.Counter("sail_proxy_should_die_checks_total",
+			"Checks of whether a forked proxy is still needed.", "result"),
+		rebuilds: reg.Counter("sail_proxy_rebuilds_total",
+			"Rebuilds started from the browser.", "result"),
+		rebuildDuration: reg.Histogram("sail_proxy_rebuild_duration_seconds",
+			"Time taken by rebuilds started from the browser.", []float64{10, 30, 60, 120, 300, 600}, "result"),
+	}
+	reg.GaugeFunc("sail_proxy_open_websockets", "Websockets open through the proxy.", func() float64 {
+		return float64(atomic.LoadInt64(&p.conns))
+	})
+	return m
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// proxyEvent is an entry in the recent history of a proxy.
+type proxyEvent struct {
+	Time     time.Time
+	Duration time.Duration
+	Err      string
+}
+
+// maxProxyEvents is how many rebuilds and errors the status page shows.
+const maxProxyEvents = 20
+
+// proxyHistory holds the recent rebuilds and errors of a proxy.
+type proxyHistory struct {
+	mu       sync.Mutex
+	rebuilds []proxyEvent
+	errors   []proxyEvent
+}
+
+func appendEvent(events []proxyEvent, e proxyEvent) []proxyEvent {
+	events = append(events, e)
+	if len(events) > maxProxyEvents {
+		events = events[len(events)-maxProxyEvents:]
+	}
+	return events
+}
+
+// recordError records err for the status page.
+func (p *proxy) recordError(err error) {
+	p.history.mu.Lock()
+	defer p.history.mu.Unlock()
+	p.history.errors = appendEvent(p.history.errors, proxyEvent{Time: time.Now(), Err: err.Error()})
+}
+
+// recordRebuild records a rebuild that started at start.
+func (p *proxy) recordRebuild(start time.Time, err error) {
+	d := time.Since(start)
+	p.metrics.rebuilds.Inc(resultLabel(err))
+	p.metrics.rebuildDuration.Observe(d.Seconds(), resultLabel(err))
+
+	e := proxyEvent{Time: start, Duration: d}
+	if err != nil {
+		e.Err = err.Error()
+		p.recordError(xerrors.Errorf("rebuild failed: %w", err))
+	}
+
+	p.history.mu.Lock()
+	defer p.history.mu.Unlock()
+	p.history.rebuilds = appendEvent(p.history.rebuilds, e)
+}
+
+// accessLogPath returns the file the proxy of the container named
+// cntName logs requests to.
+func accessLogPath(cntName string) string {
+	return filepath.Join(metaRoot(), cntName, "access.log")
+}
+
+// proxyLogPath returns the file a forked proxy of the container named
+// cntName writes its logs to.
+func proxyLogPath(cntName string) string {
+	return filepath.Join(metaRoot(), cntName, "proxy.log")
+}
+
+// maxAccessLogSize is the size past which the access log is rotated
+// when it's opened.
+const maxAccessLogSize = 10 << 20
+
+// openAccessLog opens the access log of the container named cntName.
+// A log larger than maxAccessLogSize is moved to access.log.1 first.
+func openAccessLog(cntName string) (*os.File, error) {
+	path := accessLogPath(cntName)
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err == nil && fi.Size() > maxAccessLogSize {
+		err = os.Rename(path, path+".1")
+		if err != nil {
+			return nil, xerrors.Errorf("failed to rotate %v: %w", path, err)
+		}
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+}
+
+// openAccessLog makes the proxy log requests to its access log.
+// Failing to open it isn't fatal.
+func (p *proxy) openAccessLog() {
+	f, err := openAccessLog(p.cntName)
+	if err != nil {
+		flog.Error("failed to open access log: %v", err)
+		return
+	}
+	p.setAccessLog(f)
+}
+
+// accessLogEntry is a line of the access log.
+type accessLogEntry struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Host   string    `json:"host"`
+	// Path doesn't include the query, which may hold the token.
+	Path      string  `json:"path"`
+	Route     string  `json:"route"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration_ms"`
+	Websocket bool    `json:"websocket,omitempty"`
+}
+
+// setAccessLog makes the proxy log requests to w.
+func (p *proxy) setAccessLog(w io.Writer) {
+	p.accessLogMu.Lock()
+	defer p.accessLogMu.Unlock()
+	p.accessLog = w
+}
+
+func (p *proxy) logAccess(e accessLogEntry) {
+	p.accessLogMu.Lock()
+	defer p.accessLogMu.Unlock()
+	if p.accessLog == nil {
+		return
+	}
+	json.NewEncoder(p.accessLog).Encode(e)
+}
+
+// statusRecorder records the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack allows websockets to be proxied.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, xerrors.New("response can't be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// route classifies requests for metrics.
+func route(r *http.Request) string {
+	if _, ok := portFromHost(r.Host); ok {
+		return "port"
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, portPathPrefix):
+		return "port"
+	case strings.HasPrefix(r.URL.Path, "/sail/api/"):
+		return "api"
+	case r.URL.Path == "/sail/status", r.URL.Path == "/sail.js":
+		return "sail"
+	default:
+		return "code-server"
+	}
+}
+
+// observe logs requests to h and records their metrics.
+func (p *proxy) observe(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		websocket := strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+		rt := route(r)
+
+		h.ServeHTTP(rec, r)
+
+		d := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		p.metrics.requests.Inc(rt, strconv.Itoa(rec.status))
+		if !websocket {
+			p.metrics.requestDuration.Observe(d.Seconds(), rt)
+		}
+
+		p.logAccess(accessLogEntry{
+			Time:      start,
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			Route:     rt,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			Duration:  float64(d) / float64(time.Millisecond),
+			Websocket: websocket,
+		})
+	})
+}
+
+// serveMetrics serves the proxy's metrics in the Prometheus text format.
+func (p *proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.metrics.reg.WriteTo(w)
+}
+
+var statusTmpl = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>sail - {{ .Project }} status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{ .Project }}</h1>
+<table>
+<tr><th>Container</th><td>{{ .State }}{{ if .StartedAt }}, started {{ .StartedAt }}{{ end }}</td></tr>
+<tr><th>Image</th><td>{{ .Image }}</td></tr>
+<tr><th>code-server port</th><td>{{ if .Port }}{{ .Port }}{{ else }}<span class="error">{{ .PortErr }}</span>{{ end }}</td></tr>
+<tr><th>Open websockets</th><td>{{ .Websockets }}</td></tr>
+<tr><th>Last activity</th><td>{{ .LastActive }}</td></tr>
+<tr><th>Proxy URL</th><td>{{ .URL }}</td></tr>
+</table>
+
+<h2>Recent rebuilds</h2>
+{{ if .Rebuilds }}<table>
+<tr><th>Started</th><th>Duration</th><th>Result</th></tr>
+{{ range .Rebuilds }}<tr><td>{{ .Time.Format "2006-01-02 15:04:05" }}</td><td>{{ .Duration }}</td><td>{{ if .Err }}<span class="error">{{ .Err }}</span>{{ else }}ok{{ end }}</td></tr>
+{{ end }}</table>
+{{ else }}<p>None</p>
+{{ end }}
+<h2>Recent errors</h2>
+{{ if .Errors }}<table>
+{{ range .Errors }}<tr><td>{{ .Time.Format "2006-01-02 15:04:05" }}</td><td class="error">{{ .Err }}</td></tr>
+{{ end }}</table>
+{{ else }}<p>None</p>
+{{ end }}
+<p><a href="api/v1/metrics">Metrics</a></p>
+</body>
+</html>
+`))
+
+// statusPage shows the state of the project and its proxy.
+func (p *proxy) statusPage(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Project":    toSailName(p.cntName),
+		"URL":        p.url,
+		"Websockets": atomic.LoadInt64(&p.conns),
+		"LastActive": p.lastActivity().Format("2006-01-02 15:04:05"),
+	}
+
+	cli := dockerClient()
+	defer cli.Close()
+	cnt, err := cli.ContainerInspect(context.Background(), p.cntName)
+	if err != nil {
+		data["State"] = err.Error()
+	} else {
+		data["State"] = cnt.State.Status
+		data["Image"] = cnt.Config.Image
+		if cnt.State.Running {
+			data["StartedAt"] = cnt.State.StartedAt
+		}
+	}
+
+	port, portErr := p.getCodeServerPort()
+	data["Port"] = port
+	if portErr != nil {
+		data["PortErr"] = portErr.Error()
+	}
+
+	p.history.mu.Lock()
+	data["Rebuilds"] = reverseEvents(p.history.rebuilds)
+	data["Errors"] = reverseEvents(p.history.errors)
+	p.history.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTmpl.Execute(w, data)
+}
+
+// reverseEvents returns a copy of events with the most recent first.
+func reverseEvents(events []proxyEvent) []proxyEvent {
+	rev := make([]proxyEvent, len(events))
+	for i, e := range events {
+		rev[len(events)-1-i] = e
+	}
+	return rev
+}
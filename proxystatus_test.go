@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func Test_route(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		host string
+		path string
+		exp  string
+	}{
+		{"127.0.0.1:7123", "/", "code-server"},
+		{"127.0.0.1:7123", "/static/main.js", "code-server"},
+		{"127.0.0.1:7123", "/sail.js", "sail"},
+		{"127.0.0.1:7123", "/sail/status", "sail"},
+		{"127.0.0.1:7123", "/sail/api/v1/metrics", "api"},
+		{"127.0.0.1:7123", "/port/3000/", "port"},
+		{"3000.cdr--sail.localhost:7080", "/", "port"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Host = test.host
+		assert.Equal(t, test.exp, route(r), "%v%v", test.host, test.path)
+	}
+}
+
+func Test_proxyObserve(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy("http://127.0.0.1:7123", "cdr_sail", &proxyAuth{})
+	var log bytes.Buffer
+	p.setAccessLog(&log)
+
+	h := p.observe(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?sail_token=secret", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	dec := json.NewDecoder(&log)
+	var e accessLogEntry
+	require.NoError(t, dec.Decode(&e))
+	assert.Equal(t, "/", e.Path)
+	assert.Equal(t, "code-server", e.Route)
+	assert.Equal(t, http.StatusOK, e.Status)
+	assert.EqualValues(t, 5, e.Bytes)
+	require.NoError(t, dec.Decode(&e))
+	assert.Equal(t, http.StatusNotFound, e.Status)
+
+	w := httptest.NewRecorder()
+	p.serveMetrics(w, httptest.NewRequest("GET", "/sail/api/v1/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, body, `sail_proxy_requests_total{project="cdr/sail",route="code-server",code="200"} 1`)
+	assert.Contains(t, body, `sail_proxy_requests_total{project="cdr/sail",route="code-server",code="404"} 1`)
+	assert.Contains(t, body, `sail_proxy_request_duration_seconds_count{project="cdr/sail",route="code-server"} 2`)
+	assert.Contains(t, body, `sail_proxy_open_websockets{project="cdr/sail"} 0`)
+	assert.NotContains(t, log.String(), "secret")
+}
+
+func Test_proxyHistory(t *testing.T) {
+	t.Parallel()
+
+	p := newProxy("http://127.0.0.1:7123", "cdr_sail", &proxyAuth{})
+	for i := 0; i < maxProxyEvents+5; i++ {
+		p.recordError(xerrors.Errorf("error %v", i))
+	}
+	p.recordRebuild(time.Now().Add(-time.Minute), xerrors.New("exit status 1"))
+
+	assert.Len(t, p.history.errors, maxProxyEvents)
+	assert.Equal(t, "rebuild failed: exit status 1", p.history.errors[maxProxyEvents-1].Err)
+	assert.Equal(t, "error 6", p.history.errors[0].Err)
+
+	require.Len(t, p.history.rebuilds, 1)
+	assert.True(t, p.history.rebuilds[0].Duration >= time.Minute)
+
+	rev := reverseEvents(p.history.errors)
+	assert.Equal(t, p.history.errors[0], rev[len(rev)-1])
+}
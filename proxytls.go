@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+)
+
+// The proxy serves HTTPS if tls.enabled is set in the config. It uses the
+// configured certificate, or issues certificates for the names it's reached
+// on from a local CA that sail generates and `sail ca install` trusts.
+
+// tlsConfig describes the [tls] table of the config.
+type tlsConfig struct {
+	// Enabled serves the proxy over HTTPS.
+	Enabled bool `toml:"enabled"`
+	// Cert and Key are paths to a PEM encoded certificate and its key.
+	// If they're not set, certificates are issued by sail's local CA.
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+}
+
+// localCADir returns the directory holding sail's local CA.
+func localCADir() string {
+	return filepath.Join(metaRoot(), "ca")
+}
+
+func localCACertPath() string {
+	return filepath.Join(localCADir(), "sail-ca.pem")
+}
+
+func localCAKeyPath() string {
+	return filepath.Join(localCADir(), "sail-ca-key.pem")
+}
+
+// localCA issues certificates for the names the proxy is reached on.
+type localCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu sync.Mutex
+	// leaves caches the issued certificates by name.
+	leaves map[string]*tls.Certificate
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// localCANames returns the names the proxy is reached on with conf, which the
+// local CA is constrained to. Proxies listening on every interface are reached
+// on the host's name and addresses.
+func localCANames(conf config) []string {
+	names := []string{"localhost"}
+
+	addHost := func(host string) {
+		if host == "" {
+			return
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsUnspecified() {
+			names = append(names, host)
+			return
+		}
+
+		if hostname, err := os.Hostname(); err == nil {
+			names = append(names, hostname)
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+				names = append(names, ipnet.IP.String())
+			}
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(daemonAddress(conf)); err == nil {
+		// An address without a host, e.g :7080, listens on every interface.
+		if host == "" {
+			host = "0.0.0.0"
+		}
+		addHost(host)
+	}
+	addHost(conf.ProxyAddress)
+
+	seen := make(map[string]struct{}, len(names))
+	unique := names[:0]
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		unique = append(unique, name)
+	}
+	return unique
+}
+
+// loadLocalCA loads sail's local CA, generating it for the names the proxy
+// is reached on with conf if it doesn't exist yet.
+func loadLocalCA(conf config) (*localCA, error) {
+	certPEM, certErr := ioutil.ReadFile(localCACertPath())
+	keyPEM, keyErr := ioutil.ReadFile(localCAKeyPath())
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		err := generateLocalCA(localCANames(conf))
+		if err != nil {
+			return nil, xerrors.Errorf("failed to generate local CA: %w", err)
+		}
+		return loadLocalCA(conf)
+	}
+	if certErr != nil {
+		return nil, certErr
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	ca, err := parseLocalCA(certPEM, keyPEM)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid local CA in %v: %w", localCADir(), err)
+	}
+	// CAs generated by older versions of sail could issue certificates for any name.
+	if !ca.cert.PermittedDNSDomainsCritical {
+		return nil, xerrors.Errorf("the local CA in %v isn't constrained to the proxy's names, "+
+			"remove it from your trust stores and %v, then run sail ca install again", localCADir(), localCADir())
+	}
+	return ca, nil
+}
+
+// parseLocalCA parses a PEM encoded CA certificate and its key.
+func parseLocalCA(certPEM, keyPEM []byte) (*localCA, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, xerrors.New("local CA key can't sign")
+	}
+
+	return &localCA{
+		cert:   cert,
+		key:    key,
+		leaves: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// generateLocalCA writes a new CA certificate and key for names to localCADir.
+func generateLocalCA(names []string) error {
+	certPEM, keyPEM, err := newCA(names)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(localCADir(), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(localCAKeyPath(), keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(localCACertPath(), certPEM, 0644)
+}
+
+// newCA returns a new PEM encoded CA certificate and its key. The CA is
+// trusted by the host, so it's constrained to issuing certificates for names,
+// their subdomains and the loopback addresses.
+func newCA(names []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"sail local CA"},
+			CommonName:   "sail local CA " + hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedIPRanges: []*net.IPNet{
+			{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			tmpl.PermittedIPRanges = append(tmpl.PermittedIPRanges, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(len(ip)*8, len(ip)*8),
+			})
+			continue
+		}
+		tmpl.PermittedDNSDomains = append(tmpl.PermittedDNSDomains, name)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// permits reports whether the CA's name constraints allow it to issue a
+// certificate for name.
+func (ca *localCA) permits(name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, ipnet := range ca.cert.PermittedIPRanges {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range ca.cert.PermittedDNSDomains {
+		domain = strings.ToLower(domain)
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// issue returns a certificate for name, which is a host name or IP address.
+func (ca *localCA) issue(name string) (*tls.Certificate, error) {
+	if !ca.permits(name) {
+		return nil, xerrors.Errorf("the local CA can't issue a certificate for %q, "+
+			"remove %v and run sail ca install again to include it", name, localCADir())
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if leaf, ok := ca.leaves[name]; ok && time.Now().Before(leaf.Leaf.NotAfter.Add(-time.Hour*24)) {
+		return leaf, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// Browsers reject leaf certificates valid for longer than 398 days.
+		NotAfter:    time.Now().AddDate(0, 0, 365),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	ca.leaves[name] = cert
+	return cert, nil
+}
+
+// getCertificate issues a certificate for the name the client asked for,
+// or for the address it connected to if it didn't send one.
+func (ca *localCA) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		name = host
+	}
+	return ca.issue(name)
+}
+
+// proxyTLS returns the TLS config of the proxy, or nil if TLS is disabled.
+func proxyTLS(conf config) (*tls.Config, error) {
+	if !conf.TLS.Enabled {
+		return nil, nil
+	}
+
+	if conf.TLS.Cert != "" {
+		hostHomeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.LoadX509KeyPair(resolvePath(hostHomeDir, conf.TLS.Cert), resolvePath(hostHomeDir, conf.TLS.Key))
+		if err != nil {
+			return nil, xerrors.Errorf("failed to load tls.cert and tls.key: %w", err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}, nil
+	}
+
+	ca, err := loadLocalCA(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range localCANames(conf) {
+		if !ca.permits(name) {
+			flog.Error("the local CA can't issue a certificate for %v, remove %v and run sail ca install again to include it",
+				name, localCADir())
+		}
+	}
+	return &tls.Config{
+		GetCertificate: ca.getCertificate,
+	}, nil
+}
+
+// proxyClientTLS returns the TLS config used to talk to proxies. They may use
+// certificates issued by the local CA, which may be generated after the config
+// is created, so the certificate chain is verified when connecting.
+func proxyClientTLS() *tls.Config {
+	return &tls.Config{
+		// Proxies are dialed on the loopback address, so only the
+		// certificate chain is verified and not the host name.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyProxyCert(rawCerts)
+		},
+	}
+}
+
+// verifyProxyCert checks that the chain rawCerts is trusted by the system
+// or issued by the local CA.
+func verifyProxyCert(rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return xerrors.New("no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if caPEM, err := ioutil.ReadFile(localCACertPath()); err == nil {
+		roots.AppendCertsFromPEM(caPEM)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_localCA(t *testing.T) {
+	t.Parallel()
+
+	certPEM, keyPEM, err := newCA([]string{"localhost", "devbox", "192.168.1.20"})
+	require.NoError(t, err)
+
+	ca, err := parseLocalCA(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(certPEM))
+
+	tests := []struct {
+		name    string
+		verify  string
+		wantErr bool
+	}{
+		{"cdr--sail.localhost", "cdr--sail.localhost", false},
+		{"192.168.1.20", "192.168.1.20", false},
+		{"::1", "::1", false},
+		{"127.0.0.1", "127.0.0.1", false},
+		{"cdr--sail.devbox", "cdr--sail.devbox", false},
+		{"cdr--sail.localhost", "cdr--other.localhost", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name+"/"+tc.verify, func(t *testing.T) {
+			t.Parallel()
+
+			cert, err := ca.issue(tc.name)
+			require.NoError(t, err)
+			require.Len(t, cert.Certificate, 2)
+
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{
+				DNSName: tc.verify,
+				Roots:   roots,
+			})
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// The CA is trusted by the host, so it must not issue certificates for other names.
+	for _, name := range []string{"example.com", "localhost.example.com", "192.168.1.21", "10.0.0.1"} {
+		_, err := ca.issue(name)
+		assert.Error(t, err, name)
+	}
+
+	// Certificates for other names are rejected even if the CA's key signed them.
+	serial, err := newSerial()
+	require.NoError(t, err)
+	forged := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, forged, ca.cert, ca.key.Public(), ca.key)
+	require.NoError(t, err)
+	forged, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	_, err = forged.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	assert.Error(t, err)
+
+	a, err := ca.issue("localhost")
+	require.NoError(t, err)
+	b, err := ca.issue("localhost")
+	require.NoError(t, err)
+	assert.True(t, a == b, "issued certificates should be cached")
+}
+
+func Test_localCANames(t *testing.T) {
+	t.Parallel()
+
+	names := localCANames(config{
+		DaemonAddress: "devbox.lan:7080",
+		ProxyAddress:  "192.168.1.20",
+	})
+	assert.Equal(t, []string{"localhost", "devbox.lan", "192.168.1.20"}, names)
+
+	names = localCANames(config{})
+	assert.Equal(t, []string{"localhost"}, names)
+
+	// Proxies listening on every interface are reached on the host's names.
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	names = localCANames(config{DaemonAddress: "0.0.0.0:7080"})
+	assert.Contains(t, names, hostname)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// rebuildEventsEnv holds the file descriptor that sail writes rebuild events
+// to as JSON lines, when it's run by the proxy to rebuild a project.
+const rebuildEventsEnv = "SAIL_REBUILD_EVENTS"
+
+// rebuildEmitter writes the events of a rebuild. It does nothing unless
+// sail was started with rebuildEventsEnv.
+type rebuildEmitter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+var rebuildEvents = openRebuildEvents()
+
+func openRebuildEvents() *rebuildEmitter {
+	fd, err := strconv.Atoi(os.Getenv(rebuildEventsEnv))
+	if err != nil {
+		return &rebuildEmitter{}
+	}
+	// Commands run by sail, like docker build, must not inherit it.
+	os.Unsetenv(rebuildEventsEnv)
+	syscall.CloseOnExec(fd)
+	return &rebuildEmitter{
+		enc: json.NewEncoder(os.NewFile(uintptr(fd), "rebuild-events")),
+	}
+}
+
+func (e *rebuildEmitter) enabled() bool {
+	return e.enc != nil
+}
+
+func (e *rebuildEmitter) emit(ev sailapi.Event) {
+	if !e.enabled() {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.enc.Encode(ev)
+}
+
+// phase runs fn as phase p of the rebuild.
+func (e *rebuildEmitter) phase(p sailapi.Phase, fn func() error) error {
+	e.emit(sailapi.Event{Type: sailapi.EventPhaseStart, Phase: p})
+	err := fn()
+	end := sailapi.Event{Type: sailapi.EventPhaseEnd, Phase: p}
+	if err != nil {
+		end.Error = err.Error()
+	}
+	e.emit(end)
+	return err
+}
+
+// fail reports why the rebuild failed.
+func (e *rebuildEmitter) fail(err error) {
+	e.emit(sailapi.Event{Type: sailapi.EventResult, Error: err.Error()})
+}
+
+var (
+	// dockerStepRx matches the steps of the classic docker builder,
+	// e.g "Step 2/5 : RUN make".
+	dockerStepRx = regexp.MustCompile(`^Step (\d+)/(\d+) : (.*)$`)
+	// buildkitStepRx matches the steps of BuildKit, e.g "#6 [2/5] RUN make".
+	buildkitStepRx = regexp.MustCompile(`^#\d+ \[(?:\S+ )?(\d+)/(\d+)\] (.*)$`)
+)
+
+// parseBuildStep parses a line of docker build output that starts a step.
+func parseBuildStep(line string) (step, steps int, msg string, ok bool) {
+	m := dockerStepRx.FindStringSubmatch(line)
+	if m == nil {
+		m = buildkitStepRx.FindStringSubmatch(line)
+	}
+	if m == nil {
+		return 0, 0, "", false
+	}
+	step, _ = strconv.Atoi(m[1])
+	steps, _ = strconv.Atoi(m[2])
+	return step, steps, m[3], true
+}
+
+// attachBuild reports the steps of the docker build run by cmd as progress
+// of phase p. Its output still goes to cmd's stdout and stderr, as BuildKit
+// prints the steps to stderr. The returned func must be called once cmd is done.
+func (e *rebuildEmitter) attachBuild(cmd *exec.Cmd, p sailapi.Phase) func() {
+	if !e.enabled() {
+		return func() {}
+	}
+
+	var (
+		wg    sync.WaitGroup
+		pipes []*io.PipeWriter
+	)
+	tee := func(w io.Writer) io.Writer {
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pw)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.scanSteps(p, pr)
+		}()
+		return io.MultiWriter(w, pw)
+	}
+	cmd.Stdout = tee(cmd.Stdout)
+	cmd.Stderr = tee(cmd.Stderr)
+
+	return func() {
+		for _, pw := range pipes {
+			pw.Close()
+		}
+		wg.Wait()
+	}
+}
+
+// scanSteps emits a step event for each step started in the build output r.
+func (e *rebuildEmitter) scanSteps(p sailapi.Phase, r io.Reader) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	last := ""
+	for s.Scan() {
+		step, steps, msg, ok := parseBuildStep(s.Text())
+		// BuildKit prints a step again if it's interleaved with others.
+		if !ok || msg == last {
+			continue
+		}
+		last = msg
+		e.emit(sailapi.Event{
+			Type:    sailapi.EventStep,
+			Phase:   p,
+			Step:    step,
+			Steps:   steps,
+			Message: msg,
+		})
+	}
+	// Don't block the build if a line is too long.
+	io.Copy(ioutil.Discard, r)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/sail/internal/sailapi"
+)
+
+func Test_parseBuildStep(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		line  string
+		ok    bool
+		step  int
+		steps int
+		msg   string
+	}{
+		{"Step 2/5 : RUN make", true, 2, 5, "RUN make"},
+		{"#6 [2/5] RUN make", true, 2, 5, "RUN make"},
+		{"#8 [builder 3/4] COPY . .", true, 3, 4, "COPY . ."},
+		{"#6 DONE 0.5s", false, 0, 0, ""},
+		{" ---> Running in 0123456789ab", false, 0, 0, ""},
+	}
+
+	for _, test := range tests {
+		step, steps, msg, ok := parseBuildStep(test.line)
+		assert.Equal(t, test.ok, ok, test.line)
+		assert.Equal(t, test.step, step, test.line)
+		assert.Equal(t, test.steps, steps, test.line)
+		assert.Equal(t, test.msg, msg, test.line)
+	}
+}
+
+func decodeEvents(t *testing.T, buf *bytes.Buffer) []sailapi.Event {
+	var events []sailapi.Event
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var e sailapi.Event
+		require.NoError(t, dec.Decode(&e))
+		events = append(events, e)
+	}
+	return events
+}
+
+func Test_rebuildEmitter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Disabled", func(t *testing.T) {
+		e := &rebuildEmitter{}
+		err := e.phase(sailapi.PhaseBuild, func() error {
+			return xerrors.New("exit status 1")
+		})
+		assert.EqualError(t, err, "exit status 1")
+	})
+
+	t.Run("Phase", func(t *testing.T) {
+		var buf bytes.Buffer
+		e := &rebuildEmitter{enc: json.NewEncoder(&buf)}
+
+		err := e.phase(sailapi.PhaseCreate, func() error { return nil })
+		require.NoError(t, err)
+		err = e.phase(sailapi.PhaseWaitOnline, func() error {
+			return xerrors.New("container not running")
+		})
+		require.Error(t, err)
+		e.fail(err)
+
+		assert.Equal(t, []sailapi.Event{
+			{Type: sailapi.EventPhaseStart, Phase: sailapi.PhaseCreate},
+			{Type: sailapi.EventPhaseEnd, Phase: sailapi.PhaseCreate},
+			{Type: sailapi.EventPhaseStart, Phase: sailapi.PhaseWaitOnline},
+			{Type: sailapi.EventPhaseEnd, Phase: sailapi.PhaseWaitOnline, Error: "container not running"},
+			{Type: sailapi.EventResult, Error: "container not running"},
+		}, decodeEvents(t, &buf))
+	})
+
+	t.Run("Build", func(t *testing.T) {
+		var buf, stdout, stderr bytes.Buffer
+		e := &rebuildEmitter{enc: json.NewEncoder(&buf)}
+
+		cmd := exec.Command("sh", "-c", `echo "Step 1/2 : FROM ubuntu"; echo " ---> abc"; echo "#5 [2/2] RUN make" >&2`)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		done := e.attachBuild(cmd, sailapi.PhaseBuild)
+		require.NoError(t, cmd.Run())
+		done()
+
+		assert.Contains(t, stdout.String(), " ---> abc")
+		assert.Contains(t, stderr.String(), "#5 [2/2] RUN make")
+		// Each output is scanned on its own, so there's no order between them.
+		assert.ElementsMatch(t, []sailapi.Event{
+			{Type: sailapi.EventStep, Phase: sailapi.PhaseBuild, Step: 1, Steps: 2, Message: "FROM ubuntu"},
+			{Type: sailapi.EventStep, Phase: sailapi.PhaseBuild, Step: 2, Steps: 2, Message: "RUN make"},
+		}, decodeEvents(t, &buf))
+	})
+}
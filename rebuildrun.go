@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// rebuildRun is a rebuild run by the proxy. Clients that ask for a rebuild
+// while one is running watch it instead of starting another, so they all
+// get its events from the start.
+type rebuildRun struct {
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	events []sailapi.Event
+	done   bool
+	// changed is closed and replaced whenever an event is added.
+	changed  chan struct{}
+	watchers int
+}
+
+func newRebuildRun(cancel context.CancelFunc) *rebuildRun {
+	return &rebuildRun{
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+}
+
+// add adds an event of the rebuild for its watchers.
+func (r *rebuildRun) add(e sailapi.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// finish marks the rebuild as done once all of its events were added.
+func (r *rebuildRun) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done = true
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// acquire counts a watcher of the rebuild.
+func (r *rebuildRun) acquire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.watchers++
+}
+
+// release stops counting a watcher of the rebuild. The rebuild is canceled
+// if every watcher is released before it's done.
+func (r *rebuildRun) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.watchers--
+	if r.watchers == 0 && !r.done {
+		r.cancel()
+	}
+}
+
+// watch sends the events of the rebuild to emit until it's done, ctx is done
+// or emit fails. The caller must be counted as a watcher until it returns,
+// see acquire.
+func (r *rebuildRun) watch(ctx context.Context, emit func(sailapi.Event) error) error {
+	next := 0
+	for {
+		r.mu.Lock()
+		events := r.events[next:]
+		done := r.done
+		changed := r.changed
+		r.mu.Unlock()
+
+		for _, e := range events {
+			err := emit(e)
+			if err != nil {
+				return err
+			}
+		}
+		next += len(events)
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// startRebuild starts rebuilding the container, or returns the rebuild
+// that's already running. The caller is counted as a watcher of the rebuild,
+// and must release it once it stops watching.
+func (p *proxy) startRebuild() *rebuildRun {
+	p.rebuildMu.Lock()
+	defer p.rebuildMu.Unlock()
+
+	// The watcher is counted while rebuildMu is held, so a rebuild that's
+	// being handed out can't be canceled by its other watchers leaving.
+	if p.rebuilding != nil {
+		p.rebuilding.acquire()
+		return p.rebuilding
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRebuildRun(cancel)
+	r.acquire()
+	p.rebuilding = r
+	go func() {
+		defer cancel()
+		p.runRebuild(ctx, func(e sailapi.Event) error {
+			r.add(e)
+			return nil
+		})
+
+		p.rebuildMu.Lock()
+		p.rebuilding = nil
+		p.rebuildMu.Unlock()
+		r.finish()
+	}()
+	return r
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.coder.com/sail/internal/sailapi"
+)
+
+func Test_rebuildRun(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Watchers", func(t *testing.T) {
+		canceled := false
+		r := newRebuildRun(func() { canceled = true })
+
+		first := sailapi.Event{Type: sailapi.EventPhaseStart, Phase: sailapi.PhaseBuild}
+		result := sailapi.Event{Type: sailapi.EventResult}
+		r.add(first)
+
+		var wg sync.WaitGroup
+		watched := make([][]sailapi.Event, 2)
+		for i := range watched {
+			wg.Add(1)
+			r.acquire()
+			go func(i int) {
+				defer wg.Done()
+				defer r.release()
+				err := r.watch(context.Background(), func(e sailapi.Event) error {
+					watched[i] = append(watched[i], e)
+					return nil
+				})
+				assert.NoError(t, err)
+			}(i)
+		}
+
+		r.add(result)
+		r.finish()
+		wg.Wait()
+
+		// Watchers that attach late still get every event.
+		for _, events := range watched {
+			assert.Equal(t, []sailapi.Event{first, result}, events)
+		}
+		assert.False(t, canceled)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		canceled := make(chan struct{})
+		r := newRebuildRun(func() { close(canceled) })
+
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		errs := make(chan error, 2)
+		for _, ctx := range []context.Context{ctx1, ctx2} {
+			// Both watchers are counted before either can leave.
+			r.acquire()
+			go func(ctx context.Context) {
+				defer r.release()
+				errs <- r.watch(ctx, func(sailapi.Event) error { return nil })
+			}(ctx)
+		}
+		r.add(sailapi.Event{Type: sailapi.EventPhaseStart, Phase: sailapi.PhaseBuild})
+
+		cancel1()
+		require.Error(t, <-errs)
+		select {
+		case <-canceled:
+			t.Fatal("rebuild canceled while it's still watched")
+		case <-time.After(time.Millisecond * 50):
+		}
+
+		cancel2()
+		require.Error(t, <-errs)
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("rebuild not canceled once it's no longer watched")
+		}
+	})
+}
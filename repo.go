@@ -1,17 +1,12 @@
 package main
 
 import (
-	"context"
 	"fmt"
-	"net/http"
 	"net/url"
 	"path"
 	"strings"
 
-	"github.com/google/go-github/v24/github"
 	"golang.org/x/xerrors"
-
-	"go.coder.com/flog"
 )
 
 type repo struct {
@@ -109,27 +104,6 @@ func parseRepo(defaultSchema, defaultHost, defaultOrganization, name string) (re
 	return r, nil
 }
 
-// language returns the language of a repository using github's detected language.
-// This is a best effort try and will return the empty string if something fails.
-func (r repo) language() string {
-	orgRepo := strings.SplitN(r.trimPath(), "/", 2)
-	if len(orgRepo) != 2 {
-		return ""
-	}
-
-	repo, resp, err := github.NewClient(nil).Repositories.Get(context.Background(), orgRepo[0], orgRepo[1])
-	if err != nil {
-		flog.Error("unable to get repo language: %v", err)
-		return ""
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return ""
-	}
-
-	return repo.GetLanguage()
-}
-
 func isAllowedSchema(s string) bool {
 	return s == "http" ||
 		s == "https" ||
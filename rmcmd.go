@@ -69,6 +69,10 @@ func (c *rmcmd) getRemovalList() []string {
 			flog.Error("container %v doesn't have a name.", cnt.ID)
 			continue
 		}
+		// Previous containers are removed along with their project.
+		if isPreviousCnt(name, cnt.Labels) {
+			continue
+		}
 
 		names = append(names, name)
 	}
@@ -84,11 +88,17 @@ func (c *rmcmd) removeContainers(names ...string) {
 	defer cancel()
 
 	for _, name := range names {
+		runOnStop(name)
+
 		err := dockutil.StopRemove(ctx, cli, name)
 		if err != nil {
 			flog.Error("failed to remove %s: %v", name, err)
 			continue
 		}
+		err = removeIfExists(ctx, cli, previousCntName(name))
+		if err != nil {
+			flog.Error("failed to remove previous container of %s: %v", name, err)
+		}
 		if c.withData {
 			root := c.gf.config().ProjectRoot
 			path := filepath.Join(root, c.repoArg)
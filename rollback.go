@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/randstr"
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// When sail edit replaces a project's container, the original is stopped and
+// kept as the project's previous container so that `sail edit -rollback` can
+// swap back to it. It's removed once the grace period passes.
+
+// defaultEditGracePeriod is how long the previous container is kept if
+// the config doesn't set edit_grace_period.
+const defaultEditGracePeriod = time.Hour
+
+// previousCntName returns the name of the previous container of the
+// project container named cntName.
+func previousCntName(cntName string) string {
+	return cntName + "-previous"
+}
+
+// isPreviousCnt reports whether the container named cntName, with labels,
+// is the previous container of a project. The name alone isn't enough, as
+// the name of a project can end in -previous too.
+func isPreviousCnt(cntName string, labels map[string]string) bool {
+	projectCnt, ok := labels[projectCntLabel]
+	return ok && cntName == previousCntName(projectCnt)
+}
+
+// previousExpiryPath returns the file holding the time at which the previous
+// container of cntName is removed. Container labels can't be changed once the
+// container is created, so the expiry is stored on the host.
+func previousExpiryPath(cntName string) string {
+	return filepath.Join(metaRoot(), cntName, "previous_expiry")
+}
+
+// editGracePeriod returns how long the previous container is kept.
+func (p *project) editGracePeriod() (time.Duration, error) {
+	if p.conf.EditGracePeriod == "" {
+		return defaultEditGracePeriod, nil
+	}
+	d, err := time.ParseDuration(p.conf.EditGracePeriod)
+	if err != nil {
+		return 0, xerrors.Errorf("invalid edit_grace_period: %w", err)
+	}
+	return d, nil
+}
+
+// removeIfExists stops and removes the container named cntName if it exists.
+func removeIfExists(ctx context.Context, cli *client.Client, cntName string) error {
+	err := dockutil.StopRemove(ctx, cli, cntName)
+	if err != nil && !isContainerNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// swapContainers makes the container named next the project's container.
+// The current container is stopped and kept as the project's previous container,
+// replacing any existing one. If the swap fails, the current container is restored.
+func swapContainers(ctx context.Context, cli *client.Client, proj *project, next string) error {
+	name := proj.cntName()
+	prev := previousCntName(name)
+
+	err := removeIfExists(ctx, cli, prev)
+	if err != nil {
+		return xerrors.Errorf("failed to remove %v: %w", prev, err)
+	}
+
+	err = rebuildEvents.phase(sailapi.PhaseStop, func() error {
+		runOnStop(name)
+		err := cli.ContainerStop(ctx, name, dockutil.DurationPtr(time.Second))
+		if err != nil {
+			return xerrors.Errorf("failed to stop %v: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return rebuildEvents.phase(sailapi.PhaseSwap, func() error {
+		return renameSwap(ctx, cli, name, prev, next)
+	})
+}
+
+// renameSwap renames the stopped container name to prev, and next to name.
+// If either fails, name is restored and started again.
+func renameSwap(ctx context.Context, cli *client.Client, name, prev, next string) error {
+	err := cli.ContainerRename(ctx, name, prev)
+	if err != nil {
+		restoreErr := cli.ContainerStart(ctx, name, types.ContainerStartOptions{})
+		if restoreErr != nil {
+			flog.Error("failed to restart %v: %v", name, restoreErr)
+		}
+		return xerrors.Errorf("failed to rename %v to %v: %w", name, prev, err)
+	}
+
+	err = cli.ContainerRename(ctx, next, name)
+	if err != nil {
+		restoreErr := cli.ContainerRename(ctx, prev, name)
+		if restoreErr == nil {
+			restoreErr = cli.ContainerStart(ctx, name, types.ContainerStartOptions{})
+		}
+		if restoreErr != nil {
+			flog.Error("failed to restore %v: %v", name, restoreErr)
+		}
+		return xerrors.Errorf("failed to rename %v to %v: %w", next, name, err)
+	}
+
+	return nil
+}
+
+// keepPrevious records when the previous container of proj expires, or removes
+// it right away if the grace period is zero.
+func keepPrevious(ctx context.Context, cli *client.Client, proj *project) error {
+	grace, err := proj.editGracePeriod()
+	if err != nil {
+		return err
+	}
+
+	if grace <= 0 {
+		_ = os.Remove(previousExpiryPath(proj.cntName()))
+		return removeIfExists(ctx, cli, previousCntName(proj.cntName()))
+	}
+
+	path := previousExpiryPath(proj.cntName())
+	err = os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(grace).Format(time.RFC3339)
+	err = ioutil.WriteFile(path, []byte(expiry+"\n"), 0640)
+	if err != nil {
+		return xerrors.Errorf("failed to write %v: %w", path, err)
+	}
+
+	flog.Info("keeping the previous container for %v, roll back with sail edit -rollback", grace)
+	return nil
+}
+
+// pruneExpiredPrevious removes the previous container of cntName once
+// its grace period has passed.
+func pruneExpiredPrevious(cntName string) error {
+	path := previousExpiryPath(cntName)
+	byt, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	expiry, err := time.Parse(time.RFC3339, strings.TrimSpace(string(byt)))
+	if err != nil {
+		return xerrors.Errorf("invalid expiry in %v: %w", path, err)
+	}
+	if time.Now().Before(expiry) {
+		return nil
+	}
+
+	cli := dockerClient()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	err = removeIfExists(ctx, cli, previousCntName(cntName))
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// refreshProxy tells the project's proxy that its container was replaced
+// so it picks up the new code-server port right away.
+func refreshProxy(cntName string) error {
+	c, err := apiClient(cntName)
+	if err != nil {
+		return err
+	}
+	return c.Refresh(context.Background())
+}
+
+// rollbackEdit swaps the project's container with its previous container.
+// The current container becomes the previous container, so a rollback
+// can itself be rolled back.
+func rollbackEdit(proj *project) error {
+	cli := dockerClient()
+	defer cli.Close()
+
+	ctx := context.Background()
+
+	unlock, err := lockEdit(ctx, proj.cntName())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	prev := previousCntName(proj.cntName())
+	_, err = cli.ContainerInspect(ctx, prev)
+	if err != nil {
+		if isContainerNotFoundError(err) {
+			return xerrors.Errorf("%v has no previous container to roll back to", proj.cntName())
+		}
+		return err
+	}
+
+	// Free up the previous container's name so the swap can keep the current one.
+	next := proj.cntName() + "-rollback-" + randstr.Make(5)
+	err = cli.ContainerRename(ctx, prev, next)
+	if err != nil {
+		return xerrors.Errorf("failed to rename %v: %w", prev, err)
+	}
+
+	err = rebuildEvents.phase(sailapi.PhaseWaitOnline, func() error {
+		return startReady(ctx, cli, proj, next)
+	})
+	if err != nil {
+		stopErr := cli.ContainerStop(ctx, next, dockutil.DurationPtr(time.Second))
+		if stopErr == nil {
+			stopErr = cli.ContainerRename(ctx, next, prev)
+		}
+		if stopErr != nil {
+			flog.Error("failed to restore %v: %v", prev, stopErr)
+		}
+		return err
+	}
+
+	err = swapContainers(ctx, cli, proj, next)
+	if err != nil {
+		return err
+	}
+	flog.Info("rolled back to the previous container")
+
+	err = refreshProxy(proj.cntName())
+	if err != nil {
+		flog.Error("failed to refresh proxy: %v", err)
+	}
+	return keepPrevious(ctx, cli, proj)
+}
+
+// startReady starts the stopped container named cntName and waits
+// for it to be online and ready.
+func startReady(ctx context.Context, cli *client.Client, proj *project, cntName string) error {
+	err := cli.ContainerStart(ctx, cntName, types.ContainerStartOptions{})
+	if err != nil {
+		return xerrors.Errorf("failed to start %v: %w", cntName, err)
+	}
+
+	err = runHook(cntName, onStartHook)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := proj.onlineTimeout()
+	if err != nil {
+		return err
+	}
+	err = waitOnline(cntName, timeout)
+	if err != nil {
+		return err
+	}
+	return waitReady(cntName)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_isPreviousCnt(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		cntName string
+		labels  map[string]string
+		want    bool
+	}{
+		{"Previous", "cdr_sail-previous", map[string]string{projectCntLabel: "cdr_sail"}, true},
+		{"Project", "cdr_sail", map[string]string{projectCntLabel: "cdr_sail"}, false},
+		{"ProjectNamedPrevious", "cdr_sail-previous", map[string]string{projectCntLabel: "cdr_sail-previous"}, false},
+		{"Builder", "cdr_sail-builder-abcde", map[string]string{projectCntLabel: "cdr_sail"}, false},
+		{"NoLabel", "cdr_sail-previous", nil, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.want, isPreviousCnt(tt.cntName, tt.labels))
+		})
+	}
+}
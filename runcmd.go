@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"flag"
-	"net/http"
 	"os"
 	"time"
 
@@ -12,6 +11,7 @@ import (
 	"go.coder.com/cli"
 	"go.coder.com/flog"
 	"go.coder.com/sail/internal/dockutil"
+	"go.coder.com/sail/internal/sailapi"
 )
 
 type runcmd struct {
@@ -26,6 +26,10 @@ type runcmd struct {
 
 	rebuild bool
 	noOpen  bool
+
+	env     envFlag
+	envFile string
+	gpg     bool
 }
 
 type schemaPrefs struct {
@@ -92,6 +96,9 @@ func (c *runcmd) RegisterFlags(fl *flag.FlagSet) {
 	fl.BoolVar(&c.https, "https", false, "Clone repo over HTTPS")
 	fl.BoolVar(&c.rebuild, "rebuild", false, "Delete existing container")
 	fl.BoolVar(&c.noOpen, "no-open", false, "Don't open an editor session")
+	fl.Var(&c.env, "env", "Set an environment variable in the container as KEY=VALUE, or pass KEY through from the host. Repeatable.")
+	fl.StringVar(&c.envFile, "env-file", "", "Read environment variables for the container from a .env file.")
+	fl.BoolVar(&c.gpg, "gpg", false, "Forward the host's gpg-agent so commits can be signed. Kept by sail edit.")
 }
 
 const guestHomeDir = "/home/user"
@@ -118,19 +125,22 @@ func (c *runcmd) Run(fl *flag.FlagSet) {
 	if exists {
 		c.gf.debug("opening existing project")
 
+		err = ensureProxy(c.gf.configPath, proj.cntName())
+		if err != nil {
+			flog.Error("%v", err)
+		}
+
 		u, err := proj.proxyURL()
 		if err != nil {
 			flog.Fatal("%v", err)
 		}
 
-		resp, err := http.Get(u + "/sail/api/v1/heartbeat")
+		err = sailapi.New(u, "", proxyHTTPClient).Healthz(context.Background())
 		if err == nil {
-			resp.Body.Close()
-
 			if c.noOpen {
 				os.Exit(0)
 			}
-			err = proj.open()
+			err = proj.open(c.gf.configPath)
 			if err != nil {
 				flog.Error("failed to open project: %v", err)
 				err = proj.delete()
@@ -151,6 +161,8 @@ func (c *runcmd) Run(fl *flag.FlagSet) {
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 		defer cancel()
 
+		runOnStop(proj.cntName())
+
 		err = dockutil.StopRemove(ctx, cli, proj.cntName())
 		if err != nil {
 			flog.Fatal("failed to remove container without running proxy: %v", err)
@@ -163,6 +175,8 @@ func (c *runcmd) Run(fl *flag.FlagSet) {
 	if err != nil {
 		flog.Fatal("%v", err)
 	}
+	// The project may have just been cloned, so pick up its committed config.
+	c.gf.resolveProjectConfig(proj)
 
 	var image string
 	if c.image != "" {
@@ -174,7 +188,13 @@ func (c *runcmd) Run(fl *flag.FlagSet) {
 			flog.Fatal("failed to build image: %v", err)
 		}
 		if !customImageExists {
-			image = proj.defaultRepoImage()
+			var det languageDetection
+			image, det = proj.defaultRepoImage()
+			if det.lang != "" {
+				c.gf.debug("detected language %v: %v", det.lang, det.reason)
+			} else {
+				c.gf.debug("failed to detect language: %v", det.reason)
+			}
 			flog.Info("using default image %v", image)
 
 			err = ensureImage(image)
@@ -191,8 +211,8 @@ func (c *runcmd) Run(fl *flag.FlagSet) {
 	switch {
 	case c.hat != "":
 		hatPath = c.hat
-	case c.gf.config().DefaultHat != "":
-		hatPath = c.gf.config().DefaultHat
+	case proj.conf.DefaultHat != "":
+		hatPath = proj.conf.DefaultHat
 	}
 
 	hostHomeDir, err := os.UserHomeDir()
@@ -212,9 +232,22 @@ func (c *runcmd) Run(fl *flag.FlagSet) {
 		cntName:         proj.cntName(),
 		hostname:        proj.repo.BaseName(),
 		// Use `0` as the port so that the host assigns an available one.
-		port:    "0",
-		testCmd: c.testCmd,
+		port:       "0",
+		testCmd:    c.testCmd,
+		forwardGPG: c.gpg,
+	}
+	err = r.applyConfig(proj.conf)
+	if err != nil {
+		flog.Fatal("invalid project config: %v", err)
+	}
+
+	if c.envFile != "" {
+		r.runEnv, err = readEnvFile(c.envFile)
+		if err != nil {
+			flog.Fatal("failed to read env file: %v", err)
+		}
 	}
+	r.runEnv = append(r.runEnv, c.env...)
 
 	err = c.build(c.gf, proj, b, r)
 	if err != nil {
@@ -235,7 +268,7 @@ func (c *runcmd) Run(fl *flag.FlagSet) {
 		os.Exit(0)
 	}
 
-	err = proj.open()
+	err = proj.open(c.gf.configPath)
 	if err != nil {
 		flog.Fatal("failed to open project: %w", err)
 	}
@@ -254,7 +287,7 @@ func (c *runcmd) build(gf *globalFlags, proj *project, b *hatBuilder, r *runner)
 	}
 
 	// TODO proxy if container already exists.
-	err = r.forkProxy()
+	err = r.startProxy(gf.configPath)
 	if err != nil {
 		return xerrors.Errorf("failed to start proxy: %w", err)
 	}
@@ -264,6 +297,11 @@ func (c *runcmd) build(gf *globalFlags, proj *project, b *hatBuilder, r *runner)
 		return xerrors.Errorf("failed to run container: %w", err)
 	}
 
+	err = r.registerProxy()
+	if err != nil {
+		return err
+	}
+
 	gf.debug("started container")
 
 	err = proj.waitOnline()
@@ -280,5 +318,10 @@ func (c *runcmd) build(gf *globalFlags, proj *project, b *hatBuilder, r *runner)
 	}
 
 	gf.debug("code-server online")
+
+	err = waitReady(proj.cntName())
+	if err != nil {
+		return xerrors.Errorf("project failed to become ready: %w", err)
+	}
 	return nil
 }
@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -18,6 +18,7 @@ import (
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/strslice"
 	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
 	"golang.org/x/xerrors"
 
 	"go.coder.com/flog"
@@ -43,12 +44,29 @@ const (
 	projectDirLabel      = sailLabel + ".project_dir"
 	projectNameLabel     = sailLabel + ".project_name"
 	proxyURLLabel        = sailLabel + ".proxy_url"
+	// projectCntLabel holds the name of the project's container. Containers
+	// started by sail edit are renamed, so it tells them apart from the
+	// project's own container, see isPreviousCnt.
+	projectCntLabel = sailLabel + ".project_cnt"
+	// runEnvLabel holds the names of the environment variables set
+	// through `sail run --env`, so that `sail edit` can keep them.
+	// Their values are read back from the container's config.
+	runEnvLabel = sailLabel + ".run_env"
+	// forwardGPGLabel is set when the host's gpg-agent is forwarded
+	// into the container.
+	forwardGPGLabel = sailLabel + ".forward_gpg"
+	// dotfilesLabel holds the dotfiles repository and revision
+	// installed in the container, e.g `user/dotfiles@<commit>`.
+	dotfilesLabel = sailLabel + ".dotfiles"
 )
 
 // Docker labels for user configuration.
 const (
 	onStartLabel     = "on_start"
 	projectRootLabel = "project_root"
+	// passEnvLabelPrefix declares a host environment variable to pass
+	// through to the container, e.g `pass_env.GITHUB_TOKEN="GITHUB_TOKEN"`.
+	passEnvLabelPrefix = "pass_env."
 )
 
 // runner holds all the information needed to assemble a new sail container.
@@ -59,6 +77,10 @@ type runner struct {
 	cntName     string
 	projectName string
 
+	// projectCntName is the name of the project's container. It differs
+	// from cntName while sail edit creates the replacement container.
+	projectCntName string
+
 	hostname string
 
 	port string
@@ -68,6 +90,128 @@ type runner struct {
 	testCmd string
 
 	proxyURL string
+
+	// proxyMode is either proxyModeDaemon or proxyModeFork.
+	proxyMode string
+	// daemonAddr is the address the sail daemon listens on
+	// and daemonURL is the URL it's reached on.
+	daemonAddr string
+	daemonURL  string
+
+	// env holds additional environment variables in KEY=VALUE form
+	// from the project's config.
+	env []string
+
+	// runEnv holds environment variables in KEY=VALUE form passed
+	// to `sail run` through flags. They take precedence over env.
+	runEnv []string
+
+	// secrets are mounted into the container's secret tmpfs.
+	// They are never stored on the container.
+	secrets []secret
+
+	// forwardGitIdentity and forwardGitCredentials share the host's
+	// git setup with the container.
+	forwardGitIdentity    bool
+	forwardGitCredentials bool
+
+	// forwardGPG forwards the host's gpg-agent into the container.
+	forwardGPG bool
+
+	// dotfiles is installed into the container if set.
+	dotfiles *dotfiles
+
+	// probes are the readiness probes from the project's config.
+	probes map[string]probe
+
+	// idleTimeout is how long the container can go unused
+	// before the proxy stops it.
+	idleTimeout string
+
+	// codeServerVersion is the version of code-server from the config.
+	// codeServerMirror is where it's downloaded from, and codeServerOffline
+	// restricts it to cached binaries.
+	codeServerVersion string
+	codeServerMirror  string
+	codeServerOffline bool
+
+	// rebuilt is set when the container replaces an existing one
+	// of the project, in which case the on_create hook isn't run.
+	rebuilt bool
+
+	// cpus and memory limit the container's resources.
+	// Zero means unlimited.
+	cpus   float64
+	memory int64
+}
+
+// applyConfig applies the project config's environment and
+// resource limits to the runner.
+// Any env_from commands are run on the host to resolve their values.
+func (r *runner) applyConfig(conf config) error {
+	keys := make([]string, 0, len(conf.Env))
+	for k := range conf.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r.env = nil
+	for _, k := range keys {
+		r.env = append(r.env, k+"="+conf.Env[k])
+	}
+
+	envs, secrets, err := resolveEnvSources(context.Background(), conf.EnvFrom)
+	if err != nil {
+		return err
+	}
+	r.env = append(r.env, envs...)
+	r.secrets = secrets
+
+	r.forwardGitIdentity = conf.Git.ForwardIdentity
+	r.forwardGitCredentials = conf.Git.ForwardCredentials
+	// GPG forwarding may have also been enabled with `sail run --gpg`.
+	r.forwardGPG = r.forwardGPG || conf.Git.ForwardGPG
+
+	r.dotfiles = nil
+	if conf.Dotfiles.Repo != "" {
+		repo, err := parseRepo(conf.DefaultSchema, conf.DefaultHost, conf.DefaultOrganization, conf.Dotfiles.Repo)
+		if err != nil {
+			return xerrors.Errorf("invalid dotfiles.repo: %w", err)
+		}
+		r.dotfiles = &dotfiles{
+			repo:    repo,
+			install: conf.Dotfiles.Install,
+		}
+		err = r.dotfiles.sync()
+		if err != nil {
+			return xerrors.Errorf("failed to sync dotfiles: %w", err)
+		}
+	}
+
+	r.probes = conf.Probes
+	r.idleTimeout = conf.IdleTimeout
+	r.codeServerVersion = conf.CodeServerVersion
+	r.codeServerMirror = conf.CodeServerMirror
+	r.codeServerOffline = conf.CodeServerOffline
+
+	r.proxyMode = conf.Proxy
+	if r.proxyMode == "" {
+		r.proxyMode = proxyModeDaemon
+	}
+	r.daemonAddr = daemonAddress(conf)
+	r.daemonURL = daemonURL(r.daemonAddr, conf.TLS.Enabled)
+
+	r.cpus = conf.Resources.CPUs
+	r.memory = 0
+	if conf.Resources.Memory != "" {
+		mem, err := units.RAMInBytes(conf.Resources.Memory)
+		if err != nil {
+			return xerrors.Errorf("invalid resources.memory %q: %w", conf.Resources.Memory, err)
+		}
+		r.memory = mem
+	}
+
+	return nil
 }
 
 // runContainer creates and runs a new container.
@@ -75,8 +219,8 @@ type runner struct {
 // the container's root process.
 // We want code-server to be the root process as it gives us the nice guarantee that
 // the container is only online when code-server is working.
-// Additionally, runContainer also runs the image's `on_start` label as a bash
-// command inside of the project directory.
+// Additionally, runContainer also runs the image's `on_create` and `on_start`
+// hooks inside of the project directory.
 func (r *runner) runContainer(image string) error {
 	cli := dockerClient()
 	defer cli.Close()
@@ -91,20 +235,30 @@ func (r *runner) runContainer(image string) error {
 
 	var envs []string
 	envs = r.environment(envs)
+	envs, err = r.imageDefinedEnv(image, envs)
+	if err != nil {
+		return xerrors.Errorf("failed to add image defined environment: %w", err)
+	}
+	envs = append(envs, r.runEnv...)
+	envs = dedupeEnv(envs)
+
+	runEnvNames := make([]string, 0, len(r.runEnv))
+	for _, env := range r.runEnv {
+		runEnvNames = append(runEnvNames, envKey(env))
+	}
 
 	containerConfig := &container.Config{
 		Hostname: r.hostname,
 		Env:      envs,
-		Cmd: strslice.StrSlice{
-			"bash", "-c", r.constructCommand(projectDir),
-		},
-		Image: image,
+		Image:    image,
 		Labels: map[string]string{
 			sailLabel:            "",
 			projectDirLabel:      projectDir,
 			projectLocalDirLabel: r.projectLocalDir,
 			projectNameLabel:     r.projectName,
+			projectCntLabel:      r.projectCnt(),
 			proxyURLLabel:        r.proxyURL,
+			runEnvLabel:          strings.Join(runEnvNames, ","),
 		},
 		// The user inside has uid 1000. This works even on macOS where the default user has uid 501.
 		// See https://stackoverflow.com/questions/43097341/docker-on-macosx-does-not-translate-file-ownership-correctly-in-volumes
@@ -112,19 +266,51 @@ func (r *runner) runContainer(image string) error {
 		User: "",
 	}
 
+	if r.forwardGPG {
+		containerConfig.Labels[forwardGPGLabel] = "true"
+	}
+	if r.dotfiles != nil {
+		containerConfig.Labels[dotfilesLabel] = r.dotfiles.String()
+	}
+	if r.idleTimeout != "" {
+		containerConfig.Labels[idleTimeoutLabel] = r.idleTimeout
+	}
+
 	err = r.addImageDefinedLabels(image, containerConfig.Labels)
 	if err != nil {
 		return xerrors.Errorf("failed to add image defined labels: %w", err)
 	}
 
+	err = r.addProbesLabel(image, containerConfig.Labels)
+	if err != nil {
+		return err
+	}
+
 	var mounts []mount.Mount
 	mounts = r.addHatMount(mounts, containerConfig.Labels)
 
+	mounts = r.dotfilesMounts(mounts)
+
+	mounts, codeServerPath, err := r.codeServerMount(mounts, image, containerConfig.Labels)
+	if err != nil {
+		return err
+	}
+	containerConfig.Cmd = strslice.StrSlice{
+		"bash", "-c", r.constructCommand(projectDir, codeServerPath),
+	}
+
 	mounts, err = r.mounts(mounts, image)
 	if err != nil {
 		return xerrors.Errorf("failed to assemble mounts: %w", err)
 	}
 
+	if len(r.secrets) > 0 {
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeTmpfs,
+			Target: containerSecretsDir,
+		})
+	}
+
 	hostConfig, err := r.hostConfig(containerConfig, mounts)
 	if err != nil {
 		return err
@@ -140,9 +326,32 @@ func (r *runner) runContainer(image string) error {
 		return xerrors.Errorf("failed to start container: %w", err)
 	}
 
-	err = r.runOnStart(image)
+	err = r.writeSecrets()
+	if err != nil {
+		return xerrors.Errorf("failed to write secrets: %w", err)
+	}
+
+	err = r.configureGit()
+	if err != nil {
+		// Images without git can still be used.
+		flog.Error("failed to configure git: %v", err)
+	}
+
+	err = r.installDotfiles()
 	if err != nil {
-		return xerrors.Errorf("failed to run on_start label in container: %w", err)
+		return xerrors.Errorf("failed to install dotfiles: %w", err)
+	}
+
+	if !r.rebuilt {
+		err = runHook(r.cntName, onCreateHook)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = runHook(r.cntName, onStartHook)
+	if err != nil {
+		return err
 	}
 
 	return nil
@@ -150,7 +359,7 @@ func (r *runner) runContainer(image string) error {
 
 // constructCommand constructs the code-server command that will be used
 // as the Sail container's init process.
-func (r *runner) constructCommand(projectDir string) string {
+func (r *runner) constructCommand(projectDir, codeServerPath string) string {
 	containerAddr := "localhost"
 	containerPort := r.port
 	if runtime.GOOS == "darwin" {
@@ -169,9 +378,9 @@ cd %v
 # This is necessary in case the .vscode directory wasn't created inside the container, as mounting to the host
 # extension dir will create it as root.
 sudo chown user:user ~/.vscode
-/usr/bin/code-server --host %v --port %v --user-data-dir ~/.config/Code --extensions-dir %v --extra-extensions-dir ~/.vscode/extensions --auth=none \
+%v%v --host %v --port %v --user-data-dir ~/.config/Code --extensions-dir %v --extra-extensions-dir ~/.vscode/extensions --auth=none \
 --allow-http 2>&1 | tee %v`,
-		projectDir, containerAddr, containerPort, hostExtensionsDir, containerLogPath)
+		projectDir, r.gpgSetupCommand(), codeServerPath, containerAddr, containerPort, hostExtensionsDir, containerLogPath)
 
 	if r.testCmd != "" {
 		cmd = r.testCmd + "\n exit 1"
@@ -180,6 +389,15 @@ sudo chown user:user ~/.vscode
 	return cmd
 }
 
+// gpgSetupCommand returns the commands that fix up the permissions of the gpg
+// home directory, which docker creates as root when mounting the gpg-agent socket.
+func (r *runner) gpgSetupCommand() string {
+	if !r.forwardGPG {
+		return ""
+	}
+	return fmt.Sprintf("sudo chown user:user %[1]v && chmod 700 %[1]v\n", containerGnuPGHome)
+}
+
 // hostConfig constructs the container.HostConfig required for starting the sail container.
 func (r *runner) hostConfig(containerConfig *container.Config, mounts []mount.Mount) (*container.HostConfig, error) {
 	hostConfig := &container.HostConfig{
@@ -189,6 +407,10 @@ func (r *runner) hostConfig(containerConfig *container.Config, mounts []mount.Mo
 		ExtraHosts: []string{
 			r.hostname + ":127.0.0.1",
 		},
+		Resources: container.Resources{
+			NanoCPUs: int64(r.cpus * 1e9),
+			Memory:   r.memory,
+		},
 	}
 
 	// macOS does not support host networking.
@@ -228,9 +450,66 @@ func (r *runner) environment(envs []string) []string {
 		}
 	}
 
+	envs = append(envs, r.env...)
+
+	for _, s := range r.secrets {
+		envs = append(envs, s.name+"_FILE="+s.containerPath())
+	}
+
 	return envs
 }
 
+// imageDefinedEnv adds the host environment variables that the image
+// declares with pass_env labels.
+func (r *runner) imageDefinedEnv(image string, envs []string) ([]string, error) {
+	cli := dockerClient()
+	defer cli.Close()
+
+	ins, _, err := cli.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to inspect %v: %w", image, err)
+	}
+
+	var passEnvs []string
+	for k, hostVar := range ins.ContainerConfig.Labels {
+		if !strings.HasPrefix(k, passEnvLabelPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, passEnvLabelPrefix)
+		if hostVar == "" {
+			hostVar = name
+		}
+
+		val, ok := os.LookupEnv(hostVar)
+		if !ok {
+			flog.Info("not passing %v to the container: %v is not set on the host", name, hostVar)
+			continue
+		}
+		passEnvs = append(passEnvs, name+"="+val)
+	}
+	sort.Strings(passEnvs)
+
+	return append(envs, passEnvs...), nil
+}
+
+// writeSecrets writes the runner's secrets into the container's secret tmpfs.
+// The values are piped through stdin so they never appear in the container's
+// config or in a process' arguments.
+func (r *runner) writeSecrets() error {
+	for _, s := range r.secrets {
+		cmd := dockutil.ExecUser(r.cntName, "root", "sh", "-c",
+			fmt.Sprintf("umask 077 && cat > %[1]v && chown 1000:1000 %[1]v", s.containerPath()),
+		)
+		cmd.Stdin = strings.NewReader(s.value)
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("failed to write secret %v: %s: %w", s.name, out, err)
+		}
+	}
+	return nil
+}
+
 // addHatMount mounts the hat into the user's container if they've specified one.
 func (r *runner) addHatMount(mounts []mount.Mount, labels map[string]string) []mount.Mount {
 	hatPath, ok := labels[hatLabel]
@@ -262,6 +541,16 @@ func (r *runner) mounts(mounts []mount.Mount, image string) ([]mount.Mount, erro
 
 	mounts = mountGUI(mounts)
 
+	mounts, err := r.gitMounts(mounts)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err = r.gpgMounts(mounts)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to forward gpg-agent: %w", err)
+	}
+
 	// 'SSH_AUTH_SOCK' is provided by a running ssh-agent. Passing in the
 	// socket to the container allows for using the user's existing setup for
 	// ssh authentication instead of having to create a new keys or explicity
@@ -274,8 +563,8 @@ func (r *runner) mounts(mounts []mount.Mount, image string) ([]mount.Mount, erro
 		})
 	}
 
-	localGlobalStorageDir := filepath.Join(metaRoot(), r.cntName, "globalStorage")
-	err := os.MkdirAll(localGlobalStorageDir, 0750)
+	localGlobalStorageDir := filepath.Join(metaRoot(), r.projectCnt(), "globalStorage")
+	err = os.MkdirAll(localGlobalStorageDir, 0750)
 	if err != nil {
 		return nil, err
 	}
@@ -299,17 +588,6 @@ func (r *runner) mounts(mounts []mount.Mount, image string) ([]mount.Mount, erro
 		Target: projectDir,
 	})
 
-	// Mount in code-server
-	codeServerBinPath, err := loadCodeServer(context.Background())
-	if err != nil {
-		return nil, xerrors.Errorf("failed to load code-server: %w", err)
-	}
-	mounts = append(mounts, mount.Mount{
-		Type:   mount.TypeBind,
-		Source: codeServerBinPath,
-		Target: "/usr/bin/code-server",
-	})
-
 	// We take the mounts from the final image so that it includes the hat and the baseImage.
 	mounts, err = r.imageDefinedMounts(image, mounts)
 	if err != nil {
@@ -326,6 +604,43 @@ func (r *runner) mounts(mounts []mount.Mount, image string) ([]mount.Mount, erro
 	return mounts, nil
 }
 
+// codeServerMount mounts in the code-server binary of the version resolved
+// for image, and records the version in labels. It returns the path of
+// code-server in the container, which is looked up in the PATH if the
+// image's own code-server is used.
+func (r *runner) codeServerMount(mounts []mount.Mount, image string, labels map[string]string) ([]mount.Mount, string, error) {
+	const binTarget = "/usr/bin/code-server"
+
+	cli := dockerClient()
+	defer cli.Close()
+
+	ctx := context.Background()
+	img, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return nil, "", xerrors.Errorf("failed to inspect %v: %w", image, err)
+	}
+
+	version, err := resolveCodeServerVersion(ctx, img.Config.Labels, r.codeServerVersion, r.codeServerOffline)
+	if err != nil {
+		return nil, "", xerrors.Errorf("failed to resolve code-server version: %w", err)
+	}
+	labels[codeServerVersionLabel] = version
+	if version == codeServerFromImage {
+		return mounts, "code-server", nil
+	}
+
+	binPath, err := loadCodeServer(ctx, r.codeServerMirror, version, r.codeServerOffline, false)
+	if err != nil {
+		return nil, "", xerrors.Errorf("failed to load code-server %v: %w", version, err)
+	}
+
+	return append(mounts, mount.Mount{
+		Type:   mount.TypeBind,
+		Source: binPath,
+		Target: binTarget,
+	}), binTarget, nil
+}
+
 // mountGUI mounts in any x11 sockets so that they can be used
 // inside the container.
 func mountGUI(mounts []mount.Mount) []mount.Mount {
@@ -421,6 +736,11 @@ func (r *runner) addImageDefinedLabels(image string, labels map[string]string) e
 		if !strings.HasPrefix(k, sailLabel) {
 			continue
 		}
+		// Snapshot images carry the labels of the container they were
+		// taken from, which must not replace the runner's own state.
+		if _, ok := labels[k]; ok {
+			continue
+		}
 
 		labels[k] = v
 	}
@@ -428,6 +748,37 @@ func (r *runner) addImageDefinedLabels(image string, labels map[string]string) e
 	return nil
 }
 
+// addProbesLabel stores the image's readiness probes merged with those
+// of the config on the container.
+func (r *runner) addProbesLabel(image string, labels map[string]string) error {
+	cli := dockerClient()
+	defer cli.Close()
+
+	img, _, err := cli.ImageInspectWithRaw(context.Background(), image)
+	if err != nil {
+		return xerrors.Errorf("failed to inspect image: %w", err)
+	}
+
+	imageProbes, err := probesFromLabels(img.Config.Labels)
+	if err != nil {
+		return err
+	}
+	probes, err := mergeProbes(imageProbes, r.probes)
+	if err != nil {
+		return err
+	}
+	if len(probes) == 0 {
+		return nil
+	}
+
+	byt, err := json.Marshal(probes)
+	if err != nil {
+		return xerrors.Errorf("failed to encode probes: %w", err)
+	}
+	labels[probesLabel] = string(byt)
+	return nil
+}
+
 func (r *runner) stripDuplicateMounts(mounts []mount.Mount) []mount.Mount {
 	rmounts := make([]mount.Mount, 0, len(mounts))
 
@@ -480,6 +831,15 @@ func (r *runner) projectDir(image string) (string, error) {
 	return filepath.Join(guestHomeDir, r.projectName), nil
 }
 
+// projectCnt returns the name of the project's container, which
+// host side state is stored under.
+func (r *runner) projectCnt() string {
+	if r.projectCntName != "" {
+		return r.projectCntName
+	}
+	return r.cntName
+}
+
 // runnerFromContainer gets a runner from container named
 // name.
 func runnerFromContainer(name string) (*runner, error) {
@@ -496,61 +856,94 @@ func runnerFromContainer(name string) (*runner, error) {
 		return nil, xerrors.Errorf("failed to find code server port: %w", err)
 	}
 
+	r := runnerFromConfig(name, cnt.Config)
+	r.port = port
+	return r, nil
+}
+
+// runnerFromConfig gets a runner for the container named name from
+// the state stored in the labels of a container or snapshot config.
+func runnerFromConfig(name string, cfg *container.Config) *runner {
 	return &runner{
 		cntName:         name,
-		hostname:        cnt.Config.Hostname,
-		port:            port,
-		projectLocalDir: cnt.Config.Labels[projectLocalDirLabel],
-		projectName:     cnt.Config.Labels[projectNameLabel],
-		proxyURL:        cnt.Config.Labels[proxyURLLabel],
-	}, nil
+		projectCntName:  name,
+		hostname:        cfg.Hostname,
+		projectLocalDir: cfg.Labels[projectLocalDirLabel],
+		projectName:     cfg.Labels[projectNameLabel],
+		proxyURL:        cfg.Labels[proxyURLLabel],
+		runEnv:          runEnvFromContainer(cfg.Env, cfg.Labels[runEnvLabel]),
+		forwardGPG:      cfg.Labels[forwardGPGLabel] == "true",
+	}
 }
 
-// runOnStart runs the image's `on_start` label in the container in the project directory.
-func (r *runner) runOnStart(image string) error {
-	cli := dockerClient()
-	defer cli.Close()
+// runEnvFromContainer picks the variables named in the run env label
+// out of the container's environment.
+func runEnvFromContainer(cntEnv []string, label string) []string {
+	if label == "" {
+		return nil
+	}
 
-	// Get project directory.
-	projectDir, err := r.projectDir(image)
-	if err != nil {
-		return err
+	names := make(map[string]struct{})
+	for _, name := range strings.Split(label, ",") {
+		names[name] = struct{}{}
 	}
-	projectDir = resolvePath(containerHome, projectDir)
 
-	// Get on_start label from image.
-	img, _, err := cli.ImageInspectWithRaw(context.Background(), image)
+	var envs []string
+	for _, env := range cntEnv {
+		if _, ok := names[envKey(env)]; ok {
+			envs = append(envs, env)
+		}
+	}
+	return envs
+}
+
+// startProxy makes sure there's a proxy for the container before it's
+// created, either the sail daemon or a proxy process forked for it. Either
+// is started with the global config at configPath.
+func (r *runner) startProxy(configPath string) error {
+	if r.proxyMode == proxyModeFork {
+		return r.forkProxy(configPath)
+	}
+
+	err := ensureDaemon(configPath, r.daemonURL, r.daemonAddr)
 	if err != nil {
-		return xerrors.Errorf("failed to inspect image: %w", err)
+		return err
 	}
-	onStartCmd, ok := img.Config.Labels[onStartLabel]
-	if !ok {
-		// No on_start label, so we quit early.
+	r.proxyURL = daemonProjectURL(r.daemonURL, r.cntName)
+	return nil
+}
+
+// registerProxy makes the daemon serve the container once it's created.
+// Forked proxies are already serving it.
+func (r *runner) registerProxy() error {
+	if r.proxyMode == proxyModeFork {
 		return nil
 	}
-
-	// Execute the command detached in the container.
-	cmd := dockutil.DetachedExecDir(r.cntName, projectDir, "/bin/bash", "-c", onStartCmd)
-	return cmd.Run()
+	return registerWithDaemon(r.daemonURL, r.cntName)
 }
 
-func (r *runner) forkProxy() error {
+func (r *runner) forkProxy(configPath string) error {
 	var err error
-	r.proxyURL, err = forkProxy(r.cntName)
+	r.proxyURL, err = forkProxy(configPath, r.cntName)
 	return err
 }
 
-func forkProxy(cntName string) (proxyURL string, _ error) {
-	sailProxy := exec.Command(os.Args[0], "proxy", cntName)
+func forkProxy(configPath, cntName string) (proxyURL string, _ error) {
+	sailProxy := sailCommand(configPath, "proxy", cntName)
 	stdout, err := sailProxy.StdoutPipe()
 	if err != nil {
 		return "", xerrors.Errorf("failed to create stdout pipe: %v", err)
 	}
 	defer stdout.Close()
 
-	f, err := ioutil.TempFile("", "sailproxy_"+cntName)
+	logPath := proxyLogPath(cntName)
+	err = os.MkdirAll(filepath.Dir(logPath), 0750)
+	if err != nil {
+		return "", xerrors.Errorf("failed to create %v: %w", filepath.Dir(logPath), err)
+	}
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
 	if err != nil {
-		return "", xerrors.Errorf("failed to open /tmp: %w", err)
+		return "", xerrors.Errorf("failed to open proxy log: %w", err)
 	}
 	defer f.Close()
 
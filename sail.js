@@ -1,13 +1,35 @@
 (function() {
+    // The phases of a rebuild, in the order they run in. See internal/sailapi.
+    const phaseNames = {
+        "build": "Building image",
+        "hat": "Applying hat",
+        "create": "Creating container",
+        "wait-online": "Waiting for the container to be ready",
+        "stop": "Stopping the old container",
+        "swap": "Switching to the new container",
+        "rollback": "Removing the new container",
+    }
+
     let oldonkeydown
-    function startReloadUI() {
+    let progress
+    function startReloadUI(cancel) {
         const div = document.createElement("div")
         div.className = "msgbox-overlay"
         div.style.opacity = 1
         div.style.textAlign = "center"
         div.innerHTML = `<div class="msgbox">
     <div class="msg">Rebuilding container</div>
+    <ul class="sail-phases" style="text-align: left; list-style: none; padding: 0"></ul>
+    <div class="sail-error" style="color: #f48771; white-space: pre-wrap"></div>
+    <button class="sail-cancel">Cancel</button>
     </div>`
+        div.querySelector(".sail-cancel").onclick = cancel
+        progress = {
+            phases: div.querySelector(".sail-phases"),
+            error: div.querySelector(".sail-error"),
+            cancel: div.querySelector(".sail-cancel"),
+            items: {},
+        }
         // Prevent keypresses.
         oldonkeydown = document.body.onkeydown
         document.body.onkeydown = ev => {
@@ -16,6 +38,36 @@
         document.querySelector(".monaco-workbench").appendChild(div)
     }
 
+    // showEvent shows the progress of the rebuild in the overlay.
+    function showEvent(ev) {
+        const v = ev.v || {}
+        let item = progress.items[v.phase]
+        if (!item && ev.type !== "result") {
+            item = document.createElement("li")
+            progress.phases.appendChild(item)
+            progress.items[v.phase] = item
+        }
+        const name = phaseNames[v.phase] || v.phase
+        switch (ev.type) {
+        case "phase_start":
+            item.textContent = "\u25B6 " + name
+            break
+        case "step":
+            item.textContent = `\u25B6 ${name}: step ${v.step}/${v.steps} ${v.message}`
+            break
+        case "phase_end":
+            item.textContent = (v.error ? "\u2717 " : "\u2713 ") + name
+            break
+        case "result":
+            progress.error.textContent = v.error || ""
+            break
+        }
+        // The old container is being replaced, which can't be undone.
+        if (ev.type === "phase_start" && (v.phase === "stop" || v.phase === "swap")) {
+            progress.cancel.disabled = true
+        }
+    }
+
     function removeElementsByClass(className) {
         let elements = document.getElementsByClassName(className);
         for (let e of elements) {
@@ -26,6 +78,7 @@
     function stopReloadUI() {
         document.body.onkeydown = oldonkeydown
         removeElementsByClass("msgbox-overlay")
+        progress = null
     }
 
     let tty
@@ -50,22 +103,43 @@
         tsrv.setActiveInstance(tty)
         tsrv.showPanel(true)
 
-        startReloadUI()
+        // Relative to the page so that it works when the sail daemon
+        // serves the project under a path prefix.
+        const rebuildURL = new URL("sail/api/v1/rebuild", location.href)
+        rebuildURL.protocol = location.protocol === "https:" ? "wss:" : "ws:"
+        const ws = new WebSocket(rebuildURL.href)
 
-        const ws = new WebSocket("ws://" + location.host + "/sail/api/v1/reload")
-        ws.onmessage = (ev) => {
-            const msg = JSON.parse(ev.data)
-            const out = atob(msg.v).replace(/\n/g, "\n\r")
-            tty.write(out)
-        }
-        ws.onclose = (ev) => {
-            if (ev.code === 1000) {
-                tsrv.setActiveInstance(oldTTY)
-            } else {
-                alert("reload failed; please see logs in sail terminal")
+        let canceled = false
+        // Closing the socket cancels the rebuild.
+        startReloadUI(() => {
+            canceled = true
+            ws.close()
+        })
+
+        let result
+        ws.onmessage = (msg) => {
+            const ev = JSON.parse(msg.data)
+            switch (ev.type) {
+            case "data":
+                tty.write(atob(ev.v).replace(/\n/g, "\n\r"))
+                return
+            case "result":
+                result = ev.v
+                if (result.error) {
+                    tty.write(result.error.replace(/\n/g, "\n\r") + "\n\r")
+                }
+                break
             }
+            showEvent(ev)
+        }
+        ws.onclose = () => {
             stopReloadUI()
             rebuilding = false
+            if (result && !result.error) {
+                tsrv.setActiveInstance(oldTTY)
+            } else if (!canceled) {
+                alert("rebuild failed; please see logs in sail terminal")
+            }
         }
     }
 
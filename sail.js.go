@@ -1,4 +1,4 @@
 package main
 
 //go:generate go run sail.js_gen.go
-const sailJS = "(function() {\n    let oldonkeydown\n    function startReloadUI() {\n        const div = document.createElement(\"div\")\n        div.className = \"msgbox-overlay\"\n        div.style.opacity = 1\n        div.style.textAlign = \"center\"\n        div.innerHTML = `<div class=\"msgbox\">\n    <div class=\"msg\">Rebuilding container</div>\n    </div>`\n        // Prevent keypresses.\n        oldonkeydown = document.body.onkeydown\n        document.body.onkeydown = ev => {\n            ev.stopPropagation()\n        }\n        document.querySelector(\".monaco-workbench\").appendChild(div)\n    }\n\n    function removeElementsByClass(className) {\n        let elements = document.getElementsByClassName(className);\n        for (let e of elements) {\n            e.parentNode.removeChild(e)\n        }\n    }\n\n    function stopReloadUI() {\n        document.body.onkeydown = oldonkeydown\n        removeElementsByClass(\"msgbox-overlay\")\n    }\n\n    let tty\n    let rebuilding\n    function rebuild() {\n        if (rebuilding) {\n            return\n        }\n        rebuilding = true\n\n        const tsrv = window.ide.workbench.terminalService\n\n        if (tty == null) {\n            tty = tsrv.createTerminal({\n                name: \"sail\",\n                isRendererOnly: true,\n            }, false)\n        } else {\n            tty.clear()\n        }\n        let oldTTY = tsrv.getActiveInstance()\n        tsrv.setActiveInstance(tty)\n        tsrv.showPanel(true)\n\n        startReloadUI()\n\n        const ws = new WebSocket(\"ws://\" + location.host + \"/sail/api/v1/reload\")\n        ws.onmessage = (ev) => {\n            const msg = JSON.parse(ev.data)\n            const out = atob(msg.v).replace(/\\n/g, \"\\n\\r\")\n            tty.write(out)\n        }\n        ws.onclose = (ev) => {\n            if (ev.code === 1000) {\n                tsrv.setActiveInstance(oldTTY)\n            } else {\n                alert(\"reload failed; please see logs in sail terminal\")\n            }\n            stopReloadUI()\n            rebuilding = false\n        }\n    }\n\n    window.addEventListener(\"ide-ready\", () => {\n        class rebuildAction extends window.ide.workbench.action {\n            run() {\n                rebuild()\n            }\n        }\n\n        window.ide.workbench.actionsRegistry.registerWorkbenchAction(new window.ide.workbench.syncActionDescriptor(rebuildAction, \"sail.rebuild\", \"Rebuild container\", {\n            primary: ((1 << 11) >>> 0) | 48 // That's cmd + R. See vscode source for the magic numbers.\n        }), \"sail: Rebuild container\", \"sail\");\n\n        const statusBarService = window.ide.workbench.statusbarService\n        statusBarService.addEntry({\n            text: \"rebuild\",\n            tooltip: \"Rebuild sail container\",\n            command: \"sail.rebuild\"\n        }, 0)\n    })\n}())\n"
+const sailJS = "(function() {\n    // The phases of a rebuild, in the order they run in. See internal/sailapi.\n    const phaseNames = {\n        \"build\": \"Building image\",\n        \"hat\": \"Applying hat\",\n        \"create\": \"Creating container\",\n        \"wait-online\": \"Waiting for the container to be ready\",\n        \"stop\": \"Stopping the old container\",\n        \"swap\": \"Switching to the new container\",\n        \"rollback\": \"Removing the new container\",\n    }\n\n    let oldonkeydown\n    let progress\n    function startReloadUI(cancel) {\n        const div = document.createElement(\"div\")\n        div.className = \"msgbox-overlay\"\n        div.style.opacity = 1\n        div.style.textAlign = \"center\"\n        div.innerHTML = `<div class=\"msgbox\">\n    <div class=\"msg\">Rebuilding container</div>\n    <ul class=\"sail-phases\" style=\"text-align: left; list-style: none; padding: 0\"></ul>\n    <div class=\"sail-error\" style=\"color: #f48771; white-space: pre-wrap\"></div>\n    <button class=\"sail-cancel\">Cancel</button>\n    </div>`\n        div.querySelector(\".sail-cancel\").onclick = cancel\n        progress = {\n            phases: div.querySelector(\".sail-phases\"),\n            error: div.querySelector(\".sail-error\"),\n            cancel: div.querySelector(\".sail-cancel\"),\n            items: {},\n        }\n        // Prevent keypresses.\n        oldonkeydown = document.body.onkeydown\n        document.body.onkeydown = ev => {\n            ev.stopPropagation()\n        }\n        document.querySelector(\".monaco-workbench\").appendChild(div)\n    }\n\n    // showEvent shows the progress of the rebuild in the overlay.\n    function showEvent(ev) {\n        const v = ev.v || {}\n        let item = progress.items[v.phase]\n        if (!item && ev.type !== \"result\") {\n            item = document.createElement(\"li\")\n            progress.phases.appendChild(item)\n            progress.items[v.phase] = item\n        }\n        const name = phaseNames[v.phase] || v.phase\n        switch (ev.type) {\n        case \"phase_start\":\n            item.textContent = \"\\u25B6 \" + name\n            break\n        case \"step\":\n            item.textContent = `\\u25B6 ${name}: step ${v.step}/${v.steps} ${v.message}`\n            break\n        case \"phase_end\":\n            item.textContent = (v.error ? \"\\u2717 \" : \"\\u2713 \") + name\n            break\n        case \"result\":\n            progress.error.textContent = v.error || \"\"\n            break\n        }\n        // The old container is being replaced, which can't be undone.\n        if (ev.type === \"phase_start\" && (v.phase === \"stop\" || v.phase === \"swap\")) {\n            progress.cancel.disabled = true\n        }\n    }\n\n    function removeElementsByClass(className) {\n        let elements = document.getElementsByClassName(className);\n        for (let e of elements) {\n            e.parentNode.removeChild(e)\n        }\n    }\n\n    function stopReloadUI() {\n        document.body.onkeydown = oldonkeydown\n        removeElementsByClass(\"msgbox-overlay\")\n        progress = null\n    }\n\n    let tty\n    let rebuilding\n    function rebuild() {\n        if (rebuilding) {\n            return\n        }\n        rebuilding = true\n\n        const tsrv = window.ide.workbench.terminalService\n\n        if (tty == null) {\n            tty = tsrv.createTerminal({\n                name: \"sail\",\n                isRendererOnly: true,\n            }, false)\n        } else {\n            tty.clear()\n        }\n        let oldTTY = tsrv.getActiveInstance()\n        tsrv.setActiveInstance(tty)\n        tsrv.showPanel(true)\n\n        // Relative to the page so that it works when the sail daemon\n        // serves the project under a path prefix.\n        const rebuildURL = new URL(\"sail/api/v1/rebuild\", location.href)\n        rebuildURL.protocol = location.protocol === \"https:\" ? \"wss:\" : \"ws:\"\n        const ws = new WebSocket(rebuildURL.href)\n\n        let canceled = false\n        // Closing the socket cancels the rebuild.\n        startReloadUI(() => {\n            canceled = true\n            ws.close()\n        })\n\n        let result\n        ws.onmessage = (msg) => {\n            const ev = JSON.parse(msg.data)\n            switch (ev.type) {\n            case \"data\":\n                tty.write(atob(ev.v).replace(/\\n/g, \"\\n\\r\"))\n                return\n            case \"result\":\n                result = ev.v\n                if (result.error) {\n                    tty.write(result.error.replace(/\\n/g, \"\\n\\r\") + \"\\n\\r\")\n                }\n                break\n            }\n            showEvent(ev)\n        }\n        ws.onclose = () => {\n            stopReloadUI()\n            rebuilding = false\n            if (result && !result.error) {\n                tsrv.setActiveInstance(oldTTY)\n            } else if (!canceled) {\n                alert(\"rebuild failed; please see logs in sail terminal\")\n            }\n        }\n    }\n\n    window.addEventListener(\"ide-ready\", () => {\n        class rebuildAction extends window.ide.workbench.action {\n            run() {\n                rebuild()\n            }\n        }\n\n        window.ide.workbench.actionsRegistry.registerWorkbenchAction(new window.ide.workbench.syncActionDescriptor(rebuildAction, \"sail.rebuild\", \"Rebuild container\", {\n            primary: ((1 << 11) >>> 0) | 48 // That's cmd + R. See vscode source for the magic numbers.\n        }), \"sail: Rebuild container\", \"sail\");\n\n        const statusBarService = window.ide.workbench.statusbarService\n        statusBarService.addEntry({\n            text: \"rebuild\",\n            tooltip: \"Rebuild sail container\",\n            command: \"sail.rebuild\"\n        }, 0)\n    })\n}())\n"
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -19,6 +21,18 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "sail-meta")
+	if err != nil {
+		panic(err)
+	}
+	metaRootDir = dir
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 type params struct {
 	rb     *rollback
 	proj   *project
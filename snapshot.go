@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/go-units"
+	"golang.org/x/xerrors"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+	"go.coder.com/sail/internal/randstr"
+)
+
+const (
+	// snapshotLabel holds the name of a snapshot image.
+	snapshotLabel = sailLabel + ".snapshot"
+	// snapshotProjectLabel holds the container name of the project
+	// a snapshot image was taken from.
+	snapshotProjectLabel = sailLabel + ".snapshot_project"
+
+	// snapshotRepo is the image repository snapshots are stored under.
+	snapshotRepo = "sail-snapshot"
+)
+
+// snapshotNameRe matches valid snapshot names, which are used as image tags.
+var snapshotNameRe = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+
+// snapshotImage returns the image reference of the snapshot name of
+// the project container named cntName.
+func snapshotImage(cntName, name string) string {
+	// Docker image names must be completely lowercase.
+	return fmt.Sprintf("%v/%v:%v", snapshotRepo, strings.ToLower(cntName), name)
+}
+
+// createSnapshot commits the container named cntName to a snapshot image.
+// The image keeps the container's labels so the project can be
+// recreated from it.
+func createSnapshot(cntName, name string) (string, error) {
+	if !snapshotNameRe.MatchString(name) {
+		return "", xerrors.Errorf("invalid snapshot name %q: must be letters, digits, '_', '.' or '-'", name)
+	}
+
+	cli := dockerClient()
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+	defer cancel()
+
+	cnt, err := cli.ContainerInspect(ctx, cntName)
+	if err != nil {
+		return "", xerrors.Errorf("failed to inspect %v: %w", cntName, err)
+	}
+
+	labels := make(map[string]string, len(cnt.Config.Labels)+2)
+	for k, v := range cnt.Config.Labels {
+		labels[k] = v
+	}
+	labels[snapshotLabel] = name
+	labels[snapshotProjectLabel] = cntName
+
+	image := snapshotImage(cntName, name)
+	_, err = cli.ContainerCommit(ctx, cntName, types.ContainerCommitOptions{
+		Reference: image,
+		Comment:   fmt.Sprintf("sail snapshot of %v", toSailName(cntName)),
+		Pause:     true,
+		Config: &container.Config{
+			Labels: labels,
+		},
+	})
+	if err != nil {
+		return "", xerrors.Errorf("failed to commit %v: %w", cntName, err)
+	}
+	return image, nil
+}
+
+type snapshotcmd struct {
+	gf *globalFlags
+}
+
+func (c *snapshotcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "snapshot",
+		Usage: "<repo> [name]",
+		Desc: `Saves the state of a project's container to an image.
+The name defaults to the current time. Mounted directories, like the project
+itself, aren't part of the snapshot. Restore a snapshot with sail restore.`,
+	}
+}
+
+func (c *snapshotcmd) Subcommands() []cli.Command {
+	return []cli.Command{
+		&snapshotLsCmd{gf: c.gf},
+	}
+}
+
+func (c *snapshotcmd) Run(fl *flag.FlagSet) {
+	if fl.NArg() < 1 || fl.NArg() > 2 {
+		fl.Usage()
+		os.Exit(1)
+	}
+	c.gf.ensureDockerDaemon()
+
+	proj := c.gf.projectFromArg(schemaPrefs{}, fl.Arg(0))
+
+	name := fl.Arg(1)
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+
+	image, err := createSnapshot(proj.cntName(), name)
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+	flog.Success("saved snapshot %v as %v", name, image)
+}
+
+type snapshotLsCmd struct {
+	gf *globalFlags
+}
+
+func (c *snapshotLsCmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "ls",
+		Usage: "[repo]",
+		Desc:  "Lists snapshots, optionally only those of a single project.",
+	}
+}
+
+func (c *snapshotLsCmd) Run(fl *flag.FlagSet) {
+	c.gf.ensureDockerDaemon()
+
+	filter := filters.NewArgs()
+	if fl.NArg() > 0 {
+		proj := c.gf.project(schemaPrefs{}, fl)
+		filter.Add("label", snapshotProjectLabel+"="+proj.cntName())
+	} else {
+		filter.Add("label", snapshotProjectLabel)
+	}
+
+	cli := dockerClient()
+	defer cli.Close()
+
+	images, err := cli.ImageList(context.Background(), types.ImageListOptions{
+		Filters: filter,
+	})
+	if err != nil {
+		flog.Fatal("failed to list snapshots: %v", err)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created > images[j].Created
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintf(tw, "project\tname\timage\tcreated\tsize\n")
+	for _, img := range images {
+		cntName := img.Labels[snapshotProjectLabel]
+		name := img.Labels[snapshotLabel]
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n",
+			toSailName(cntName),
+			name,
+			snapshotImage(cntName, name),
+			time.Unix(img.Created, 0).Format("2006-01-02 15:04:05"),
+			units.HumanSize(float64(img.Size)),
+		)
+	}
+	tw.Flush()
+}
+
+type restorecmd struct {
+	gf *globalFlags
+}
+
+func (c *restorecmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "restore",
+		Usage: "<repo> <name>",
+		Desc: `Recreates a project's container from a snapshot taken with sail snapshot.
+The container is recreated with the same mounts, so the project directory is kept.
+If the project is running, it's replaced once the restored container is ready and
+can be swapped back with sail edit -rollback.`,
+	}
+}
+
+func (c *restorecmd) Run(fl *flag.FlagSet) {
+	if fl.NArg() != 2 {
+		fl.Usage()
+		os.Exit(1)
+	}
+	c.gf.ensureDockerDaemon()
+
+	proj := c.gf.projectFromArg(schemaPrefs{}, fl.Arg(0))
+
+	err := restoreSnapshot(c.gf.configPath, proj, fl.Arg(1))
+	if err != nil {
+		flog.Fatal("failed to restore snapshot: %v", err)
+	}
+	flog.Success("restored %v from snapshot %v", proj.cntName(), fl.Arg(1))
+}
+
+// restoreSnapshot recreates the project's container from the snapshot name.
+// If the project's container exists, the restored container replaces it like
+// sail edit does. Otherwise it's created from the state stored on the snapshot,
+// and its proxy is started with the global config at configPath.
+func restoreSnapshot(configPath string, proj *project, name string) (err error) {
+	cli := dockerClient()
+	defer cli.Close()
+
+	ctx := context.Background()
+
+	image := snapshotImage(proj.cntName(), name)
+	img, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return xerrors.Errorf("failed to find snapshot %v: %w", name, err)
+	}
+
+	// The containers are renamed like with sail edit, which mustn't run
+	// at the same time.
+	unlock, err := lockEdit(ctx, proj.cntName())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	exists, err := proj.cntExists()
+	if err != nil {
+		return err
+	}
+
+	var r *runner
+	if exists {
+		r, err = runnerFromContainer(proj.cntName())
+		if err != nil {
+			return xerrors.Errorf("failed to initialize runner: %w", err)
+		}
+		r.cntName = proj.cntName() + "-restore-" + randstr.Make(5)
+		r.rebuilt = true
+	} else {
+		r = runnerFromConfig(proj.cntName(), img.Config)
+	}
+	// Let code-server pick a free port so it doesn't collide with
+	// a running container of the project.
+	r.port = "0"
+
+	err = r.applyConfig(proj.conf)
+	if err != nil {
+		return xerrors.Errorf("invalid project config: %w", err)
+	}
+
+	if !exists {
+		err = r.startProxy(configPath)
+		if err != nil {
+			return xerrors.Errorf("failed to start proxy: %w", err)
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			removeErr := removeIfExists(ctx, cli, r.cntName)
+			if removeErr != nil {
+				flog.Error("failed to remove %v: %v", r.cntName, removeErr)
+			}
+		}
+	}()
+	err = r.runContainer(image)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := proj.onlineTimeout()
+	if err != nil {
+		return err
+	}
+	err = waitOnline(r.cntName, timeout)
+	if err != nil {
+		return err
+	}
+	err = waitReady(r.cntName)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return r.registerProxy()
+	}
+
+	err = swapContainers(ctx, cli, proj, r.cntName)
+	if err != nil {
+		return err
+	}
+
+	refreshErr := refreshProxy(proj.cntName())
+	if refreshErr != nil {
+		flog.Error("failed to refresh proxy: %v", refreshErr)
+	}
+	keepErr := keepPrevious(ctx, cli, proj)
+	if keepErr != nil {
+		flog.Error("failed to keep previous container: %v", keepErr)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_snapshotImage(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "sail-snapshot/cdr_sail:before-upgrade", snapshotImage("cdr_sail", "before-upgrade"))
+	assert.Equal(t, "sail-snapshot/nhooyr_websocket:20191019-150405", snapshotImage("nhooyr_WebSocket", "20191019-150405"))
+
+	for _, name := range []string{"v1.2", "before_upgrade", "20191019-150405"} {
+		assert.True(t, snapshotNameRe.MatchString(name), name)
+	}
+	for _, name := range []string{"", "-leading-dash", "has space", "a:b", "a/b"} {
+		assert.False(t, snapshotNameRe.MatchString(name), name)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+
+	"go.coder.com/cli"
+	"go.coder.com/flog"
+)
+
+type stopcmd struct {
+	gf *globalFlags
+}
+
+func (c *stopcmd) Spec() cli.CommandSpec {
+	return cli.CommandSpec{
+		Name:  "stop",
+		Usage: "<repo>",
+		Desc: `Stops a project's container after running its on_stop hook.
+The container is kept, and is started again by sail run.`,
+	}
+}
+
+func (c *stopcmd) Run(fl *flag.FlagSet) {
+	proj := c.gf.project(schemaPrefs{}, fl)
+	c.gf.ensureDockerDaemon()
+	proj.requireRunning()
+
+	err := stopContainer(proj.cntName())
+	if err != nil {
+		flog.Fatal("%v", err)
+	}
+	flog.Info("stopped %v", proj.cntName())
+}
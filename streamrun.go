@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"go.coder.com/sail/internal/sailapi"
+)
+
+// streamRunGrace is how long sail gets to clean up once the run is canceled
+// before it's killed.
+const streamRunGrace = time.Second * 30
+
+// sailCommand returns the command running sail with args. Children of
+// sail must read the same config, so it's passed with -config unless
+// configPath is empty.
+func sailCommand(configPath string, args ...string) *exec.Cmd {
+	if configPath != "" {
+		args = append([]string{"-config", configPath}, args...)
+	}
+	return exec.Command(os.Args[0], args...)
+}
+
+// streamRun runs sail with args and sends its output to emit as data events,
+// along with the phase and step events sail writes to rebuildEventsEnv.
+// configPath is passed on as with sailCommand. It returns why sail failed. No result event is sent, as callers may have
+// more to do. Canceling ctx interrupts sail so it can clean up.
+func streamRun(ctx context.Context, configPath string, emit func(sailapi.Event) error, args ...string) error {
+	var mu sync.Mutex
+	lockedEmit := func(e sailapi.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return emit(e)
+	}
+
+	readEvents, writeEvents, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readEvents.Close()
+
+	readOut, writeOut := io.Pipe()
+
+	sail := sailCommand(configPath, args...)
+	// The events pipe is the first of ExtraFiles, so it's fd 3.
+	sail.Env = append(os.Environ(), "EDITOR=true", rebuildEventsEnv+"=3")
+	sail.ExtraFiles = []*os.File{writeEvents}
+	sail.Stdout = writeOut
+	sail.Stderr = writeOut
+	// Interrupt docker and the other commands sail runs too.
+	sail.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = sail.Start()
+	writeEvents.Close()
+	if err != nil {
+		return xerrors.Errorf("failed to start %q: %w", sail.Args, err)
+	}
+
+	// sail's result is the reason it failed, which is returned instead of
+	// being sent.
+	var result string
+	eventsDone := make(chan struct{})
+	go func() {
+		defer close(eventsDone)
+		s := bufio.NewScanner(readEvents)
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			var e sailapi.Event
+			err := json.Unmarshal(s.Bytes(), &e)
+			if err != nil {
+				continue
+			}
+			if e.Type == sailapi.EventResult {
+				result = e.Error
+				continue
+			}
+			lockedEmit(e)
+		}
+	}()
+
+	waitDone := make(chan struct{})
+	go func() {
+		werr := sail.Wait()
+		writeOut.CloseWithError(werr)
+		close(waitDone)
+	}()
+
+	go func() {
+		select {
+		case <-waitDone:
+			return
+		case <-ctx.Done():
+		}
+		syscall.Kill(-sail.Process.Pid, syscall.SIGTERM)
+		select {
+		case <-waitDone:
+		case <-time.After(streamRunGrace):
+			syscall.Kill(-sail.Process.Pid, syscall.SIGKILL)
+		}
+	}()
+
+	runErr := func() error {
+		for {
+			b := make([]byte, 4096)
+			n, rerr := readOut.Read(b)
+
+			if n > 0 {
+				err := lockedEmit(sailapi.Event{
+					Type:   sailapi.EventData,
+					Output: b[:n],
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			if rerr == io.EOF {
+				return nil
+			}
+			if rerr != nil {
+				return rerr
+			}
+		}
+	}()
+	if runErr != nil {
+		// Keep draining the output so sail doesn't block on it.
+		go io.Copy(ioutil.Discard, readOut)
+		select {
+		case <-waitDone:
+		default:
+			syscall.Kill(-sail.Process.Pid, syscall.SIGTERM)
+		}
+	}
+	<-waitDone
+	<-eventsDone
+
+	switch {
+	case ctx.Err() != nil:
+		return xerrors.Errorf("sail %v canceled: %w", args[0], ctx.Err())
+	case result != "":
+		return xerrors.New(result)
+	case runErr != nil:
+		return xerrors.Errorf("sail %v failed: %w", args[0], runErr)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sailCommand(t *testing.T) {
+	t.Parallel()
+
+	cmd := sailCommand("/tmp/other.toml", "proxy", "cdr_sail")
+	assert.Equal(t, []string{os.Args[0], "-config", "/tmp/other.toml", "proxy", "cdr_sail"}, cmd.Args)
+
+	cmd = sailCommand("", "run", "cdr/sail")
+	assert.Equal(t, []string{os.Args[0], "run", "cdr/sail"}, cmd.Args)
+}